@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/config"
+)
+
+// healthcheck requests /readyz from the HTTP API configured by args and the
+// environment, for container health checks. It returns the exit status.
+func healthcheck(args []string) int {
+	cfg, _, err := config.Load(args, os.Getenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		return 2
+	}
+	url, err := readyURL(cfg.HTTP.Addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid HTTP address: %v\n", err)
+		return 2
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Not ready: %v\n", err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Not ready: %s\n", resp.Status)
+		return 1
+	}
+	return 0
+}
+
+// readyURL returns the readiness URL of a listen address, using loopback
+// when the address listens on all interfaces
+func readyURL(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/readyz", nil
+}
@@ -1,54 +1,289 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/joukojo/go-mail-testserver/internal/commonssmtp"
+	"github.com/joukojo/go-mail-testserver/internal/config"
 	httpapi "github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/imapserver"
+	"github.com/joukojo/go-mail-testserver/internal/logging"
+	"github.com/joukojo/go-mail-testserver/internal/pop3"
+	"github.com/joukojo/go-mail-testserver/internal/relay"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.revision=..."
+var (
+	version  = "dev"
+	revision = "" // defaults to the VCS revision recorded by the toolchain
 )
 
 func main() {
-	fmt.Println("Mailserver")
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(healthcheck(os.Args[2:]))
+	}
 
-	storage := httpapi.NewStorage()
+	cfg, opts, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	smtpAddr := getenv("SMTP_ADDR", ":1025")
-	httpAddr := getenv("HTTP_ADDR", ":8025")
+	// Already validated by config.Load
+	logLevel := new(slog.LevelVar)
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logLevel.Set(level)
+	logger, _ := logging.New(os.Stderr, cfg.Log.Format, logLevel)
+	slog.SetDefault(logger)
 
-	fmt.Printf("Starting SMTP server at %s\n", smtpAddr)
-	smtpServer := commonssmtp.NewSmtpServer(storage, smtpAddr)
-	fmt.Printf("Starting HTTP server at %s\n", httpAddr)
-	apiServer := httpapi.New(httpAddr, storage)
+	slog.Info("starting mail-testserver", "version", version, "commit", commit(), "config", opts.ConfigFile)
 
+	storage := httpapi.NewStorage()
 	go func() {
-		if err := smtpServer.Start(); err != nil {
-			fmt.Printf("SMTP server error: %v\n", err)
-			os.Exit(1)
+		for range time.Tick(time.Minute) {
+			storage.Prune()
 		}
 	}()
 
-	go func() {
-		if err := apiServer.Start(); err != nil {
-			fmt.Printf("HTTP server error: %v\n", err)
+	slog.Info("starting SMTP server", "addr", cfg.SMTP.Addr)
+	mailServers := []*commonssmtp.SmtpServer{commonssmtp.NewSmtpServer(storage, cfg.SMTP.Addr)}
+
+	if cfg.LMTP.Addr != "" {
+		slog.Info("starting LMTP server", "addr", cfg.LMTP.Addr)
+		mailServers = append(mailServers, commonssmtp.NewLmtpServer(storage, cfg.LMTP.Addr))
+	}
+
+	smtpTLS := loadTLS("SMTP", cfg.SMTP.TLSCert, cfg.SMTP.TLSKey)
+	for _, srv := range mailServers {
+		srv.SetTimeout(time.Duration(cfg.SMTP.TimeoutSeconds) * time.Second)
+		if smtpTLS != nil {
+			srv.SetTLSConfig(smtpTLS)
+		}
+	}
+
+	var relayer *relay.Relayer
+	if cfg.Relay.Addr != "" {
+		relayer = relay.New(storage, relay.Config{
+			Addr:          cfg.Relay.Addr,
+			Username:      cfg.Relay.Username,
+			Password:      cfg.Relay.Password,
+			StartTLS:      cfg.Relay.StartTLS,
+			MaxAttempts:   cfg.Relay.MaxAttempts,
+			RetryInterval: time.Duration(cfg.Relay.RetrySeconds) * time.Second,
+		}, nil)
+		relayer.Start()
+		for _, srv := range mailServers {
+			srv.SetRelayer(relayer)
+		}
+		slog.Info("relaying enabled", "upstream", cfg.Relay.Addr)
+	}
+	slog.Info("starting HTTP server", "addr", cfg.HTTP.Addr)
+	apiServer := httpapi.New(cfg.HTTP.Addr, storage)
+	if cfg.HTTP.MailHogPrefix != "" {
+		apiServer.SetMailHogPrefix(cfg.HTTP.MailHogPrefix)
+		slog.Info("serving MailHog compatible API", "prefix", cfg.HTTP.MailHogPrefix)
+	}
+	if cfg.HTTP.MailpitPrefix != "" {
+		apiServer.SetMailpitPrefix(cfg.HTTP.MailpitPrefix)
+		slog.Info("serving Mailpit compatible API", "prefix", cfg.HTTP.MailpitPrefix)
+	}
+	if cfg.Storage.SnapshotDir != "" {
+		if err := apiServer.SetSnapshotDir(cfg.Storage.SnapshotDir); err != nil {
+			slog.Error("failed to create snapshot directory", "error", err)
 			os.Exit(1)
 		}
-	}()
+	}
+
+	// The registry is shared so reloads can enable tenants later
+	registry, _ := tenant.New(nil, "")
+	apiServer.SetTenants(registry)
+	for _, srv := range mailServers {
+		srv.SetTenants(registry)
+	}
+
+	reloader := &reloader{
+		storage:     storage,
+		mailServers: mailServers,
+		apiServer:   apiServer,
+		relayer:     relayer,
+		registry:    registry,
+		logLevel:    logLevel,
+	}
+	if err := reloader.apply(cfg); err != nil {
+		slog.Error("configuration error", "error", err)
+		os.Exit(1)
+	}
+	apiServer.SetIngester(mailServers[0].Ingest)
+	apiServer.SetReloader(reloader.Reload)
+	apiServer.SetInfo(httpapi.Info{
+		Version: version,
+		Commit:  commit(),
+		Config:  func() any { return reloader.config().Redacted() },
+	})
+	apiServer.AddReadinessCheck("smtp", mailServers[0].Check)
+	if len(mailServers) > 1 {
+		apiServer.AddReadinessCheck("lmtp", mailServers[1].Check)
+	}
 
-	fmt.Printf("Starting HTTP server at %s\n", httpAddr)
+	// Servers report failures here, a clean shutdown returns nil
+	errs := make(chan error, 8)
+	run := func(name string, start func() error) {
+		go func() {
+			if err := start(); err != nil {
+				errs <- fmt.Errorf("%s server error: %w", name, err)
+			}
+		}()
+	}
+
+	for _, srv := range mailServers {
+		run("SMTP", srv.Start)
+	}
+	run("HTTP", apiServer.Start)
+
+	var closers []func() error
 
-	// Graceful shutdown on SIGINT/SIGTERM
+	if cfg.POP3.Addr != "" {
+		slog.Info("starting POP3 server", "addr", cfg.POP3.Addr)
+		pop3Server := pop3.New(storage, cfg.POP3.Addr)
+		pop3Server.Shared = cfg.POP3.Shared
+		pop3Server.Tenants = registry
+		pop3Server.TLSConfig = loadTLS("POP3", cfg.POP3.TLSCert, cfg.POP3.TLSKey)
+
+		run("POP3", pop3Server.Start)
+		closers = append(closers, pop3Server.Close)
+	}
+
+	if cfg.IMAP.Addr != "" {
+		slog.Info("starting IMAP server", "addr", cfg.IMAP.Addr)
+		imapServer := imapserver.New(storage, cfg.IMAP.Addr, cfg.IMAP.Shared, nil)
+		imapServer.SetTenants(registry)
+		if tlsConfig := loadTLS("IMAP", cfg.IMAP.TLSCert, cfg.IMAP.TLSKey); tlsConfig != nil {
+			imapServer.SetTLSConfig(tlsConfig)
+		}
+
+		run("IMAP", imapServer.Start)
+		closers = append(closers, imapServer.Close)
+	}
+
+	// Reload on SIGHUP, graceful shutdown on SIGINT/SIGTERM
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	<-stop
 
+	status := 0
+wait:
+	for {
+		select {
+		case <-hup:
+			if err := reloader.Reload(); err != nil {
+				slog.Error("reload failed, keeping the current configuration", "error", err)
+			}
+		case sig := <-stop:
+			slog.Info("shutting down", "signal", sig.String())
+			break wait
+		case err := <-errs:
+			slog.Error("server failed", "error", err)
+			status = 1
+			break wait
+		}
+	}
+
+	timeout := time.Duration(reloader.config().ShutdownTimeoutSeconds) * time.Second
+	if !shutdown(timeout, mailServers, apiServer, closers) {
+		status = 1
+	}
+	if relayer != nil {
+		relayer.Stop()
+	}
+	os.Exit(status)
+}
+
+// shutdown stops accepting mail and lets transactions in progress finish,
+// then stops the HTTP API and the mailbox servers. It reports whether
+// everything stopped within timeout. Messages are kept in memory only and
+// do not outlive the process.
+func shutdown(timeout time.Duration, mailServers []*commonssmtp.SmtpServer, apiServer *httpapi.Server, closers []func() error) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	clean := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, srv := range mailServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Error("SMTP shutdown failed", "error", err)
+				mu.Lock()
+				clean = false
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := apiServer.Shutdown(ctx); err != nil {
+		slog.Error("HTTP shutdown failed", "error", err)
+		clean = false
+	}
+	for _, closeServer := range closers {
+		if err := closeServer(); err != nil {
+			slog.Error("shutdown failed", "error", err)
+			clean = false
+		}
+	}
+	return clean
 }
 
-func getenv(k, def string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+// commit returns the build commit
+func commit() string {
+	if revision != "" {
+		return revision
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
+// loadTLS returns a TLS configuration for the certificate pair, or nil
+// when no certificate is configured
+func loadTLS(name, cert, key string) *tls.Config {
+	if cert == "" {
+		return nil
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		slog.Error("TLS configuration error", "server", name, "error", err)
+		os.Exit(1)
 	}
-	return def
+	return &tls.Config{Certificates: []tls.Certificate{pair}}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/commonssmtp"
+	"github.com/joukojo/go-mail-testserver/internal/config"
+	httpapi "github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/logging"
+	"github.com/joukojo/go-mail-testserver/internal/relay"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+// reloader applies configuration changes to the running servers. Tenants,
+// tagging rules, fault rules, relay rules, retention, SMTP limits, link
+// check hosts and the log level change in place, connections and stored
+// messages are kept.
+type reloader struct {
+	storage     *httpapi.Storage
+	mailServers []*commonssmtp.SmtpServer
+	apiServer   *httpapi.Server
+	relayer     *relay.Relayer // nil when relaying is disabled
+	registry    *tenant.Registry
+	logLevel    *slog.LevelVar
+
+	mu  sync.Mutex
+	cfg config.Config
+}
+
+// Reload reads the configuration again from the same file, environment
+// and flags as at startup. An invalid configuration changes nothing.
+func (r *reloader) Reload() error {
+	cfg, _, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	restart := fixed(cfg) != fixed(r.cfg)
+	r.mu.Unlock()
+
+	if err := r.apply(cfg); err != nil {
+		return err
+	}
+	slog.Info("configuration reloaded")
+	if restart {
+		slog.Warn("listener, TLS, timeout, storage backend, log format and relay upstream changes take effect after a restart")
+	}
+	return nil
+}
+
+// apply loads and validates the tenants, tagging, fault and relay rules
+// before changing anything, so a failed reload keeps the running
+// configuration
+func (r *reloader) apply(cfg config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var tenants []tenant.Tenant
+	if cfg.Auth.TenantsFile != "" {
+		var err error
+		if tenants, err = tenant.Load(cfg.Auth.TenantsFile); err != nil {
+			return err
+		}
+	}
+	if err := tenant.Validate(tenants, cfg.Auth.AdminToken); err != nil {
+		return err
+	}
+	var tagRules []httpapi.TagRule
+	if cfg.Storage.TagRulesFile != "" {
+		var err error
+		if tagRules, err = httpapi.LoadTagRules(cfg.Storage.TagRulesFile); err != nil {
+			return err
+		}
+	}
+	faultRules, err := commonssmtp.ParseFaultRules(cfg.FaultRules)
+	if err != nil {
+		return fmt.Errorf("faultRules: %w", err)
+	}
+	relayRules, err := relay.ParseRules(cfg.Relay.RecipientRegex, cfg.Relay.SenderDomains)
+	if err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+
+	// Validated above
+	r.registry.Set(tenants, cfg.Auth.AdminToken)
+	if cfg.Auth.TenantsFile != "" {
+		slog.Info("tenants loaded", "count", len(tenants))
+	}
+	// The file replaces rules set through the API, removing it clears them
+	if cfg.Storage.TagRulesFile != "" || r.cfg.Storage.TagRulesFile != "" {
+		r.storage.SetTagRules(tagRules)
+		slog.Info("tag rules loaded", "count", len(tagRules))
+	}
+
+	for _, srv := range r.mailServers {
+		srv.SetFaultRules(faultRules)
+		srv.SetLimits(int64(cfg.SMTP.MaxMessageBytes), cfg.SMTP.MaxRecipients)
+	}
+	r.apiServer.SetMaxMessageBytes(int64(cfg.SMTP.MaxMessageBytes))
+	r.apiServer.SetLinkCheckHosts(strings.FieldsFunc(cfg.HTTP.LinkCheckHosts, func(c rune) bool { return c == ',' || c == ' ' }))
+	if r.relayer != nil {
+		r.relayer.SetRules(relayRules)
+		slog.Info("relay rules loaded", "count", len(relayRules))
+	}
+	r.storage.SetRetention(cfg.Storage.MaxMessages, time.Duration(cfg.Storage.MaxAgeSeconds)*time.Second)
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	r.logLevel.Set(level)
+
+	r.cfg = cfg
+	return nil
+}
+
+func (r *reloader) config() config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// fixed returns the settings that only apply at startup
+func fixed(cfg config.Config) config.Config {
+	cfg.Auth = config.Auth{}
+	cfg.FaultRules = ""
+	cfg.Relay.RecipientRegex, cfg.Relay.SenderDomains = "", ""
+	cfg.SMTP.MaxMessageBytes, cfg.SMTP.MaxRecipients = 0, 0
+	cfg.Storage.MaxMessages, cfg.Storage.MaxAgeSeconds = 0, 0
+	cfg.Storage.TagRulesFile = ""
+	cfg.ShutdownTimeoutSeconds = 0
+	cfg.Log.Level = ""
+	cfg.HTTP.LinkCheckHosts = ""
+	return cfg
+}
@@ -4,4 +4,12 @@ go 1.25.5
 
 require github.com/emersion/go-smtp v0.24.0
 
-require github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6 // indirect
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-message v0.18.2
+	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/text v0.41.0 // indirect
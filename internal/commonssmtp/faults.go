@@ -0,0 +1,85 @@
+package commonssmtp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+// Fault stages
+const (
+	StageRcpt = "rcpt" // reject the recipient at RCPT TO
+	StageData = "data" // reject the recipient after DATA
+)
+
+// FaultRule fails recipients matching Recipient with an SMTP error
+type FaultRule struct {
+	Recipient *regexp.Regexp
+	Stage     string
+	Code      int
+	Message   string
+}
+
+func (r FaultRule) err() *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         r.Code,
+		EnhancedCode: smtp.EnhancedCodeNotSet,
+		Message:      r.Message,
+	}
+}
+
+// matchFault returns the error of the first rule matching rcpt in stage
+func matchFault(rules []FaultRule, stage, rcpt string) error {
+	for _, r := range rules {
+		if r.Stage == stage && r.Recipient.MatchString(rcpt) {
+			return r.err()
+		}
+	}
+	return nil
+}
+
+// ParseFaultRules parses rules separated by ';' in the form
+// "[stage:]regex=code[ message]", e.g.
+// "bounce@.*=550 Mailbox unavailable;data:flaky@.*=451 Try again later".
+// The stage defaults to rcpt.
+func ParseFaultRules(spec string) ([]FaultRule, error) {
+	var rules []FaultRule
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		stage := StageRcpt
+		for _, st := range []string{StageRcpt, StageData} {
+			if strings.HasPrefix(part, st+":") {
+				stage, part = st, strings.TrimPrefix(part, st+":")
+			}
+		}
+
+		i := strings.LastIndex(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("fault rule %q: missing '=code'", part)
+		}
+		pattern, reply := part[:i], strings.TrimSpace(part[i+1:])
+
+		codeStr, msg, _ := strings.Cut(reply, " ")
+		code, err := strconv.Atoi(codeStr)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("fault rule %q: invalid reply code %q", part, codeStr)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("fault rule %q: %w", part, err)
+		}
+		if msg == "" {
+			msg = "Recipient rejected by fault rule"
+		}
+
+		rules = append(rules, FaultRule{Recipient: re, Stage: stage, Code: code, Message: msg})
+	}
+	return rules, nil
+}
@@ -0,0 +1,61 @@
+package commonssmtp
+
+import (
+	"log/slog"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+// delivery is a received message and its envelope
+type delivery struct {
+	from      string
+	to        []string
+	raw       []byte
+	username  string // SMTP AUTH user, routes the message to a tenant
+	tenant    string // set when the sender's tenant is already known
+	sessionID string
+	log       *slog.Logger
+}
+
+// ingest is the path of every received message: it parses the message,
+// routes it to a tenant, applies the data stage fault rules, stores it for
+// the accepted recipients, queues it for relaying and counts it. With
+// partial unset any rejected recipient rejects the whole message, as plain
+// SMTP has a single reply for DATA. It returns the stored message, nil when
+// nothing was stored, and the error of each rejected recipient.
+func (b *backend) ingest(d delivery, partial bool) (int, map[string]error) {
+	msg := httpapi.NewMessage(d.from, d.to, d.raw)
+	msg.Tenant = d.tenant
+	if msg.Tenant == "" {
+		msg.Tenant = b.tenants.Route(d.username, d.to)
+	}
+	msg.SessionID = d.sessionID
+
+	rules := b.faultRules()
+	rejected := make(map[string]error)
+	var accepted []string
+	for _, rcpt := range d.to {
+		if err := matchFault(rules, StageData, rcpt); err != nil {
+			d.log.Info("recipient rejected by fault rule", "rcpt", rcpt, "error", err)
+			countRejected(err)
+			rejected[rcpt] = err
+			if !partial {
+				return 0, rejected
+			}
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		return 0, rejected
+	}
+	msg.To = accepted
+
+	id := b.store.Add(msg)
+	messagesTotal.Inc("accepted", "250")
+	d.log.Info("message stored", "id", id, "from", d.from, "to", accepted, "bytes", len(d.raw), "tenant", msg.Tenant)
+	if b.relayer != nil {
+		b.relayer.Enqueue(msg)
+	}
+	return id, rejected
+}
@@ -0,0 +1,34 @@
+package commonssmtp
+
+import (
+	"errors"
+	"strconv"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/joukojo/go-mail-testserver/internal/metrics"
+)
+
+var (
+	connectionsTotal = metrics.Default.NewCounter("mailserver_smtp_connections_total",
+		"SMTP and LMTP connections accepted.")
+	messagesTotal = metrics.Default.NewCounter("mailserver_smtp_messages_total",
+		"Messages and recipients accepted or rejected, by reply code.", "result", "code")
+	receivedBytesTotal = metrics.Default.NewCounter("mailserver_smtp_received_bytes_total",
+		"Bytes received in DATA.")
+	authFailuresTotal = metrics.Default.NewCounter("mailserver_smtp_auth_failures_total",
+		"Failed AUTH attempts.")
+	tlsSessionsTotal = metrics.Default.NewCounter("mailserver_smtp_tls_sessions_total",
+		"Sessions that used TLS.")
+	dataSize = metrics.Default.NewHistogram("mailserver_smtp_data_size_bytes",
+		"Size of messages received in DATA.", metrics.ExponentialBuckets(1024, 4, 8))
+	sessionDuration = metrics.Default.NewHistogram("mailserver_smtp_session_duration_seconds",
+		"Duration of SMTP and LMTP sessions.", []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300})
+)
+
+// countRejected counts err as a rejection when it carries an SMTP reply
+func countRejected(err error) {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		messagesTotal.Inc("rejected", strconv.Itoa(smtpErr.Code))
+	}
+}
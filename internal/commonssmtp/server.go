@@ -1,84 +1,452 @@
 package commonssmtp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	smtp "github.com/emersion/go-smtp"
 	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/logging"
+	"github.com/joukojo/go-mail-testserver/internal/relay"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
 )
 
 type SmtpServer struct {
 	storage    *httpapi.Storage
 	backend    *backend
 	SmtpServer *smtp.Server
+
+	listenMu sync.Mutex
+	listener net.Addr // set once serving, used by Check
 }
 
 type backend struct {
-	store *httpapi.Storage
+	store   *httpapi.Storage
+	relayer *relay.Relayer
+	tenants *tenant.Registry
+
+	mu              sync.RWMutex
+	faults          []FaultRule
+	maxMessageBytes int64
+	maxRecipients   int
+
+	connMu sync.Mutex
+	conns  map[*smtp.Conn]bool // open connections, true while in a transaction
 }
 
+// probeHello is the greeting Check uses, so that readiness probes are kept
+// out of the metrics and the log
+const probeHello = "mail-testserver-readiness-probe"
+
 func (b *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	// Allow any session for local testing.
-	return &session{storage: b.store}, nil
+	b.connMu.Lock()
+	b.conns[c] = false
+	b.connMu.Unlock()
+
+	if isProbe(c) {
+		return &session{backend: b, conn: c, probe: true, log: slog.New(slog.DiscardHandler)}, nil
+	}
+	connectionsTotal.Inc()
+
+	id := logging.NewID()
+	log := slog.With("session", id, "remote", c.Conn().RemoteAddr().String())
+	log.Debug("smtp session started")
+	return &session{backend: b, conn: c, id: id, log: log, started: time.Now()}, nil
+}
+
+// isProbe reports whether c is a readiness probe from this host. The
+// session starts with the greeting, so Hostname is already known.
+func isProbe(c *smtp.Conn) bool {
+	if c.Hostname() != probeHello {
+		return false
+	}
+	switch addr := c.Conn().RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+func (b *backend) setBusy(c *smtp.Conn, busy bool) {
+	b.connMu.Lock()
+	defer b.connMu.Unlock()
+	if _, open := b.conns[c]; open {
+		b.conns[c] = busy
+	}
+}
+
+func (b *backend) forget(c *smtp.Conn) {
+	b.connMu.Lock()
+	defer b.connMu.Unlock()
+	delete(b.conns, c)
+}
+
+// closeConns closes the idle connections, or all of them when force is set
+func (b *backend) closeConns(force bool) {
+	b.connMu.Lock()
+	var conns []*smtp.Conn
+	for c, busy := range b.conns {
+		if force || !busy {
+			conns = append(conns, c)
+			delete(b.conns, c)
+		}
+	}
+	b.connMu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (b *backend) faultRules() []FaultRule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.faults
+}
+
+func (b *backend) limits() (maxMessageBytes int64, maxRecipients int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.maxMessageBytes, b.maxRecipients
 }
 
 type session struct {
-	storage *httpapi.Storage
-	from    string
-	to      []string
+	backend  *backend
+	conn     *smtp.Conn
+	id       string // stored on the messages of the session
+	log      *slog.Logger
+	started  time.Time
+	probe    bool   // readiness probe, not counted or logged
+	username string // set by AUTH
+	from     string
+	to       []string
+}
+
+// AuthMechanisms implements smtp.AuthSession. Authentication is optional,
+// the user name only routes messages to a tenant.
+func (s *session) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (s *session) Auth(mech string) (sasl.Server, error) {
+	if mech != sasl.Plain {
+		authFailuresTotal.Inc()
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+	return countingServer{sasl.NewPlainServer(func(identity, username, password string) error {
+		// Any password is accepted for local testing
+		s.username = username
+		return nil
+	})}, nil
+}
+
+// countingServer counts malformed SASL exchanges as auth failures
+type countingServer struct {
+	sasl.Server
+}
+
+func (c countingServer) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := c.Server.Next(response)
+	if err != nil {
+		authFailuresTotal.Inc()
+	}
+	return challenge, done, err
 }
 
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if maxBytes, _ := s.backend.limits(); opts != nil && opts.Size > maxBytes {
+		s.log.Info("message rejected", "from", from, "size", opts.Size, "reason", "too large")
+		countRejected(smtp.ErrDataTooLarge)
+		return smtp.ErrDataTooLarge
+	}
+	s.backend.setBusy(s.conn, true)
 	s.from = from
 	s.to = nil
 	return nil
 }
 
 func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if _, maxRcpt := s.backend.limits(); len(s.to) >= maxRcpt {
+		err := &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      fmt.Sprintf("Maximum limit of %v recipients reached", maxRcpt),
+		}
+		countRejected(err)
+		return err
+	}
+	if err := matchFault(s.backend.faultRules(), StageRcpt, to); err != nil {
+		s.log.Info("recipient rejected by fault rule", "rcpt", to, "error", err)
+		countRejected(err)
+		return err
+	}
 	s.to = append(s.to, to)
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
-	raw, err := io.ReadAll(r)
+	raw, err := s.read(r)
 	if err != nil {
 		return err
 	}
-	s.storage.Add(msgFromRaw(s.from, s.to, raw))
+	// Plain SMTP has a single reply for DATA, any failing recipient fails it
+	_, rejected := s.backend.ingest(s.delivery(raw), false)
+	for _, err := range rejected {
+		return err // holds only the first failing recipient
+	}
 	return nil
 }
 
-func msgFromRaw(s1 string, s2 []string, raw []byte) *httpapi.Message {
-	return &httpapi.Message{
-		From: s1,
-		To:   s2,
-		Body: string(raw),
-		Raw:  raw,
+// LMTPData implements smtp.LMTPSession with a reply per recipient
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	raw, err := s.read(r)
+	if err != nil {
+		return err
+	}
+	_, rejected := s.backend.ingest(s.delivery(raw), true)
+	for _, rcpt := range s.to {
+		status.SetStatus(rcpt, rejected[rcpt])
 	}
+	return nil
+}
+
+func (s *session) delivery(raw []byte) delivery {
+	return delivery{from: s.from, to: s.to, raw: raw, username: s.username, sessionID: s.id, log: s.log}
 }
 
-func (s *session) Reset()        {}
-func (s *session) Logout() error { return nil }
+// read reads the message, failing when it exceeds the size limit
+func (s *session) read(r io.Reader) ([]byte, error) {
+	maxBytes, _ := s.backend.limits()
+	raw, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	receivedBytesTotal.Add(float64(len(raw)))
+	if int64(len(raw)) > maxBytes {
+		s.log.Info("message rejected", "from", s.from, "reason", "too large")
+		countRejected(smtp.ErrDataTooLarge)
+		return nil, smtp.ErrDataTooLarge
+	}
+	dataSize.Observe(float64(len(raw)))
+	return raw, nil
+}
+
+// Reset ends the transaction, DATA is always followed by a reset
+func (s *session) Reset() {
+	s.backend.setBusy(s.conn, false)
+}
+
+func (s *session) Logout() error {
+	s.backend.forget(s.conn)
+	if s.probe {
+		return nil
+	}
+	if _, isTLS := s.conn.TLSConnectionState(); isTLS {
+		tlsSessionsTotal.Inc()
+	}
+	sessionDuration.Observe(time.Since(s.started).Seconds())
+	s.log.Debug("smtp session closed")
+	return nil
+}
 
 // --- HTTP API ---
 
 func NewSmtpServer(storage *httpapi.Storage, addr string) *SmtpServer {
-	be := &backend{store: storage}
+	be := &backend{
+		store:           storage,
+		conns:           make(map[*smtp.Conn]bool),
+		maxMessageBytes: 10 << 20, // 10 MB
+		maxRecipients:   50,
+	}
 
+	// Size and recipient limits are enforced by the backend so they can be
+	// changed while the server runs
 	s := smtp.NewServer(be)
 	s.Addr = addr
 	s.Domain = "localhost"
 	s.AllowInsecureAuth = true // OK for local testing only
 	s.ReadTimeout = 10 * time.Second
 	s.WriteTimeout = 10 * time.Second
-	s.MaxMessageBytes = 10 << 20 // 10 MB
-	s.MaxRecipients = 50
 	stmpServer := &SmtpServer{storage: storage, backend: be, SmtpServer: s}
 	return stmpServer
 
 }
 
+// NewLmtpServer creates a server speaking LMTP (RFC 2033) over the same
+// backend. An addr of the form "unix:/path" listens on a Unix socket.
+func NewLmtpServer(storage *httpapi.Storage, addr string) *SmtpServer {
+	s := NewSmtpServer(storage, addr)
+	s.SmtpServer.LMTP = true
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		s.SmtpServer.Network = "unix"
+		s.SmtpServer.Addr = path
+	}
+	return s
+}
+
+// SetRelayer enables relaying of messages matching the relayer's rules
+func (s *SmtpServer) SetRelayer(r *relay.Relayer) {
+	s.backend.relayer = r
+}
+
+// Ingest stores a message received outside an SMTP session, e.g. posted to
+// the HTTP API, like one delivered over SMTP: it is routed to tenant or by
+// its recipients, checked by the data stage fault rules, relayed and
+// counted. It returns the ID of the stored message, a failing recipient
+// rejects it with an *smtp.SMTPError.
+func (s *SmtpServer) Ingest(from string, to []string, raw []byte, tenantName, sessionID string) (int, error) {
+	log := slog.With("request", sessionID)
+	id, rejected := s.backend.ingest(delivery{from: from, to: to, raw: raw, tenant: tenantName, sessionID: sessionID, log: log}, false)
+	for _, err := range rejected {
+		return 0, err
+	}
+	return id, nil
+}
+
+// SetTenants routes messages to tenants by AUTH user or recipient domain
+func (s *SmtpServer) SetTenants(r *tenant.Registry) {
+	s.backend.tenants = r
+}
+
+// SetLimits sets the maximum message size and recipients per message, it
+// is safe to call while the server runs
+func (s *SmtpServer) SetLimits(maxMessageBytes int64, maxRecipients int) {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	s.backend.maxMessageBytes = maxMessageBytes
+	s.backend.maxRecipients = maxRecipients
+}
+
+// SetTimeout sets the read and write timeout, call it before Start
+func (s *SmtpServer) SetTimeout(timeout time.Duration) {
+	s.SmtpServer.ReadTimeout = timeout
+	s.SmtpServer.WriteTimeout = timeout
+}
+
+// SetTLSConfig enables STARTTLS
+func (s *SmtpServer) SetTLSConfig(cfg *tls.Config) {
+	s.SmtpServer.TLSConfig = cfg
+}
+
+// SetFaultRules replaces the rules used to fail recipients
+func (s *SmtpServer) SetFaultRules(rules []FaultRule) {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	s.backend.faults = rules
+}
+
+// Start listens on the configured address, it returns nil once the server
+// is shut down
 func (s *SmtpServer) Start() error {
-	return s.SmtpServer.ListenAndServe()
+	network, addr := s.SmtpServer.Network, s.SmtpServer.Addr
+	if network == "" {
+		network = "tcp"
+	}
+	if addr == "" && !s.SmtpServer.LMTP {
+		addr = ":smtp"
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is shut down
+func (s *SmtpServer) Serve(l net.Listener) error {
+	s.listenMu.Lock()
+	s.listener = l.Addr()
+	s.listenMu.Unlock()
+	return ignoreClosed(s.SmtpServer.Serve(l))
+}
+
+// Check connects to the listener and completes a greeting, EHLO (LHLO for
+// LMTP), NOOP and QUIT, so it fails unless the server accepts sessions
+func (s *SmtpServer) Check(ctx context.Context) error {
+	s.listenMu.Lock()
+	addr := s.listener
+	s.listenMu.Unlock()
+	if addr == nil {
+		return errors.New("not listening")
+	}
+
+	target := addr.String()
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		target = net.JoinHostPort("localhost", strconv.Itoa(tcp.Port))
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, addr.Network(), target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The client sets its own deadlines, closing the connection ends the check
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var c *smtp.Client
+	if s.SmtpServer.LMTP {
+		c = smtp.NewClientLMTP(conn)
+	} else {
+		c = smtp.NewClient(conn)
+	}
+	err = c.Hello(probeHello)
+	if err == nil {
+		err = c.Noop()
+	}
+	if err == nil {
+		err = c.Quit()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func ignoreClosed(err error) error {
+	if errors.Is(err, smtp.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server and closes all open connections
+func (s *SmtpServer) Close() error {
+	return s.SmtpServer.Close()
+}
+
+// Shutdown stops accepting connections and closes idle sessions while
+// transactions in progress finish. Connections still open when ctx expires
+// are closed and ctx's error is returned.
+func (s *SmtpServer) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- s.SmtpServer.Shutdown(context.Background()) }()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.backend.closeConns(false)
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.backend.closeConns(true)
+			<-done
+			return ctx.Err()
+		}
+	}
 }
@@ -0,0 +1,491 @@
+package commonssmtp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	smtp "github.com/emersion/go-smtp"
+	"github.com/joukojo/go-mail-testserver/internal/commonssmtp"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/metrics"
+	"github.com/joukojo/go-mail-testserver/internal/relay"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+const rawMessage = "Subject: test\r\n\r\nbody\r\n"
+
+func serve(t *testing.T, srv *commonssmtp.SmtpServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.SmtpServer.Close() })
+	return l.Addr().String()
+}
+
+func faultRules(t *testing.T, spec string) []commonssmtp.FaultRule {
+	t.Helper()
+	rules, err := commonssmtp.ParseFaultRules(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParseFaultRules(t *testing.T) {
+	rules := faultRules(t, "bounce@.*=550 Mailbox unavailable; data:flaky@.*=451")
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	if rules[0].Stage != commonssmtp.StageRcpt || rules[0].Code != 550 || rules[0].Message != "Mailbox unavailable" {
+		t.Errorf("unexpected first rule %+v", rules[0])
+	}
+	if rules[1].Stage != commonssmtp.StageData || rules[1].Code != 451 || rules[1].Message == "" {
+		t.Errorf("unexpected second rule %+v", rules[1])
+	}
+
+	for _, spec := range []string{"nocode", "a=abc", "a=250 ok", "(=550"} {
+		if _, err := commonssmtp.ParseFaultRules(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestSMTP_RcptFault(t *testing.T) {
+	storage := httpapi.NewStorage()
+	srv := commonssmtp.NewSmtpServer(storage, "")
+	srv.SetFaultRules(faultRules(t, "bounce@.*=550 Mailbox unavailable"))
+	addr := serve(t, srv)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := c.Rcpt("bounce@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("expected 550 for bounce recipient, got %v", err)
+	}
+	if err := c.Rcpt("ok@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLMTP_PerRecipientStatus(t *testing.T) {
+	storage := httpapi.NewStorage()
+	srv := commonssmtp.NewLmtpServer(storage, "")
+	srv.SetFaultRules(faultRules(t, "data:flaky@.*=451 Try again later"))
+	addr := serve(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smtp.NewClientLMTP(conn)
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"ok@example.com", "flaky@example.com"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(rawMessage))
+	resp, err := w.CloseWithLMTPResponse()
+
+	var lmtpErr smtp.LMTPDataError
+	if !errors.As(err, &lmtpErr) {
+		t.Fatalf("expected per-recipient error, got %v", err)
+	}
+	if e := lmtpErr["flaky@example.com"]; e == nil || e.Code != 451 {
+		t.Errorf("expected 451 for flaky recipient, got %v", e)
+	}
+	if _, ok := resp["ok@example.com"]; !ok {
+		t.Error("expected success for ok recipient")
+	}
+
+	messages := storage.List()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(messages))
+	}
+	if strings.Join(messages[0].To, ",") != "ok@example.com" {
+		t.Errorf("expected only delivered recipient to be stored, got %v", messages[0].To)
+	}
+}
+
+func TestSMTP_TenantRouting(t *testing.T) {
+	registry, err := tenant.New([]tenant.Tenant{
+		{Name: "alpha", Token: "a", Users: []string{"alpha-app"}},
+		{Name: "beta", Token: "b", Domains: []string{"beta.example"}},
+	}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := httpapi.NewStorage()
+	srv := commonssmtp.NewSmtpServer(storage, "")
+	srv.SetTenants(registry)
+	addr := serve(t, srv)
+
+	send := func(auth sasl.Client, to string) {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if auth != nil {
+			if err := c.Auth(auth); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.SendMail("sender@example.com", []string{to}, strings.NewReader(rawMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(sasl.NewPlainClient("", "alpha-app", "any"), "x@beta.example")
+	send(nil, "y@beta.example")
+	send(nil, "z@other.example")
+
+	want := map[string]string{"x@beta.example": "alpha", "y@beta.example": "beta", "z@other.example": ""}
+	for _, msg := range storage.List() {
+		if msg.Tenant != want[msg.To[0]] {
+			t.Errorf("message to %s: expected tenant %q, got %q", msg.To[0], want[msg.To[0]], msg.Tenant)
+		}
+	}
+}
+
+func TestSMTP_DecodesSubject(t *testing.T) {
+	storage := httpapi.NewStorage()
+	addr := serve(t, commonssmtp.NewSmtpServer(storage, ""))
+
+	raw := "Subject: =?UTF-8?Q?P=C3=A4iv=C3=A4=C3=A4?=\r\n\r\nbody\r\n"
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SendMail("sender@example.com", []string{"alice@example.com"}, strings.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	messages := storage.List()
+	if len(messages) != 1 || messages[0].Subject != "Päivää" {
+		t.Fatalf("expected decoded subject, got %+v", messages)
+	}
+	if messages[0].SessionID == "" {
+		t.Error("expected the SMTP session ID on the message")
+	}
+}
+
+func TestSMTP_ShutdownFinishesData(t *testing.T) {
+	storage := httpapi.NewStorage()
+	srv := commonssmtp.NewSmtpServer(storage, "")
+	addr := serve(t, srv)
+
+	idle, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if err := idle.Hello("idle"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: in flight\r\n\r\n"))
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	// The idle session is closed while the transaction is allowed to finish
+	time.Sleep(100 * time.Millisecond)
+	if err := idle.Noop(); err == nil {
+		t.Error("expected the idle connection to be closed")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+
+	w.Write([]byte("body\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected DATA to complete during shutdown, got %v", err)
+	}
+	c.Quit()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	if len(storage.List()) != 1 {
+		t.Error("expected the in-flight message to be stored")
+	}
+}
+
+func TestSMTP_ShutdownDeadline(t *testing.T) {
+	srv := commonssmtp.NewSmtpServer(httpapi.NewStorage(), "")
+	addr := serve(t, srv)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if err := c.Noop(); err == nil {
+		t.Error("expected the stalled connection to be closed")
+	}
+}
+
+func TestSMTP_Limits(t *testing.T) {
+	storage := httpapi.NewStorage()
+	srv := commonssmtp.NewSmtpServer(storage, "")
+	addr := serve(t, srv)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Limits apply to sessions that are already connected
+	srv.SetLimits(16, 1)
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := c.Rcpt("bob@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 452 {
+		t.Errorf("expected 452 for the second recipient, got %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(rawMessage + strings.Repeat("x", 32)))
+	if err := w.Close(); !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Errorf("expected 552 for an oversized message, got %v", err)
+	}
+	if len(storage.List()) != 0 {
+		t.Error("expected the oversized message to be rejected")
+	}
+}
+
+// metric returns the value of the sample named series, 0 when absent
+func metric(t *testing.T, series string) float64 {
+	t.Helper()
+	var out strings.Builder
+	metrics.Default.WriteText(&out)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestSMTP_Metrics(t *testing.T) {
+	srv := commonssmtp.NewSmtpServer(httpapi.NewStorage(), "")
+	srv.SetFaultRules(faultRules(t, "bounce@.*=550 Mailbox unavailable"))
+	addr := serve(t, srv)
+
+	series := []string{
+		"mailserver_smtp_connections_total",
+		`mailserver_smtp_messages_total{result="accepted",code="250"}`,
+		`mailserver_smtp_messages_total{result="rejected",code="550"}`,
+		"mailserver_smtp_received_bytes_total",
+		"mailserver_smtp_data_size_bytes_count",
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = metric(t, s)
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("bounce@example.com", nil); err == nil {
+		t.Fatal("expected the bounce recipient to be rejected")
+	}
+	if err := c.Rcpt("ok@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(rawMessage))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []float64{1, 1, 1, float64(len(rawMessage)), 1}
+	for i, s := range series {
+		if got := metric(t, s) - before[i]; got != want[i] {
+			t.Errorf("%s increased by %v, want %v", s, got, want[i])
+		}
+	}
+}
+
+func TestSMTP_Check(t *testing.T) {
+	for _, lmtp := range []bool{false, true} {
+		var srv *commonssmtp.SmtpServer
+		if lmtp {
+			srv = commonssmtp.NewLmtpServer(httpapi.NewStorage(), "")
+		} else {
+			srv = commonssmtp.NewSmtpServer(httpapi.NewStorage(), "")
+		}
+		if err := srv.Check(context.Background()); err == nil {
+			t.Errorf("lmtp=%v: expected an error before serving", lmtp)
+		}
+
+		// Serve runs in a goroutine, the server is ready once it records
+		// its listener
+		serve(t, srv)
+		deadline := time.Now().Add(time.Second)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			err := srv.Check(ctx)
+			cancel()
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("lmtp=%v: %v", lmtp, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Probes leave the session metrics alone
+		series := []string{"mailserver_smtp_connections_total", "mailserver_smtp_session_duration_seconds_count"}
+		before := make([]float64, len(series))
+		for i, s := range series {
+			before[i] = metric(t, s)
+		}
+		for range 3 {
+			if err := srv.Check(context.Background()); err != nil {
+				t.Fatalf("lmtp=%v: %v", lmtp, err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond) // Logout runs after the client quits
+		for i, s := range series {
+			if got := metric(t, s); got != before[i] {
+				t.Errorf("lmtp=%v: probes changed %s from %v to %v", lmtp, s, before[i], got)
+			}
+		}
+
+		srv.Close()
+		if err := srv.Check(context.Background()); err == nil {
+			t.Errorf("lmtp=%v: expected an error after close", lmtp)
+		}
+	}
+}
+
+func TestIngest_InjectedMessages(t *testing.T) {
+	storage := httpapi.NewStorage()
+	srv := commonssmtp.NewSmtpServer(storage, "")
+	srv.SetFaultRules(faultRules(t, "data:flaky@.*=451 Try again later"))
+	rules, err := relay.ParseRules(`@team\.example$`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not started, so relayed messages stay queued
+	srv.SetRelayer(relay.New(storage, relay.Config{Addr: "127.0.0.1:1"}, rules))
+	api := httpapi.New("", storage)
+	api.SetIngester(srv.Ingest)
+	h := api.Handler()
+
+	inject := func(to string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/messages", strings.NewReader("To: "+to+"\r\n"+rawMessage))
+		req.Header.Set("Content-Type", "message/rfc822")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	series := `mailserver_smtp_messages_total{result="accepted",code="250"}`
+	accepted := metric(t, series)
+
+	rec := inject("dev@team.example")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var msg httpapi.Message
+	if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Relay == nil || msg.Relay.State != httpapi.RelayQueued {
+		t.Errorf("expected the injected message to be queued for relaying, got %+v", msg.Relay)
+	}
+	if got := metric(t, series); got != accepted+1 {
+		t.Errorf("expected the injected message to be counted, got %v accepted", got-accepted)
+	}
+
+	if rec := inject("flaky@example.com"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a fault rule to reject the message with 422, got %d", rec.Code)
+	}
+	if len(storage.List()) != 1 {
+		t.Errorf("expected only the accepted message to be stored, got %d", len(storage.List()))
+	}
+}
@@ -0,0 +1,391 @@
+// Package config loads the server configuration from a file, environment
+// variables and command-line flags.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joukojo/go-mail-testserver/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration
+type Config struct {
+	SMTP    SMTP    `json:"smtp"`
+	LMTP    LMTP    `json:"lmtp"`
+	HTTP    HTTP    `json:"http"`
+	POP3    Mailbox `json:"pop3"`
+	IMAP    Mailbox `json:"imap"`
+	Relay   Relay   `json:"relay"`
+	Auth    Auth    `json:"auth"`
+	Storage Storage `json:"storage"`
+	Log     Log     `json:"log"`
+
+	FaultRules             string `json:"faultRules"`
+	ShutdownTimeoutSeconds int    `json:"shutdownTimeoutSeconds"`
+}
+
+// SMTP configures the SMTP listener
+type SMTP struct {
+	Addr            string `json:"addr"`
+	TLSCert         string `json:"tlsCert"` // enables STARTTLS
+	TLSKey          string `json:"tlsKey"`
+	MaxMessageBytes int    `json:"maxMessageBytes"`
+	MaxRecipients   int    `json:"maxRecipients"`
+	TimeoutSeconds  int    `json:"timeoutSeconds"`
+}
+
+// LMTP configures the optional LMTP listener
+type LMTP struct {
+	Addr string `json:"addr"` // "unix:/path" for a Unix socket
+}
+
+// HTTP configures the HTTP API
+type HTTP struct {
+	Addr           string `json:"addr"`
+	MailHogPrefix  string `json:"mailhogPrefix"`  // MailHog compatible API, disabled when empty
+	MailpitPrefix  string `json:"mailpitPrefix"`  // Mailpit compatible API, disabled when empty
+	LinkCheckHosts string `json:"linkCheckHosts"` // comma separated hosts message links may be checked against
+}
+
+// Mailbox configures a POP3 or IMAP listener
+type Mailbox struct {
+	Addr    string `json:"addr"`
+	Shared  bool   `json:"shared"`
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+}
+
+// Relay configures upstream relaying
+type Relay struct {
+	Addr           string `json:"addr"`
+	RecipientRegex string `json:"recipientRegex"`
+	SenderDomains  string `json:"senderDomains"`
+	Username       string `json:"username"`
+	Password       string `json:"password"`
+	StartTLS       bool   `json:"startTLS"`
+	MaxAttempts    int    `json:"maxAttempts"`
+	RetrySeconds   int    `json:"retrySeconds"`
+}
+
+// Auth configures tenants and API tokens
+type Auth struct {
+	TenantsFile string `json:"tenantsFile"`
+	AdminToken  string `json:"adminToken"`
+}
+
+// Storage configures message storage
+type Storage struct {
+	Backend       string `json:"backend"`     // only "memory" is supported
+	MaxMessages   int    `json:"maxMessages"` // 0 keeps every message
+	MaxAgeSeconds int    `json:"maxAgeSeconds"`
+	SnapshotDir   string `json:"snapshotDir"` // snapshots are kept in memory when empty
+	TagRulesFile  string `json:"tagRulesFile"`
+}
+
+// Log configures logging
+type Log struct {
+	Level  string `json:"level"`  // debug, info, warn or error
+	Format string `json:"format"` // text or json
+}
+
+// Default returns the configuration used when nothing is set
+func Default() Config {
+	return Config{
+		SMTP: SMTP{
+			Addr:            ":1025",
+			MaxMessageBytes: 10 << 20,
+			MaxRecipients:   50,
+			TimeoutSeconds:  10,
+		},
+		HTTP:                   HTTP{Addr: ":8025"},
+		Relay:                  Relay{MaxAttempts: 3, RetrySeconds: 5},
+		Storage:                Storage{Backend: "memory"},
+		Log:                    Log{Level: "info", Format: logging.FormatText},
+		ShutdownTimeoutSeconds: 30,
+	}
+}
+
+// setting binds a configuration value to its environment variable and
+// flag. The flag name is the key used in configuration files.
+type setting struct {
+	key    string
+	env    string
+	value  any // *string, *int or *bool
+	secret bool
+	usage  string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{key: "smtp.addr", env: "SMTP_ADDR", value: &c.SMTP.Addr, usage: "SMTP listen address"},
+		{key: "smtp.tlsCert", env: "SMTP_TLS_CERT", value: &c.SMTP.TLSCert, usage: "SMTP STARTTLS certificate file"},
+		{key: "smtp.tlsKey", env: "SMTP_TLS_KEY", value: &c.SMTP.TLSKey, usage: "SMTP STARTTLS key file"},
+		{key: "smtp.maxMessageBytes", env: "SMTP_MAX_MESSAGE_BYTES", value: &c.SMTP.MaxMessageBytes, usage: "maximum message size"},
+		{key: "smtp.maxRecipients", env: "SMTP_MAX_RECIPIENTS", value: &c.SMTP.MaxRecipients, usage: "maximum recipients per message"},
+		{key: "smtp.timeoutSeconds", env: "SMTP_TIMEOUT_SECONDS", value: &c.SMTP.TimeoutSeconds, usage: "SMTP read and write timeout"},
+		{key: "lmtp.addr", env: "LMTP_ADDR", value: &c.LMTP.Addr, usage: "LMTP listen address, disabled when empty"},
+		{key: "http.addr", env: "HTTP_ADDR", value: &c.HTTP.Addr, usage: "HTTP API listen address"},
+		{key: "http.mailhogPrefix", env: "MAILHOG_PREFIX", value: &c.HTTP.MailHogPrefix, usage: "path prefix of the MailHog compatible API, disabled when empty"},
+		{key: "http.mailpitPrefix", env: "MAILPIT_PREFIX", value: &c.HTTP.MailpitPrefix, usage: "path prefix of the Mailpit compatible API, disabled when empty"},
+		{key: "http.linkCheckHosts", env: "LINK_CHECK_HOSTS", value: &c.HTTP.LinkCheckHosts, usage: "comma separated hosts message links may be checked against"},
+		{key: "pop3.addr", env: "POP3_ADDR", value: &c.POP3.Addr, usage: "POP3 listen address, disabled when empty"},
+		{key: "pop3.shared", env: "POP3_SHARED", value: &c.POP3.Shared, usage: "serve all messages to every POP3 user"},
+		{key: "pop3.tlsCert", env: "POP3_TLS_CERT", value: &c.POP3.TLSCert, usage: "POP3 STLS certificate file"},
+		{key: "pop3.tlsKey", env: "POP3_TLS_KEY", value: &c.POP3.TLSKey, usage: "POP3 STLS key file"},
+		{key: "imap.addr", env: "IMAP_ADDR", value: &c.IMAP.Addr, usage: "IMAP listen address, disabled when empty"},
+		{key: "imap.shared", env: "IMAP_SHARED", value: &c.IMAP.Shared, usage: "serve one shared IMAP INBOX"},
+		{key: "imap.tlsCert", env: "IMAP_TLS_CERT", value: &c.IMAP.TLSCert, usage: "IMAP STARTTLS certificate file"},
+		{key: "imap.tlsKey", env: "IMAP_TLS_KEY", value: &c.IMAP.TLSKey, usage: "IMAP STARTTLS key file"},
+		{key: "relay.addr", env: "RELAY_ADDR", value: &c.Relay.Addr, usage: "upstream SMTP server, relaying is disabled when empty"},
+		{key: "relay.recipientRegex", env: "RELAY_RECIPIENT_REGEX", value: &c.Relay.RecipientRegex, usage: "relay recipients matching this expression"},
+		{key: "relay.senderDomains", env: "RELAY_SENDER_DOMAINS", value: &c.Relay.SenderDomains, usage: "comma separated sender domains to relay"},
+		{key: "relay.username", env: "RELAY_USERNAME", value: &c.Relay.Username, usage: "upstream user name"},
+		{key: "relay.password", env: "RELAY_PASSWORD", value: &c.Relay.Password, secret: true, usage: "upstream password"},
+		{key: "relay.startTLS", env: "RELAY_STARTTLS", value: &c.Relay.StartTLS, usage: "require STARTTLS upstream"},
+		{key: "relay.maxAttempts", env: "RELAY_MAX_ATTEMPTS", value: &c.Relay.MaxAttempts, usage: "delivery attempts before giving up"},
+		{key: "relay.retrySeconds", env: "RELAY_RETRY_SECONDS", value: &c.Relay.RetrySeconds, usage: "base delay between attempts"},
+		{key: "auth.tenantsFile", env: "TENANTS_FILE", value: &c.Auth.TenantsFile, usage: "JSON file with tenants"},
+		{key: "auth.adminToken", env: "ADMIN_TOKEN", value: &c.Auth.AdminToken, secret: true, usage: "token that sees every tenant"},
+		{key: "storage.backend", env: "STORAGE_BACKEND", value: &c.Storage.Backend, usage: "storage backend, only memory is supported"},
+		{key: "storage.maxMessages", env: "STORAGE_MAX_MESSAGES", value: &c.Storage.MaxMessages, usage: "keep at most this many messages, 0 for no limit"},
+		{key: "storage.maxAgeSeconds", env: "STORAGE_MAX_AGE_SECONDS", value: &c.Storage.MaxAgeSeconds, usage: "remove messages older than this, 0 for no limit"},
+		{key: "storage.snapshotDir", env: "STORAGE_SNAPSHOT_DIR", value: &c.Storage.SnapshotDir, usage: "directory for snapshots, kept in memory when empty"},
+		{key: "storage.tagRulesFile", env: "TAG_RULES_FILE", value: &c.Storage.TagRulesFile, usage: "JSON file with tagging rules"},
+		{key: "log.level", env: "LOG_LEVEL", value: &c.Log.Level, usage: "log level: debug, info, warn or error"},
+		{key: "log.format", env: "LOG_FORMAT", value: &c.Log.Format, usage: "log format: text or json"},
+		{key: "faultRules", env: "FAULT_RULES", value: &c.FaultRules, usage: "rules failing recipients, see README"},
+		{key: "shutdownTimeoutSeconds", env: "SHUTDOWN_TIMEOUT_SECONDS", value: &c.ShutdownTimeoutSeconds, usage: "time allowed for a graceful shutdown"},
+	}
+}
+
+// Options are the command-line options that are not configuration values
+type Options struct {
+	ConfigFile  string
+	PrintConfig bool
+}
+
+// Load builds the configuration from defaults, the configuration file, the
+// environment and args, later sources taking precedence. The file is
+// -config or CONFIG_FILE, its format is chosen by extension: .yaml, .yml,
+// .toml or .json.
+func Load(args []string, getenv func(string) string) (Config, Options, error) {
+	cfg := Default()
+	var opts Options
+
+	fs := flag.NewFlagSet("mail-testserver", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigFile, "config", getenv("CONFIG_FILE"), "configuration file (.yaml, .toml or .json)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration and exit")
+
+	// Flags are recorded first and applied last so they override the file
+	flags := make(map[string]string)
+	for _, s := range cfg.settings() {
+		record := func(v string) error {
+			flags[s.key] = v
+			return parseValue(s.value, v)
+		}
+		// Boolean flags work as switches, e.g. -pop3.shared
+		if _, ok := s.value.(*bool); ok {
+			fs.BoolFunc(s.key, s.usage+" ($"+s.env+")", record)
+		} else {
+			fs.Func(s.key, s.usage+" ($"+s.env+")", record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, opts, err
+	}
+
+	if opts.ConfigFile != "" {
+		if err := cfg.loadFile(opts.ConfigFile); err != nil {
+			return cfg, opts, err
+		}
+	}
+
+	settings := cfg.settings()
+	for _, s := range settings {
+		if v := getenv(s.env); v != "" {
+			if err := parseValue(s.value, v); err != nil {
+				return cfg, opts, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flags[s.key]; ok {
+			parseValue(s.value, v) // already validated by fs.Parse
+		}
+	}
+
+	return cfg, opts, cfg.Validate()
+}
+
+func parseValue(dst any, v string) error {
+	switch p := dst.(type) {
+	case *string:
+		*p = v
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*p = b
+	}
+	return nil
+}
+
+// loadFile overlays the file on cfg. YAML and TOML are converted to JSON
+// first so one set of field names applies to every format.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	default:
+		return fmt.Errorf("%s: unsupported configuration format %q", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	normalized, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(normalized))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid value. Fault and relay rules are parsed by
+// the servers that use them.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	checkAddr := func(key, addr string, required bool) {
+		if addr == "" {
+			check(!required, "%s is required", key)
+			return
+		}
+		_, _, err := net.SplitHostPort(addr)
+		check(err == nil, "%s: invalid address %q", key, addr)
+	}
+	checkAddr("smtp.addr", c.SMTP.Addr, true)
+	checkAddr("http.addr", c.HTTP.Addr, true)
+	checkAddr("pop3.addr", c.POP3.Addr, false)
+	checkAddr("imap.addr", c.IMAP.Addr, false)
+	checkAddr("relay.addr", c.Relay.Addr, false)
+	if !strings.HasPrefix(c.LMTP.Addr, "unix:") {
+		checkAddr("lmtp.addr", c.LMTP.Addr, false)
+	}
+
+	checkPrefix := func(key, prefix string) {
+		if prefix == "" {
+			return
+		}
+		check(len(prefix) > 1 && prefix[0] == '/' && !strings.HasSuffix(prefix, "/") && !strings.ContainsAny(prefix, "{} \t"),
+			"%s: invalid path prefix %q, expected e.g. /mailhog", key, prefix)
+	}
+	checkPrefix("http.mailhogPrefix", c.HTTP.MailHogPrefix)
+	checkPrefix("http.mailpitPrefix", c.HTTP.MailpitPrefix)
+	check(c.HTTP.MailHogPrefix == "" || c.HTTP.MailHogPrefix != c.HTTP.MailpitPrefix,
+		"http.mailhogPrefix and http.mailpitPrefix must differ")
+
+	for key, pair := range map[string][2]string{
+		"smtp": {c.SMTP.TLSCert, c.SMTP.TLSKey},
+		"pop3": {c.POP3.TLSCert, c.POP3.TLSKey},
+		"imap": {c.IMAP.TLSCert, c.IMAP.TLSKey},
+	} {
+		check((pair[0] == "") == (pair[1] == ""), "%s.tlsCert and %s.tlsKey must be set together", key, key)
+	}
+
+	check(c.SMTP.MaxMessageBytes > 0, "smtp.maxMessageBytes must be positive")
+	check(c.SMTP.MaxRecipients > 0, "smtp.maxRecipients must be positive")
+	check(c.SMTP.TimeoutSeconds > 0, "smtp.timeoutSeconds must be positive")
+	check(c.Relay.MaxAttempts > 0, "relay.maxAttempts must be positive")
+	check(c.Relay.RetrySeconds > 0, "relay.retrySeconds must be positive")
+	check(c.Storage.Backend == "memory", "storage.backend: unsupported backend %q, only memory is available", c.Storage.Backend)
+	check(c.Storage.MaxMessages >= 0, "storage.maxMessages must not be negative")
+	check(c.Storage.MaxAgeSeconds >= 0, "storage.maxAgeSeconds must not be negative")
+	check(c.ShutdownTimeoutSeconds > 0, "shutdownTimeoutSeconds must be positive")
+	check(c.Auth.TenantsFile == "" || c.Auth.AdminToken != "", "auth.adminToken is required with auth.tenantsFile")
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	check(c.Log.Format == logging.FormatText || c.Log.Format == logging.FormatJSON, "log.format: unknown format %q, expected text or json", c.Log.Format)
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration with secrets masked
+func (c Config) Redacted() Config {
+	for _, s := range c.settings() {
+		if p, ok := s.value.(*string); ok && s.secret && *p != "" {
+			*p = "********"
+		}
+	}
+	return c
+}
+
+// Print writes the configuration as YAML with secrets redacted
+func (c Config) Print(w io.Writer) error {
+	c = c.Redacted()
+
+	// Round trip through JSON so the YAML keys match the file format
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	blockStyle(&doc)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle clears the JSON flow style and quoting of n and its children
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, child := range n.Content {
+		blockStyle(child)
+	}
+}
@@ -0,0 +1,140 @@
+package config_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/config"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(k string) string { return vars[k] }
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, _, err := config.Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SMTP.Addr != ":1025" || cfg.HTTP.Addr != ":8025" || cfg.Storage.Backend != "memory" {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+}
+
+func TestLoad_Formats(t *testing.T) {
+	files := map[string]string{
+		"server.yaml": "smtp:\n  addr: \":2525\"\n  maxRecipients: 5\npop3:\n  shared: true\n",
+		"server.toml": "[smtp]\naddr = \":2525\"\nmaxRecipients = 5\n[pop3]\nshared = true\n",
+		"server.json": `{"smtp": {"addr": ":2525", "maxRecipients": 5}, "pop3": {"shared": true}}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			cfg, _, err := config.Load([]string{"-config", writeFile(t, name, content)}, env(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.SMTP.Addr != ":2525" || cfg.SMTP.MaxRecipients != 5 || !cfg.POP3.Shared {
+				t.Errorf("file values not applied: %+v", cfg)
+			}
+			if cfg.SMTP.MaxMessageBytes != 10<<20 {
+				t.Errorf("expected defaults for unset keys, got %d", cfg.SMTP.MaxMessageBytes)
+			}
+		})
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, "server.yaml", "smtp:\n  addr: \":2525\"\nhttp:\n  addr: \":9025\"\nlmtp:\n  addr: \":2424\"\n")
+	vars := env(map[string]string{"CONFIG_FILE": path, "HTTP_ADDR": ":9026", "LMTP_ADDR": ":2425"})
+
+	cfg, _, err := config.Load([]string{"-lmtp.addr", ":2426"}, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SMTP.Addr != ":2525" {
+		t.Errorf("expected file value, got %q", cfg.SMTP.Addr)
+	}
+	if cfg.HTTP.Addr != ":9026" {
+		t.Errorf("expected env to override file, got %q", cfg.HTTP.Addr)
+	}
+	if cfg.LMTP.Addr != ":2426" {
+		t.Errorf("expected flag to override env, got %q", cfg.LMTP.Addr)
+	}
+}
+
+func TestLoad_BooleanSwitches(t *testing.T) {
+	cfg, opts, err := config.Load([]string{"-pop3.shared", "-imap.shared=false", "-print-config"}, env(map[string]string{"IMAP_SHARED": "true"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.POP3.Shared || cfg.IMAP.Shared || !opts.PrintConfig {
+		t.Errorf("expected pop3.shared only, got pop3=%v imap=%v print=%v", cfg.POP3.Shared, cfg.IMAP.Shared, opts.PrintConfig)
+	}
+}
+
+func TestLoad_Validation(t *testing.T) {
+	path := writeFile(t, "server.json", `{"smtp": {"addr": "nope", "tlsCert": "cert.pem"}, "storage": {"backend": "postgres"}}`)
+	_, _, err := config.Load([]string{"-config", path, "-relay.retrySeconds", "0", "-http.mailhogPrefix", "mailhog/"}, env(nil))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"smtp.addr", "smtp.tlsCert", "storage.backend", "relay.retrySeconds", "http.mailhogPrefix"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected an error about %s, got:\n%v", want, err)
+		}
+	}
+
+	path = writeFile(t, "server.yaml", "smtp:\n  adr: \":2525\"\n")
+	if _, _, err := config.Load([]string{"-config", path}, env(nil)); err == nil || !strings.Contains(err.Error(), "adr") {
+		t.Errorf("expected unknown key error, got %v", err)
+	}
+
+	if _, _, err := config.Load(nil, env(map[string]string{"POP3_SHARED": "maybe"})); err == nil {
+		t.Error("expected invalid boolean to fail")
+	}
+}
+
+func TestPrint_RedactsSecrets(t *testing.T) {
+	cfg, opts, err := config.Load([]string{"-print-config", "-relay.password", "hunter2"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.PrintConfig {
+		t.Error("expected -print-config to be set")
+	}
+
+	var out bytes.Buffer
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") || !strings.Contains(out.String(), "password: '********'") {
+		t.Errorf("expected redacted password:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "smtp:\n  addr: :1025\n") {
+		t.Errorf("expected block style YAML:\n%s", out.String())
+	}
+	if cfg.Relay.Password != "hunter2" {
+		t.Error("Print must not modify the configuration")
+	}
+
+	// The printed configuration loads back unchanged
+	reloaded, _, err := config.Load([]string{"-config", writeFile(t, "printed.yaml", out.String())}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.SMTP != cfg.SMTP || reloaded.Storage != cfg.Storage {
+		t.Errorf("printed configuration did not round trip: %+v", reloaded)
+	}
+}
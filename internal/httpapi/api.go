@@ -1,10 +1,20 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/metrics"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
 )
 
 type Email struct {
@@ -20,41 +30,269 @@ type Server struct {
 
 	storage  *Storage
 	emailsMu sync.RWMutex
+	tenants  *tenant.Registry
+	reload   func() error // nil when reloading is not available
+
+	started time.Time
+	info    Info
+	checks  []readinessCheck
+	metrics *metrics.Registry // per-server metrics, served after metrics.Default
+
+	mailhogPrefix string // MailHog compatible routes, disabled when empty
+	mailpitPrefix string // Mailpit compatible routes, disabled when empty
+
+	maxMessageBytes atomic.Int64 // limit for messages posted to the API
+	ingest          Ingester     // nil stores posted messages directly
+	snapshots       snapshotStore
+	linkCheckHosts  atomic.Pointer[[]string] // hosts links may be checked against
+	codesMu         sync.RWMutex
+	codePatterns    map[string][]CodePattern // by tenant, "" for global
+
+	httpServer *http.Server
+	closing    chan struct{} // closed on shutdown to end long-running requests
 }
 
 // New creates a new HTTP API server
 func New(addr string, storage *Storage) *Server {
-	return &Server{
-		addr:    addr,
-		storage: storage,
+	s := &Server{
+		addr:       addr,
+		storage:    storage,
+		started:    time.Now(),
+		httpServer: &http.Server{},
+		closing:    make(chan struct{}),
 	}
+	s.httpServer.RegisterOnShutdown(func() { close(s.closing) })
+	s.maxMessageBytes.Store(10 << 20) // 10 MB, like SMTP
+	s.metrics = storageMetrics(storage)
+	return s
+}
+
+// SetTenants scopes the API by tenant tokens
+func (s *Server) SetTenants(r *tenant.Registry) {
+	s.tenants = r
+}
+
+// SetReloader enables POST /api/v1/admin/reload, call it before Start
+func (s *Server) SetReloader(reload func() error) {
+	s.reload = reload
 }
 
+// Start listens on the configured address, it returns nil once the server
+// is shut down
 func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts HTTP connections on l until the server is shut down
+func (s *Server) Serve(l net.Listener) error {
+	s.httpServer.Handler = s.Handler()
+	if err := s.httpServer.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close stops the server and closes all open connections
+func (s *Server) Close() error {
+	return s.httpServer.Close()
+}
+
+// Shutdown stops accepting connections, ends waits and event streams and
+// lets other requests finish. Connections still open when ctx expires are
+// closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.httpServer.Close()
+	}
+	return err
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	// Register routes
 	mux.HandleFunc("/api/v1/messages", s.handleEmails)
 	mux.HandleFunc("/api/v1/messages/clear", s.handleClear)
+	mux.HandleFunc("/api/v1/messages/wait", s.handleWait)
 	mux.HandleFunc("/api/v1/messages/{id}", s.handleEmail)
 	mux.HandleFunc("/api/v1/messages/{id}/raw", s.handleRawEmail)
-	// mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/api/v1/messages/{id}/links", s.handleLinks)
+	mux.HandleFunc("/api/v1/messages/{id}/codes", s.handleCodes)
+	mux.HandleFunc("/api/v1/messages/{id}/html-check", s.handleHTMLCheck)
+	mux.HandleFunc("/api/v1/code-patterns", s.handleCodePatterns)
+	mux.HandleFunc("/api/v1/mailboxes", s.handleMailboxes)
+	mux.HandleFunc("/api/v1/mailboxes/{address}/messages", s.handleMailboxMessages)
+	mux.HandleFunc("/api/v1/events", s.handleEvents)
+	mux.HandleFunc("/api/v1/export", s.handleExport)
+	mux.HandleFunc("/api/v1/import", s.handleImport)
+	mux.HandleFunc("/api/v1/admin/reload", s.handleReload)
+	mux.HandleFunc("/api/v1/admin/tag-rules", s.handleTagRules)
+	mux.HandleFunc("/api/v1/admin/snapshots", s.handleSnapshots)
+	mux.HandleFunc("/api/v1/admin/snapshots/{name}", s.handleSnapshot)
+	mux.HandleFunc("/api/v1/admin/snapshots/{name}/restore", s.handleRestore)
+	mux.HandleFunc("/api/v1/info", s.handleInfo)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	if s.mailhogPrefix != "" {
+		s.mailhogRoutes(mux, s.mailhogPrefix)
+	}
+	if s.mailpitPrefix != "" {
+		s.mailpitRoutes(mux, s.mailpitPrefix)
+	}
 
-	return http.ListenAndServe(s.addr, mux)
+	return s.logRequests(s.authenticate(recordRoute(mux)))
 }
 
-// handleEmails returns all received emails
+// handleEmails returns the received emails matching the query filter,
+// ordered by ID, POST stores a new message and PATCH changes the state of
+// several messages
 func (s *Server) handleEmails(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.handleInject(w, r)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		s.handleBulkPatch(w, r)
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	s.emailsMu.RLock()
 	defer s.emailsMu.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s.storage.List())
+	json.NewEncoder(w).Encode(s.find(tenantScope(r), filter))
+}
+
+// find returns the messages in scope matching filter, ordered by ID
+func (s *Server) find(scope string, filter Filter) []Message {
+	messages := []Message{}
+	for _, msg := range s.storage.List() {
+		if visible(scope, &msg) && filter.Match(&msg) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	if filter.Limit > 0 && len(messages) > filter.Limit {
+		messages = messages[:filter.Limit]
+	}
+	return messages
+}
+
+// handleWait blocks until a message matching the query filter exists or
+// the timeout (default 10s, maximum 5m) expires
+func (s *Server) handleWait(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout := 10 * time.Second
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > 5*time.Minute {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+	filter.Limit = 1
+	scope := tenantScope(r)
+
+	// Subscribe before looking so no message slips through in between
+	events, cancel := s.storage.Subscribe()
+	defer cancel()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if found := s.find(scope, filter); len(found) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(found[0])
+			return
+		}
+
+		select {
+		case <-events:
+		case <-timer.C:
+			http.Error(w, "No matching message", http.StatusNotFound)
+			return
+		case <-s.closing:
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleEvents streams storage events as Server-Sent Events
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := s.storage.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	scope := tenantScope(r)
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if scope != "" && ev.Tenant != scope && ev.Type != EventCleared && ev.Type != EventRestored {
+				continue
+			}
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-s.closing:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
 func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
@@ -66,20 +304,30 @@ func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
 	s.emailsMu.Lock()
 	defer s.emailsMu.Unlock()
 
-	s.storage.Clear()
+	if scope := tenantScope(r); scope != "" {
+		s.storage.ClearTenant(scope)
+	} else {
+		s.storage.Clear()
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) handleEmail(w http.ResponseWriter, r *http.Request) {
 
+	if r.Method == http.MethodDelete {
+		s.handleDeleteEmail(w, r)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		s.handlePatchEmail(w, r)
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	fmt.Println("Provision ID: ", r.PathValue("id"))
-
 	s.emailsMu.RLock()
 	defer s.emailsMu.RUnlock()
 
@@ -92,7 +340,7 @@ func (s *Server) handleEmail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msg, exists := s.storage.Get(id)
-	if !exists {
+	if !exists || !visible(tenantScope(r), msg) {
 		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
@@ -119,7 +367,7 @@ func (s *Server) handleRawEmail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msg, exists := s.storage.Get(id)
-	if !exists {
+	if !exists || !visible(tenantScope(r), msg) {
 		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
@@ -127,3 +375,100 @@ func (s *Server) handleRawEmail(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write(msg.Raw)
 }
+
+// handleMailboxes lists every distinct envelope recipient with counts
+func (s *Server) handleMailboxes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, ok := mailboxOptions(r)
+	if !ok {
+		http.Error(w, "Invalid mailbox options", http.StatusBadRequest)
+		return
+	}
+	opts.Tenant = tenantScope(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.storage.Mailboxes(opts))
+}
+
+// handleMailboxMessages returns the messages delivered to one recipient
+func (s *Server) handleMailboxMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, ok := mailboxOptions(r)
+	if !ok {
+		http.Error(w, "Invalid mailbox options", http.StatusBadRequest)
+		return
+	}
+	opts.Tenant = tenantScope(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.storage.MailboxMessages(r.PathValue("address"), opts))
+}
+
+// mailboxOptions reads the ignoreCase (default true) and stripPlus
+// (default false) query parameters
+func mailboxOptions(r *http.Request) (MailboxOptions, bool) {
+	opts := MailboxOptions{IgnoreCase: true}
+	q := r.URL.Query()
+	for name, dst := range map[string]*bool{"ignoreCase": &opts.IgnoreCase, "stripPlus": &opts.StripPlus} {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, false
+			}
+			*dst = b
+		}
+	}
+	return opts, true
+}
+
+func (s *Server) handleDeleteEmail(w http.ResponseWriter, r *http.Request) {
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+
+	idStr := r.PathValue("id")
+	var id int
+	_, err := fmt.Sscanf(idStr, "%d", &id)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	msg, exists := s.storage.Get(id)
+	if !exists || !visible(tenantScope(r), msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	s.storage.Delete(id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReload reloads the server configuration, admin only
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if tenantScope(r) != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if s.reload == nil {
+		http.Error(w, "Reload not available", http.StatusNotFound)
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		http.Error(w, "Reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package httpapi_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func TestServer_ShutdownEndsWait(t *testing.T) {
+	srv := httpapi.New("", httpapi.NewStorage())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/api/v1/messages/wait?timeout=1m")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if code := <-status; code != http.StatusServiceUnavailable {
+		t.Errorf("expected the pending wait to get 503, got %d", code)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected Serve to return nil after shutdown, got %v", err)
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	srv := httpapi.New("", httpapi.NewStorage())
+	if rec := do(srv.Handler(), http.MethodPost, "/api/v1/admin/reload", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a reloader, got %d", rec.Code)
+	}
+
+	reloads := 0
+	var failure error
+	srv.SetReloader(func() error {
+		reloads++
+		return failure
+	})
+	h := srv.Handler()
+	if rec := do(h, http.MethodPost, "/api/v1/admin/reload", ""); rec.Code != http.StatusNoContent || reloads != 1 {
+		t.Errorf("expected reload with 204, got %d after %d reload(s)", rec.Code, reloads)
+	}
+	failure = errors.New("bad fault rule")
+	if rec := do(h, http.MethodPost, "/api/v1/admin/reload", ""); rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "bad fault rule") {
+		t.Errorf("expected the reload error, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServer_ReloadAdminOnly(t *testing.T) {
+	_, h := tenantServer(t)
+	if rec := do(h, http.MethodPost, "/api/v1/admin/reload", "alpha-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a tenant token, got %d", rec.Code)
+	}
+}
+
+func TestServer_RequestID(t *testing.T) {
+	h := httpapi.New("", httpapi.NewStorage()).Handler()
+
+	rec := do(h, http.MethodGet, "/api/v1/messages", "")
+	if len(rec.Header().Get("X-Request-ID")) != 16 {
+		t.Errorf("expected a generated request ID, got %q", rec.Header().Get("X-Request-ID"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/messages", nil)
+	req.Header.Set("X-Request-ID", "trace-42")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "trace-42" {
+		t.Errorf("expected the caller's request ID, got %q", got)
+	}
+	// An invalid ID is replaced in the response, the request is left alone
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/messages", nil)
+	req.Header.Set("X-Request-ID", "not valid")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); len(got) != 16 {
+		t.Errorf("expected a generated request ID, got %q", got)
+	}
+	if got := req.Header.Get("X-Request-ID"); got != "not valid" {
+		t.Errorf("expected the request header to be kept, got %q", got)
+	}
+}
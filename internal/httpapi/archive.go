@@ -0,0 +1,451 @@
+package httpapi
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxImportBytes limits the size of an uploaded archive and of the
+// messages of a zip once decompressed
+const maxImportBytes = 1 << 30
+
+// maxManifestBytes limits the decompressed size of a zip's manifest
+const maxManifestBytes = 32 << 20
+
+// errImportTooLarge marks archive entries over the message size limit and
+// zips over maxImportBytes once decompressed
+var errImportTooLarge = errors.New("too large")
+
+// mboxDate is the asctime layout of mbox "From " separator lines
+const mboxDate = "Mon Jan _2 15:04:05 2006"
+
+// envelopeToHeader carries the envelope recipients of a message in an mbox,
+// which has room for the sender only
+const envelopeToHeader = "X-Envelope-To"
+
+// manifestName is the zip entry listing the envelope of each .eml file
+const manifestName = "manifest.json"
+
+// manifestEntry describes one message of a zip archive
+type manifestEntry struct {
+	File      string   `json:"file"`
+	From      string   `json:"from"`
+	To        []string `json:"to"`
+	CreatedAt string   `json:"createdAt,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Read      bool     `json:"read,omitempty"`
+	Starred   bool     `json:"starred,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// mboxFromLine matches lines that need ">" quoting in mboxrd
+var mboxFromLine = regexp.MustCompile(`^>*From `)
+
+// handleExport streams the messages matching the query filter as an mbox
+// or a zip of .eml files, ordered by ID
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "mbox"
+	}
+	if format != "mbox" && format != "zip" {
+		http.Error(w, "Invalid format, expected mbox or zip", http.StatusBadRequest)
+		return
+	}
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.emailsMu.RLock()
+	var messages []*Message
+	for _, found := range s.find(tenantScope(r), filter) {
+		if msg, ok := s.storage.Get(found.ID); ok {
+			messages = append(messages, msg)
+		}
+	}
+	s.emailsMu.RUnlock()
+
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="messages.zip"`)
+		err = writeZip(w, messages)
+	} else {
+		w.Header().Set("Content-Type", "application/mbox")
+		w.Header().Set("Content-Disposition", `attachment; filename="messages.mbox"`)
+		err = writeMbox(w, messages)
+	}
+	if err != nil {
+		slog.Warn("export failed", "request", requestID(r.Context()), "error", err)
+	}
+}
+
+// writeMbox writes messages in mboxrd format. The envelope sender and
+// receive time go to the "From " line, the recipients to an X-Envelope-To
+// header in front of the message.
+func writeMbox(w io.Writer, messages []*Message) error {
+	bw := bufio.NewWriter(w)
+	for _, msg := range messages {
+		sender := msg.From
+		if sender == "" {
+			sender = "MAILER-DAEMON"
+		}
+		created, err := time.Parse(time.RFC3339, msg.CreatedAt)
+		if err != nil {
+			created = time.Now()
+		}
+		fmt.Fprintf(bw, "From %s %s\n", sender, created.UTC().Format(mboxDate))
+
+		eol := "\n"
+		if bytes.Contains(msg.Raw, []byte("\r\n")) {
+			eol = "\r\n"
+		}
+		if len(msg.To) > 0 {
+			fmt.Fprintf(bw, "%s: %s%s", envelopeToHeader, strings.Join(msg.To, ", "), eol)
+		}
+
+		lines := bufio.NewScanner(bytes.NewReader(msg.Raw))
+		lines.Buffer(nil, len(msg.Raw)+1)
+		lines.Split(scanLinesKeepEOL)
+		for lines.Scan() {
+			if mboxFromLine.Match(lines.Bytes()) {
+				bw.WriteByte('>')
+			}
+			bw.Write(lines.Bytes())
+		}
+		if len(msg.Raw) > 0 && msg.Raw[len(msg.Raw)-1] != '\n' {
+			bw.WriteString(eol)
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+// scanLinesKeepEOL is bufio.ScanLines without stripping line endings
+func scanLinesKeepEOL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// writeZip writes each message as <id>.eml followed by a manifest of the
+// envelopes
+func writeZip(w io.Writer, messages []*Message) error {
+	zw := zip.NewWriter(w)
+	manifest := []manifestEntry{}
+	for _, msg := range messages {
+		entry := manifestEntry{
+			File:      fmt.Sprintf("%d.eml", msg.ID),
+			From:      msg.From,
+			To:        msg.To,
+			CreatedAt: msg.CreatedAt,
+			Tenant:    msg.Tenant,
+			Read:      msg.Read,
+			Starred:   msg.Starred,
+			Tags:      msg.Tags,
+		}
+		modified, _ := time.Parse(time.RFC3339, msg.CreatedAt)
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: entry.File, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(msg.Raw); err != nil {
+			return err
+		}
+		manifest = append(manifest, entry)
+	}
+
+	f, err := zw.Create(manifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// handleImport stores the messages of an uploaded mbox or zip of .eml
+// files. Nothing is stored unless the whole archive is valid.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/zip" && mediaType != "application/mbox" {
+		// Sniff the format of generic uploads
+		magic, _ := body.Peek(5)
+		switch {
+		case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+			mediaType = "application/zip"
+		case bytes.Equal(magic, []byte("From ")):
+			mediaType = "application/mbox"
+		default:
+			http.Error(w, "Unsupported archive, expected application/mbox or application/zip", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	var (
+		messages []*Message
+		err      error
+	)
+	maxMessage := s.maxMessageBytes.Load()
+	if mediaType == "application/zip" {
+		messages, err = readZip(body, maxMessage)
+	} else {
+		messages, err = readMbox(body, maxMessage)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Archive exceeds %d bytes", int64(maxImportBytes)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errImportTooLarge) {
+		http.Error(w, "Invalid archive: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reqID := requestID(r.Context())
+	scope := tenantScope(r)
+	ids := []int{}
+
+	s.emailsMu.Lock()
+	for _, msg := range messages {
+		switch {
+		case scope != "":
+			msg.Tenant = scope
+		case msg.Tenant == "":
+			msg.Tenant = s.tenants.Route("", msg.To)
+		}
+		msg.SessionID = reqID
+		ids = append(ids, s.storage.Add(msg))
+	}
+	s.emailsMu.Unlock()
+	slog.Info("messages imported", "request", reqID, "format", mediaType, "count", len(ids))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"imported": len(ids), "ids": ids})
+}
+
+// readMbox parses an mbox written by writeMbox or by other mail software,
+// undoing mboxrd quoting. Messages over maxMessage bytes fail the import.
+func readMbox(r *bufio.Reader, maxMessage int64) ([]*Message, error) {
+	var (
+		messages []*Message
+		current  *bytes.Buffer
+		sender   string
+		created  string
+	)
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		raw := current.Bytes()
+		// Drop the blank line separating messages
+		switch {
+		case bytes.HasSuffix(raw, []byte("\r\n\r\n")):
+			raw = raw[:len(raw)-2]
+		case bytes.HasSuffix(raw, []byte("\n\n")):
+			raw = raw[:len(raw)-1]
+		}
+		msg, err := importedMessage(raw, sender, nil, created)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", len(messages)+1, err)
+		}
+		messages = append(messages, msg)
+		return nil
+	}
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if rest, ok := bytes.CutPrefix(line, []byte("From ")); ok {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				current = &bytes.Buffer{}
+				sender, created = parseMboxFrom(string(bytes.TrimRight(rest, "\r\n")))
+			} else if current == nil {
+				return nil, errors.New(`mbox must start with a "From " line`)
+			} else {
+				if mboxFromLine.Match(line) {
+					line = line[1:]
+				}
+				current.Write(line)
+				if int64(current.Len()) > maxMessage {
+					return nil, fmt.Errorf("message %d: %w, the limit is %d bytes", len(messages)+1, errImportTooLarge, maxMessage)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// parseMboxFrom splits the rest of a "From " line into the envelope sender
+// and, when it parses, the RFC 3339 receive time
+func parseMboxFrom(s string) (sender, created string) {
+	sender, date, _ := strings.Cut(s, " ")
+	if sender == "MAILER-DAEMON" {
+		sender = ""
+	}
+	if t, err := time.Parse(mboxDate, strings.TrimSpace(date)); err == nil {
+		created = t.UTC().Format(time.RFC3339)
+	}
+	return sender, created
+}
+
+// readZip parses a zip written by writeZip. Without a manifest entry the
+// envelope of an .eml file comes from its headers. The upload is spooled to
+// a temporary file as a zip is read from its end. Entries over maxMessage
+// bytes, or over maxImportBytes together, fail the import.
+func readZip(r io.Reader, maxMessage int64) ([]*Message, error) {
+	tmp, err := os.CreateTemp("", "mail-testserver-import-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := map[string]manifestEntry{}
+	if f, err := zr.Open(manifestName); err == nil {
+		var entries []manifestEntry
+		err := json.NewDecoder(io.LimitReader(f, maxManifestBytes)).Decode(&entries)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", manifestName, err)
+		}
+		for _, e := range entries {
+			manifest[e.File] = e
+		}
+	}
+
+	var (
+		messages []*Message
+		total    int64
+	)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !strings.EqualFold(path.Ext(f.Name), ".eml") {
+			continue
+		}
+		raw, err := readZipEntry(f, maxMessage)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if total += int64(len(raw)); total > maxImportBytes {
+			return nil, fmt.Errorf("%w, the messages exceed %d bytes", errImportTooLarge, int64(maxImportBytes))
+		}
+
+		entry, ok := manifest[f.Name]
+		if !ok {
+			entry.From, _, _ = headerEnvelope(raw)
+		}
+		msg, err := importedMessage(raw, entry.From, entry.To, entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		msg.Tenant = entry.Tenant
+		msg.Read, msg.Starred, msg.Tags = entry.Read, entry.Starred, entry.Tags
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// readZipEntry decompresses f, failing when it exceeds limit bytes. The
+// size in the header is checked first but not trusted.
+func readZipEntry(f *zip.File, limit int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, fmt.Errorf("%w, the limit is %d bytes", errImportTooLarge, limit)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > limit {
+		return nil, fmt.Errorf("%w, the limit is %d bytes", errImportTooLarge, limit)
+	}
+	return raw, nil
+}
+
+// importedMessage builds a message from an archived source. A leading
+// X-Envelope-To header is removed and used when to is empty, recipients
+// are taken from the headers as a last resort.
+func importedMessage(raw []byte, from string, to []string, created string) (*Message, error) {
+	if rest, ok := bytes.CutPrefix(raw, []byte(envelopeToHeader+":")); ok {
+		line, after, _ := bytes.Cut(rest, []byte("\n"))
+		raw = after
+		if len(to) == 0 {
+			for _, addr := range strings.Split(string(line), ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					to = append(to, addr)
+				}
+			}
+		}
+	}
+
+	if len(to) == 0 {
+		var err error
+		if _, to, err = headerEnvelope(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := NewMessage(from, to, raw)
+	msg.CreatedAt = created
+	return msg, nil
+}
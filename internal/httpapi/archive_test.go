@@ -0,0 +1,178 @@
+package httpapi_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+// archiveFixtures adds messages that exercise the mbox quoting and envelope
+func archiveFixtures(s *httpapi.Storage) {
+	s.Add(&httpapi.Message{From: "alice@example.com", To: []string{"bob@example.com", "hidden@example.com"},
+		CreatedAt: "2025-03-01T08:00:00Z",
+		Raw:       []byte("From: alice@example.com\r\nTo: bob@example.com\r\nSubject: First\r\n\r\nFrom the start\r\n>From quoted\r\n")})
+	s.Add(&httpapi.Message{From: "", To: []string{"carol@example.com"}, CreatedAt: "2025-03-02T09:30:00Z",
+		Raw: []byte("Subject: Bounce\n\nNo sender\n\n")})
+}
+
+func roundTrip(t *testing.T, format string) *httpapi.Storage {
+	t.Helper()
+	source := httpapi.NewStorage()
+	archiveFixtures(source)
+	rec := do(httpapi.New("", source).Handler(), http.MethodGet, "/api/v1/export?format="+format, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	target := httpapi.NewStorage()
+	rec = post(httpapi.New("", target).Handler(), "/api/v1/import", "application/octet-stream", "", rec.Body.String())
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("import: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var result struct {
+		Imported int   `json:"imported"`
+		IDs      []int `json:"ids"`
+	}
+	json.NewDecoder(rec.Body).Decode(&result)
+	if result.Imported != 2 || len(result.IDs) != 2 {
+		t.Fatalf("expected 2 imported messages, got %+v", result)
+	}
+
+	for id := 1; id <= 2; id++ {
+		want, _ := source.Get(id)
+		got, _ := target.Get(id)
+		if got == nil {
+			t.Fatalf("message %d not imported", id)
+		}
+		if got.From != want.From || strings.Join(got.To, ",") != strings.Join(want.To, ",") {
+			t.Errorf("message %d: envelope %q -> %v, want %q -> %v", id, got.From, got.To, want.From, want.To)
+		}
+		if got.CreatedAt != want.CreatedAt {
+			t.Errorf("message %d: CreatedAt %s, want %s", id, got.CreatedAt, want.CreatedAt)
+		}
+		if string(got.Raw) != string(want.Raw) {
+			t.Errorf("message %d: raw %q, want %q", id, got.Raw, want.Raw)
+		}
+	}
+	return target
+}
+
+func TestArchive_MboxRoundTrip(t *testing.T) {
+	target := roundTrip(t, "mbox")
+	if msg, _ := target.Get(1); msg.Subject != "First" {
+		t.Errorf("expected parsed subject, got %q", msg.Subject)
+	}
+}
+
+func TestArchive_ZipRoundTrip(t *testing.T) {
+	roundTrip(t, "zip")
+}
+
+func TestArchive_ExportFiltered(t *testing.T) {
+	storage := httpapi.NewStorage()
+	archiveFixtures(storage)
+	rec := do(httpapi.New("", storage).Handler(), http.MethodGet, "/api/v1/export?to=carol", "")
+	if rec.Header().Get("Content-Type") != "application/mbox" {
+		t.Errorf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "From MAILER-DAEMON Sun Mar  2 09:30:00 2025\n") || strings.Contains(body, "First") {
+		t.Errorf("expected only the bounce, got %q", rec.Body)
+	}
+}
+
+func TestArchive_ImportZipWithoutManifest(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("inbox/welcome.eml")
+	f.Write([]byte("From: shop@example.com\r\nTo: alice@example.com\r\nSubject: Welcome\r\n\r\nHi\r\n"))
+	f, _ = zw.Create("README.txt")
+	f.Write([]byte("not a message"))
+	zw.Close()
+
+	storage := httpapi.NewStorage()
+	rec := post(httpapi.New("", storage).Handler(), "/api/v1/import", "application/zip", "", buf.String())
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	msgs := storage.List()
+	if len(msgs) != 1 || msgs[0].From != "shop@example.com" || msgs[0].To[0] != "alice@example.com" || msgs[0].Subject != "Welcome" {
+		t.Errorf("unexpected messages %+v", msgs)
+	}
+	if msgs[0].CreatedAt == "" {
+		t.Error("expected CreatedAt to default to the import time")
+	}
+}
+
+func TestArchive_ImportErrors(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+
+	if rec := post(h, "/api/v1/import", "text/plain", "", "hello"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", rec.Code)
+	}
+	if rec := post(h, "/api/v1/import", "application/mbox", "", "Subject: no separator\n\n"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an mbox without From line, got %d", rec.Code)
+	}
+	if rec := post(h, "/api/v1/import", "application/zip", "", "PK\x03\x04broken"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a broken zip, got %d", rec.Code)
+	}
+	if n, _ := storage.Size(); n != 0 {
+		t.Errorf("expected nothing stored, got %d messages", n)
+	}
+}
+
+func TestArchive_ImportSizeLimits(t *testing.T) {
+	storage := httpapi.NewStorage()
+	api := httpapi.New("", storage)
+	api.SetMaxMessageBytes(100)
+	h := api.Handler()
+
+	// Compresses well below the limit but inflates past it
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("small.eml")
+	f.Write([]byte("Subject: small\r\n\r\nHi\r\n"))
+	f, _ = zw.Create("big.eml")
+	f.Write([]byte("Subject: big\r\n\r\n" + strings.Repeat("a", 1000)))
+	zw.Close()
+	if rec := post(h, "/api/v1/import", "application/zip", "", buf.String()); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a zip entry over the message size, got %d: %s", rec.Code, rec.Body)
+	}
+
+	mbox := "From a@example.com\nSubject: big\n\n" + strings.Repeat("a\n", 100)
+	if rec := post(h, "/api/v1/import", "application/mbox", "", mbox); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an mbox message over the message size, got %d: %s", rec.Code, rec.Body)
+	}
+	if n, _ := storage.Size(); n != 0 {
+		t.Errorf("expected nothing stored, got %d messages", n)
+	}
+}
+
+func TestArchive_TenantScope(t *testing.T) {
+	storage, h := tenantServer(t)
+
+	rec := do(h, http.MethodGet, "/api/v1/export?format=zip", "alpha-token")
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "1.eml" {
+		t.Errorf("expected alpha's message and the manifest, got %d files", len(zr.File))
+	}
+
+	// Imports by a tenant are stored for that tenant
+	mbox := "From x@example.com Sun Mar  2 09:30:00 2025\nTo: x@beta.example\n\nHi\n"
+	rec = post(h, "/api/v1/import", "application/mbox", "alpha-token", mbox)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if msg, _ := storage.Get(4); msg == nil || msg.Tenant != "alpha" || msg.To[0] != "x@beta.example" {
+		t.Errorf("unexpected imported message %+v", msg)
+	}
+}
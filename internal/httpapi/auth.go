@@ -0,0 +1,50 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type scopeKey struct{}
+
+// publicPaths are served without a token, they expose no message content
+var publicPaths = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// authenticate resolves the bearer token to a tenant scope when tenants
+// are configured. Without tenants every request sees all messages.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.tenants.Enabled() || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name, admin, ok := s.tenants.Authenticate(strings.TrimSpace(token))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mail-testserver"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !admin {
+			r = r.WithContext(context.WithValue(r.Context(), scopeKey{}, name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantScope returns the caller's tenant, or "" when it may see everything
+func tenantScope(r *http.Request) string {
+	name, _ := r.Context().Value(scopeKey{}).(string)
+	return name
+}
+
+// visible reports whether a message belongs to the scope
+func visible(scope string, msg *Message) bool {
+	return scope == "" || msg.Tenant == scope
+}
@@ -0,0 +1,111 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+func tenantServer(t *testing.T) (*httpapi.Storage, http.Handler) {
+	t.Helper()
+	registry, err := tenant.New([]tenant.Tenant{
+		{Name: "alpha", Token: "alpha-token"},
+		{Name: "beta", Token: "beta-token"},
+	}, "admin-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := httpapi.NewStorage()
+	storage.Add(&httpapi.Message{From: "a@example.com", To: []string{"x@alpha.example"}, Tenant: "alpha"})
+	storage.Add(&httpapi.Message{From: "b@example.com", To: []string{"x@beta.example"}, Tenant: "beta"})
+	storage.Add(&httpapi.Message{From: "c@example.com", To: []string{"x@other.example"}})
+
+	srv := httpapi.New("", storage)
+	srv.SetTenants(registry)
+	return storage, srv.Handler()
+}
+
+func do(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func listIDs(t *testing.T, rec *httptest.ResponseRecorder) map[int]bool {
+	t.Helper()
+	var msgs []httpapi.Message
+	if err := json.NewDecoder(rec.Body).Decode(&msgs); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int]bool)
+	for _, m := range msgs {
+		ids[m.ID] = true
+	}
+	return ids
+}
+
+func TestTenants_RequireToken(t *testing.T) {
+	_, h := tenantServer(t)
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := do(h, http.MethodGet, "/api/v1/messages", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, rec.Code)
+		}
+	}
+}
+
+func TestTenants_ScopedList(t *testing.T) {
+	_, h := tenantServer(t)
+
+	ids := listIDs(t, do(h, http.MethodGet, "/api/v1/messages", "alpha-token"))
+	if len(ids) != 1 || !ids[1] {
+		t.Errorf("alpha should only see message 1, got %v", ids)
+	}
+
+	ids = listIDs(t, do(h, http.MethodGet, "/api/v1/messages", "admin-token"))
+	if len(ids) != 3 {
+		t.Errorf("admin should see all messages, got %v", ids)
+	}
+
+	if rec := do(h, http.MethodGet, "/api/v1/messages/2", "alpha-token"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another tenant's message, got %d", rec.Code)
+	}
+	if rec := do(h, http.MethodGet, "/api/v1/messages/2/raw", "beta-token"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for own message, got %d", rec.Code)
+	}
+}
+
+func TestTenants_ScopedClear(t *testing.T) {
+	storage, h := tenantServer(t)
+
+	if rec := do(h, http.MethodPost, "/api/v1/messages/clear", "beta-token"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if len(storage.List()) != 2 {
+		t.Errorf("expected only beta's message to be cleared, %d left", len(storage.List()))
+	}
+
+	do(h, http.MethodPost, "/api/v1/messages/clear", "admin-token")
+	if len(storage.List()) != 0 {
+		t.Errorf("expected admin clear to remove everything, %d left", len(storage.List()))
+	}
+}
+
+func TestTenants_DisabledIsOpen(t *testing.T) {
+	storage := httpapi.NewStorage()
+	storage.Add(&httpapi.Message{From: "a@example.com", Tenant: "alpha"})
+	h := httpapi.New("", storage).Handler()
+
+	if ids := listIDs(t, do(h, http.MethodGet, "/api/v1/messages", "")); len(ids) != 1 {
+		t.Errorf("expected open API without tenants, got %v", ids)
+	}
+}
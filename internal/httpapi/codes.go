@@ -0,0 +1,204 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// CodePattern extracts one-time codes or tokens from messages. The value is
+// the group named code, else the first group, else the whole match.
+type CodePattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// Code is a value extracted from a message
+type Code struct {
+	Value   string `json:"value"`
+	Pattern string `json:"pattern"` // name of the pattern that found it
+	Part    string `json:"part"`    // subject, text/plain or text/html
+}
+
+// maxCodePatterns limits the patterns of a tenant or of the global set
+const maxCodePatterns = 50
+
+// defaultCodePatterns apply after the registered ones: 4 to 8 digit codes
+// near a keyword or on a line of their own, and token-like query
+// parameters of links
+var defaultCodePatterns = mustCompileCodePatterns([]CodePattern{
+	{Name: "otp", Pattern: `(?i)\b(?:code|otp|pin|passcode|verification|verify|one[- ]time)\b[^\d\n]{0,30}\b(?P<code>\d{4,8})\b`},
+	{Name: "otp", Pattern: `(?m)^[ \t]*(?P<code>\d{4,8})[ \t]*\r?$`},
+	{Name: "otp", Pattern: `(?i)\b(?P<code>\d{4,8})\b[^\d\n]{0,5}\b(?:is your|is the)\b`},
+	{Name: "token", Pattern: `(?i)[?&](?:token|code|otp|key|magic|auth|login|verify|confirm|confirmation|signature)(?:_?token)?=(?P<code>[A-Za-z0-9._~%-]{6,})`},
+})
+
+func mustCompileCodePatterns(patterns []CodePattern) []CodePattern {
+	if err := compileCodePatterns(patterns); err != nil {
+		panic(err)
+	}
+	return patterns
+}
+
+// compileCodePatterns validates patterns and compiles them in place
+func compileCodePatterns(patterns []CodePattern) error {
+	if len(patterns) > maxCodePatterns {
+		return fmt.Errorf("at most %d patterns", maxCodePatterns)
+	}
+	for i := range patterns {
+		p := &patterns[i]
+		if p.Name = strings.TrimSpace(p.Name); p.Name == "" {
+			return fmt.Errorf("pattern %d: no name", i+1)
+		}
+		if p.Pattern == "" {
+			return fmt.Errorf("pattern %q: empty", p.Name)
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", p.Name, err)
+		}
+		p.re = re
+	}
+	return nil
+}
+
+// value returns the code of a match, see CodePattern
+func (p *CodePattern) value(m []string) string {
+	if i := p.re.SubexpIndex("code"); i > 0 {
+		return m[i]
+	}
+	if len(m) > 1 {
+		return m[1]
+	}
+	return m[0]
+}
+
+// SetCodePatterns replaces the patterns of a tenant, or the global ones
+// when tenant is empty. Invalid patterns change nothing.
+func (s *Server) SetCodePatterns(tenant string, patterns []CodePattern) error {
+	patterns = append([]CodePattern{}, patterns...)
+	if err := compileCodePatterns(patterns); err != nil {
+		return err
+	}
+
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+	if s.codePatterns == nil {
+		s.codePatterns = make(map[string][]CodePattern)
+	}
+	if len(patterns) == 0 {
+		delete(s.codePatterns, tenant)
+	} else {
+		s.codePatterns[tenant] = patterns
+	}
+	return nil
+}
+
+// CodePatterns returns the patterns registered for a tenant, or the global
+// ones when tenant is empty
+func (s *Server) CodePatterns(tenant string) []CodePattern {
+	s.codesMu.RLock()
+	defer s.codesMu.RUnlock()
+	return append([]CodePattern{}, s.codePatterns[tenant]...)
+}
+
+// extractCodes applies the tenant's patterns, the global ones and the
+// defaults in that order. A value found by several parts or patterns is
+// reported once.
+func (s *Server) extractCodes(msg *Message) []Code {
+	s.codesMu.RLock()
+	var patterns []CodePattern
+	if msg.Tenant != "" {
+		patterns = append(patterns, s.codePatterns[msg.Tenant]...)
+	}
+	patterns = append(patterns, s.codePatterns[""]...)
+	s.codesMu.RUnlock()
+	patterns = append(patterns, defaultCodePatterns...)
+
+	p := parseMessage(msg)
+	// Tags are removed from the HTML, link targets are kept for tokens
+	var htmlText strings.Builder
+	htmlText.WriteString(html.UnescapeString(htmlTags.ReplaceAllString(p.HTML, "\n")))
+	for _, link := range extractLinks(p) {
+		if link.Part == "text/html" {
+			htmlText.WriteString("\n" + link.URL)
+		}
+	}
+	parts := []struct{ name, content string }{
+		{"subject", p.subject()},
+		{"text/plain", p.Text},
+		{"text/html", htmlText.String()},
+	}
+
+	codes := []Code{}
+	seen := make(map[string]bool)
+	for i := range patterns {
+		for _, part := range parts {
+			for _, m := range patterns[i].re.FindAllStringSubmatch(part.content, -1) {
+				value := patterns[i].value(m)
+				if value == "" || seen[value] {
+					continue
+				}
+				seen[value] = true
+				codes = append(codes, Code{Value: value, Pattern: patterns[i].Name, Part: part.name})
+			}
+		}
+	}
+	return codes
+}
+
+// handleCodes returns the codes and tokens found in a message
+func (s *Server) handleCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var id int
+	if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	s.emailsMu.RLock()
+	msg, exists := s.storage.Get(id)
+	s.emailsMu.RUnlock()
+	if !exists || !visible(tenantScope(r), msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.extractCodes(msg))
+}
+
+// handleCodePatterns returns (GET) or replaces (PUT) the patterns of the
+// caller's tenant, the global ones for the admin or without tenants
+func (s *Server) handleCodePatterns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	scope := tenantScope(r)
+
+	if r.Method == http.MethodPut {
+		var patterns []CodePattern
+		if err := json.NewDecoder(r.Body).Decode(&patterns); err != nil {
+			http.Error(w, "Invalid code patterns: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetCodePatterns(scope, patterns); err != nil {
+			http.Error(w, "Invalid code patterns: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("code patterns updated", "request", requestID(r.Context()), "tenant", scope, "count", len(patterns))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.CodePatterns(scope))
+}
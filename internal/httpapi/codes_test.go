@@ -0,0 +1,93 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func TestCodes_Defaults(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"keyword", "Subject: Sign in\r\n\r\nYour verification code: 482913\r\nIt expires in 10 minutes.\r\n", "otp:482913"},
+		{"own line", "Subject: Sign in\r\n\r\nUse this to sign in:\r\n\r\n  7351\r\n\r\nThanks, 2024 team\r\n", "otp:7351"},
+		{"subject", "Subject: 902114 is your login code\r\n\r\nHello\r\n", "otp:902114"},
+		{"magic link", "Content-Type: text/html\r\n\r\n<a href=\"https://app.local/login?email=a%40b.c&amp;token=Zx81-ab_Qp9\">Sign in</a>\r\n", "token:Zx81-ab_Qp9"},
+		{"nothing", "Subject: Newsletter\r\n\r\nOrder 12 items before 2030-01-01.\r\n", ""},
+		{"text and html once", "Subject: Code\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nYour code is 551200\r\n" +
+			"--b\r\nContent-Type: text/html\r\n\r\n<p>Your code is <b>551200</b></p>\r\n--b--\r\n", "otp:551200"},
+	}
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := storage.Add(&httpapi.Message{Raw: []byte(tt.raw)})
+			var codes []httpapi.Code
+			getJSON(t, h, "/api/v1/messages/"+strconv.Itoa(id)+"/codes", &codes)
+			var got []string
+			for _, c := range codes {
+				got = append(got, c.Pattern+":"+c.Value)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("expected %q, got %+v", tt.want, codes)
+			}
+		})
+	}
+}
+
+func TestCodes_Patterns(t *testing.T) {
+	storage, h := tenantServer(t)
+	raw := []byte("Subject: Welcome\r\n\r\nReference ABC-1234-XY, code 123456\r\n")
+	alpha := storage.Add(&httpapi.Message{Tenant: "alpha", Raw: raw})
+	beta := storage.Add(&httpapi.Message{Tenant: "beta", Raw: raw})
+
+	if code := put(h, "/api/v1/code-patterns", "admin-token", `[{"name":"ref","pattern":"Reference ([A-Z]{3}-\\d{4})"}]`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := put(h, "/api/v1/code-patterns", "alpha-token", `[{"name":"full-ref","pattern":"(?P<code>[A-Z]{3}-\\d{4}-[A-Z]{2})"}]`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	codes := func(id int, token string) string {
+		var codes []httpapi.Code
+		json.NewDecoder(do(h, http.MethodGet, "/api/v1/messages/"+strconv.Itoa(id)+"/codes", token).Body).Decode(&codes)
+		var got []string
+		for _, c := range codes {
+			got = append(got, c.Pattern+":"+c.Value)
+		}
+		return strings.Join(got, ",")
+	}
+	// Tenant patterns come first, then global ones, then the defaults
+	if got := codes(alpha, "alpha-token"); got != "full-ref:ABC-1234-XY,ref:ABC-1234,otp:123456" {
+		t.Errorf("unexpected alpha codes %q", got)
+	}
+	if got := codes(beta, "beta-token"); got != "ref:ABC-1234,otp:123456" {
+		t.Errorf("unexpected beta codes %q", got)
+	}
+	// The admin sees a message with its tenant's patterns
+	if got := codes(alpha, "admin-token"); !strings.HasPrefix(got, "full-ref:") {
+		t.Errorf("unexpected codes for the admin %q", got)
+	}
+
+	var patterns []httpapi.CodePattern
+	json.NewDecoder(do(h, http.MethodGet, "/api/v1/code-patterns", "beta-token").Body).Decode(&patterns)
+	if len(patterns) != 0 {
+		t.Errorf("expected no beta patterns, got %+v", patterns)
+	}
+	for _, body := range []string{`[{"name":"x","pattern":"("}]`, `[{"pattern":"\\d+"}]`, `[{"name":"x"}]`, `{}`} {
+		if code := put(h, "/api/v1/code-patterns", "alpha-token", body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, code)
+		}
+	}
+	if rec := do(h, http.MethodGet, "/api/v1/messages/"+strconv.Itoa(beta)+"/codes", "alpha-token"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another tenant's message, got %d", rec.Code)
+	}
+}
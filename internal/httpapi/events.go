@@ -0,0 +1,52 @@
+package httpapi
+
+// Storage event types
+const (
+	EventAdded   = "added"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	EventCleared = "cleared"
+	// EventRestored replaces every message at once, like a clear followed
+	// by the snapshot's messages
+	EventRestored = "restored"
+)
+
+// Event describes a change in storage
+type Event struct {
+	Type   string `json:"type"`
+	ID     int    `json:"id,omitempty"` // zero for EventCleared and EventRestored
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Subscribe returns a channel receiving storage events and a function
+// that cancels the subscription. Events are dropped for subscribers that
+// do not keep up.
+func (s *Storage) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+
+	s.subMu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.subMu.Unlock()
+
+	cancel := func() {
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+func (s *Storage) publish(ev Event) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter selects messages by envelope, content and state. Empty fields
+// match everything, text comparisons are case-insensitive substring matches.
+type Filter struct {
+	From     string
+	To       string
+	Subject  string
+	Contains string    // matched against the body
+	Since    time.Time // only messages received at or after Since
+	Read     *bool
+	Starred  *bool
+	Tags     []string // messages carrying every tag, compared case-insensitively
+	Limit    int      // maximum number of results, 0 for no limit
+}
+
+// ParseFilter reads the from, to, subject, contains, since, read, starred,
+// tag and limit query parameters. tag may be repeated.
+func ParseFilter(q url.Values) (Filter, error) {
+	f := Filter{
+		From:     q.Get("from"),
+		To:       q.Get("to"),
+		Subject:  q.Get("subject"),
+		Contains: q.Get("contains"),
+		Tags:     q["tag"],
+	}
+	for key, dst := range map[string]**bool{"read": &f.Read, "starred": &f.Starred} {
+		if v := q.Get(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s, expected true or false", key)
+			}
+			*dst = &b
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, errors.New("invalid since, expected RFC 3339 timestamp")
+		}
+		f.Since = t
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return f, errors.New("invalid limit")
+		}
+		f.Limit = n
+	}
+	return f, nil
+}
+
+// selective reports whether the filter narrows the messages down, Limit
+// does not count
+func (f Filter) selective() bool {
+	return f.From != "" || f.To != "" || f.Subject != "" || f.Contains != "" || !f.Since.IsZero() ||
+		f.Read != nil || f.Starred != nil || len(f.Tags) > 0
+}
+
+// Match reports whether msg passes the filter, Limit is not considered
+func (f Filter) Match(msg *Message) bool {
+	if !containsFold(msg.From, f.From) || !containsFold(msg.Subject, f.Subject) || !containsFold(msg.Body, f.Contains) {
+		return false
+	}
+	if f.To != "" {
+		found := false
+		for _, rcpt := range msg.To {
+			if containsFold(rcpt, f.To) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() {
+		created, err := time.Parse(time.RFC3339, msg.CreatedAt)
+		if err != nil || created.Before(f.Since) {
+			return false
+		}
+	}
+	if (f.Read != nil && msg.Read != *f.Read) || (f.Starred != nil && msg.Starred != *f.Starred) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !slices.ContainsFunc(msg.Tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(s, substr string) bool {
+	return substr == "" || strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,28 @@
+package httpapi_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func TestFilter_Match(t *testing.T) {
+	f, err := httpapi.ParseFilter(url.Values{"to": {"ALICE@"}, "subject": {"reset"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match(&httpapi.Message{To: []string{"bob@example.com", "alice@example.com"}, Subject: "Password Reset"}) {
+		t.Error("expected case-insensitive match")
+	}
+	if f.Match(&httpapi.Message{To: []string{"alice@example.com"}, Subject: "Welcome"}) {
+		t.Error("expected subject mismatch")
+	}
+
+	if _, err := httpapi.ParseFilter(url.Values{"since": {"yesterday"}}); err == nil {
+		t.Error("expected invalid since to fail")
+	}
+	if _, err := httpapi.ParseFilter(url.Values{"limit": {"-1"}}); err == nil {
+		t.Error("expected negative limit to fail")
+	}
+}
@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Info describes the running server for GET /api/v1/info
+type Info struct {
+	Version string
+	Commit  string
+	Config  func() any // summary of the current configuration, without secrets
+}
+
+// SetInfo sets the build and configuration details, call it before Start
+func (s *Server) SetInfo(info Info) {
+	s.info = info
+}
+
+type readinessCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// AddReadinessCheck adds a check to GET /readyz next to the storage check,
+// call it before Start
+func (s *Server) AddReadinessCheck(name string, check func(context.Context) error) {
+	s.checks = append(s.checks, readinessCheck{name: name, check: check})
+}
+
+// readinessTimeout bounds each readiness check
+const readinessTimeout = 2 * time.Second
+
+// handleHealthz reports that the process is alive
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz runs the storage and registered checks, it answers 503 when
+// one fails or the server is shutting down
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	checks := append([]readinessCheck{{name: "storage", check: s.storage.Ready}}, s.checks...)
+	results := make(map[string]string, len(checks))
+	ready := true
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		err := c.check(ctx)
+		cancel()
+		results[c.name] = "ok"
+		if err != nil {
+			results[c.name] = err.Error()
+			ready = false
+		}
+	}
+	select {
+	case <-s.closing:
+		results["server"] = "shutting down"
+		ready = false
+	default:
+	}
+
+	status := "ok"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": results})
+}
+
+// handleInfo returns the version, uptime, configuration summary and the
+// number of messages visible to the caller
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scope := tenantScope(r)
+	count := 0
+	for _, msg := range s.storage.List() {
+		if visible(scope, &msg) {
+			count++
+		}
+	}
+
+	info := map[string]any{
+		"version":       s.info.Version,
+		"commit":        s.info.Commit,
+		"startedAt":     s.started.UTC().Format(time.RFC3339),
+		"uptimeSeconds": int64(time.Since(s.started).Seconds()),
+		"messages":      count,
+	}
+	// Tenants see their own message count but not the server configuration
+	if s.info.Config != nil && scope == "" {
+		info["config"] = s.info.Config()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,95 @@
+package httpapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func TestHealth_PublicProbes(t *testing.T) {
+	_, h := tenantServer(t)
+
+	if rec := do(h, http.MethodGet, "/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from /healthz, got %d", rec.Code)
+	}
+	rec := do(h, http.MethodGet, "/readyz", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from /readyz, got %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "ok" || body.Checks["storage"] != "ok" {
+		t.Errorf("unexpected readiness %+v", body)
+	}
+}
+
+func TestHealth_ReadinessCheckFails(t *testing.T) {
+	srv := httpapi.New("", httpapi.NewStorage())
+	srv.AddReadinessCheck("smtp", func(context.Context) error { return errors.New("not listening") })
+
+	rec := do(srv.Handler(), http.MethodGet, "/readyz", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body.Checks["smtp"] != "not listening" {
+		t.Errorf("expected the check error, got %+v", body.Checks)
+	}
+}
+
+func TestHealth_Info(t *testing.T) {
+	storage := httpapi.NewStorage()
+	storage.Add(&httpapi.Message{From: "a@example.com"})
+	srv := httpapi.New("", storage)
+	srv.SetInfo(httpapi.Info{
+		Version: "1.2.3",
+		Commit:  "abc123",
+		Config:  func() any { return map[string]string{"smtp": ":1025"} },
+	})
+
+	rec := do(srv.Handler(), http.MethodGet, "/api/v1/info", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var info struct {
+		Version  string            `json:"version"`
+		Commit   string            `json:"commit"`
+		Messages int               `json:"messages"`
+		Uptime   *int64            `json:"uptimeSeconds"`
+		Config   map[string]string `json:"config"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.2.3" || info.Commit != "abc123" || info.Messages != 1 || info.Uptime == nil || info.Config["smtp"] != ":1025" {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+func TestHealth_InfoScopedToTenant(t *testing.T) {
+	_, h := tenantServer(t)
+
+	if rec := do(h, http.MethodGet, "/api/v1/info", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rec.Code)
+	}
+	var info map[string]any
+	json.NewDecoder(do(h, http.MethodGet, "/api/v1/info", "alpha-token").Body).Decode(&info)
+	if info["messages"] != float64(1) {
+		t.Errorf("expected the tenant's single message, got %v", info["messages"])
+	}
+	if _, ok := info["config"]; ok {
+		t.Error("tenants must not see the configuration")
+	}
+}
@@ -0,0 +1,219 @@
+package httpapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// htmlCheckData lists HTML and CSS features with uneven support across mail
+// clients. Features supported everywhere are left out.
+//
+//go:embed htmlcheck.json
+var htmlCheckData []byte
+
+var htmlRules = mustLoadHTMLRules(htmlCheckData)
+
+// htmlRuleDB is the format of htmlcheck.json
+type htmlRuleDB struct {
+	Clients  []htmlClient  `json:"clients"`
+	Features []htmlFeature `json:"features"`
+}
+
+type htmlClient struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type htmlFeature struct {
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Type        string   `json:"type"`    // html matches the markup, css only styles
+	Pattern     string   `json:"pattern"` // case-insensitive, ^ matches at line starts
+	Unsupported []string `json:"unsupported"`
+	Partial     []string `json:"partial"`
+	Notes       string   `json:"notes"`
+
+	re *regexp.Regexp
+}
+
+func mustLoadHTMLRules(data []byte) *htmlRuleDB {
+	var db htmlRuleDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		panic(fmt.Sprintf("htmlcheck.json: %v", err))
+	}
+	clients := make(map[string]bool)
+	for _, c := range db.Clients {
+		clients[c.ID] = true
+	}
+	for i := range db.Features {
+		f := &db.Features[i]
+		if f.Type != "html" && f.Type != "css" {
+			panic(fmt.Sprintf("htmlcheck.json: feature %s: unknown type %q", f.ID, f.Type))
+		}
+		for _, id := range append(slices.Clone(f.Unsupported), f.Partial...) {
+			if !clients[id] {
+				panic(fmt.Sprintf("htmlcheck.json: feature %s: unknown client %q", f.ID, id))
+			}
+		}
+		f.re = regexp.MustCompile("(?im)" + f.Pattern)
+	}
+	return &db
+}
+
+// HTMLCheck reports the HTML and CSS features of a message that some mail
+// clients do not support
+type HTMLCheck struct {
+	Clients []HTMLClientScore `json:"clients"`
+	Issues  []HTMLIssue       `json:"issues"`
+}
+
+// HTMLClientScore is the share of the detected features a client supports,
+// partial support counting half
+type HTMLClientScore struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Score       float64  `json:"score"` // 0 to 100
+	Unsupported []string `json:"unsupported"`
+	Partial     []string `json:"partial"`
+}
+
+// HTMLIssue is a detected feature with limited support
+type HTMLIssue struct {
+	Feature     string   `json:"feature"`
+	Title       string   `json:"title"`
+	Type        string   `json:"type"` // html or css
+	Lines       []int    `json:"lines"`
+	Unsupported []string `json:"unsupported"`
+	Partial     []string `json:"partial"`
+	Notes       string   `json:"notes,omitempty"`
+}
+
+var (
+	styleBlock = regexp.MustCompile(`(?is)<style\b[^>]*>(.*?)</style\s*>`)
+	styleAttr  = regexp.MustCompile(`(?is)\sstyle\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// checkHTML scores body for the given client IDs, all when empty
+func checkHTML(body string, clients []string) HTMLCheck {
+	// CSS features are only looked for in style blocks and attributes
+	var styles [][2]int
+	for _, m := range styleBlock.FindAllStringSubmatchIndex(body, -1) {
+		styles = append(styles, [2]int{m[2], m[3]})
+	}
+	for _, m := range styleAttr.FindAllStringSubmatchIndex(body, -1) {
+		if m[2] >= 0 {
+			styles = append(styles, [2]int{m[2], m[3]})
+		} else {
+			styles = append(styles, [2]int{m[4], m[5]})
+		}
+	}
+	selected := func(ids []string) []string {
+		out := []string{}
+		for _, id := range ids {
+			if len(clients) == 0 || slices.Contains(clients, id) {
+				out = append(out, id)
+			}
+		}
+		return out
+	}
+
+	check := HTMLCheck{Clients: []HTMLClientScore{}, Issues: []HTMLIssue{}}
+	for i := range htmlRules.Features {
+		f := &htmlRules.Features[i]
+		issue := HTMLIssue{Feature: f.ID, Title: f.Title, Type: f.Type, Unsupported: selected(f.Unsupported),
+			Partial: selected(f.Partial), Notes: f.Notes}
+		if len(issue.Unsupported) == 0 && len(issue.Partial) == 0 {
+			continue
+		}
+		var offsets []int
+		if f.Type == "html" {
+			for _, m := range f.re.FindAllStringIndex(body, -1) {
+				offsets = append(offsets, m[0])
+			}
+		} else {
+			for _, s := range styles {
+				for _, m := range f.re.FindAllStringIndex(body[s[0]:s[1]], -1) {
+					offsets = append(offsets, s[0]+m[0])
+				}
+			}
+		}
+		if len(offsets) == 0 {
+			continue
+		}
+		for _, off := range offsets {
+			issue.Lines = append(issue.Lines, lineAt(body, off))
+		}
+		slices.Sort(issue.Lines)
+		issue.Lines = slices.Compact(issue.Lines)
+		check.Issues = append(check.Issues, issue)
+	}
+
+	for _, c := range htmlRules.Clients {
+		if len(clients) > 0 && !slices.Contains(clients, c.ID) {
+			continue
+		}
+		score := HTMLClientScore{ID: c.ID, Name: c.Name, Unsupported: []string{}, Partial: []string{}}
+		for _, issue := range check.Issues {
+			switch {
+			case slices.Contains(issue.Unsupported, c.ID):
+				score.Unsupported = append(score.Unsupported, issue.Feature)
+			case slices.Contains(issue.Partial, c.ID):
+				score.Partial = append(score.Partial, issue.Feature)
+			}
+		}
+		score.Score = 100
+		if n := len(check.Issues); n > 0 {
+			missing := float64(len(score.Unsupported)) + float64(len(score.Partial))/2
+			score.Score = math.Round(1000*(1-missing/float64(n))) / 10
+		}
+		check.Clients = append(check.Clients, score)
+	}
+	return check
+}
+
+// handleHTMLCheck checks the HTML part of a message, optionally only for
+// the comma separated clients
+func (s *Server) handleHTMLCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var id int
+	if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var clients []string
+	if v := r.URL.Query().Get("clients"); v != "" {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.TrimSpace(c)
+			if !slices.ContainsFunc(htmlRules.Clients, func(known htmlClient) bool { return known.ID == c }) {
+				http.Error(w, "Unknown client: "+c, http.StatusBadRequest)
+				return
+			}
+			clients = append(clients, c)
+		}
+	}
+
+	s.emailsMu.RLock()
+	msg, exists := s.storage.Get(id)
+	s.emailsMu.RUnlock()
+	if !exists || !visible(tenantScope(r), msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	body := parseMessage(msg).HTML
+	if body == "" {
+		http.Error(w, "Message has no HTML part", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkHTML(body, clients))
+}
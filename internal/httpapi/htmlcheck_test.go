@@ -0,0 +1,74 @@
+package httpapi_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+const marketingHTML = `<html>
+<head>
+<style>
+  .hero { display: flex; border-radius: 8px; }
+</style>
+</head>
+<body>
+<table><tr><td style="background-image: url(hero.png)">
+  <p>Display: flex in text is not CSS</p>
+  <video src="promo.mp4"></video>
+</td></tr></table>
+</body>
+</html>`
+
+func TestHTMLCheck(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+	storage.Add(&httpapi.Message{Raw: []byte("Content-Type: text/html\r\n\r\n" + strings.ReplaceAll(marketingHTML, "\n", "\r\n"))})
+	storage.Add(&httpapi.Message{Raw: []byte("Content-Type: text/plain\r\n\r\nHello\r\n")})
+
+	var check httpapi.HTMLCheck
+	getJSON(t, h, "/api/v1/messages/1/html-check", &check)
+	lines := map[string][]int{}
+	for _, issue := range check.Issues {
+		lines[issue.Feature] = issue.Lines
+	}
+	want := map[string][]int{"css-display-flex": {4}, "css-border-radius": {4}, "css-background-image": {8}, "html-video": {10}}
+	if len(lines) != len(want) {
+		t.Fatalf("expected issues %v, got %+v", want, check.Issues)
+	}
+	for feature, l := range want {
+		if len(lines[feature]) != 1 || lines[feature][0] != l[0] {
+			t.Errorf("%s: expected lines %v, got %v", feature, l, lines[feature])
+		}
+	}
+
+	scores := map[string]httpapi.HTMLClientScore{}
+	for _, c := range check.Clients {
+		scores[c.ID] = c
+	}
+	if s := scores["outlook-windows"]; s.Score != 0 || len(s.Unsupported) != 4 {
+		t.Errorf("expected Outlook to support nothing, got %+v", s)
+	}
+	if s := scores["apple-mail"]; s.Score != 100 {
+		t.Errorf("expected Apple Mail to support everything, got %+v", s)
+	}
+	// Gmail: video unsupported, flex and background images partial
+	if s := scores["gmail"]; s.Score != 50 {
+		t.Errorf("expected Gmail to score 50, got %+v", s)
+	}
+
+	// Only the selected clients are scored and reported
+	getJSON(t, h, "/api/v1/messages/1/html-check?clients=apple-mail,yahoo", &check)
+	if len(check.Clients) != 2 || len(check.Issues) != 1 || check.Issues[0].Feature != "html-video" {
+		t.Errorf("unexpected check %+v", check)
+	}
+
+	if rec := do(h, http.MethodGet, "/api/v1/messages/1/html-check?clients=lynx", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown client, got %d", rec.Code)
+	}
+	if rec := do(h, http.MethodGet, "/api/v1/messages/2/html-check", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without an HTML part, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,277 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// Ingester stores a message received outside SMTP the way SMTP does and
+// returns its ID. The tenant is empty when the message should be routed by
+// its recipients.
+type Ingester func(from string, to []string, raw []byte, tenant, sessionID string) (int, error)
+
+// SetIngester makes posted messages take the SMTP path through fault rules,
+// relaying and metrics, call it before Start. Without one they are only
+// stored.
+func (s *Server) SetIngester(ingest Ingester) {
+	s.ingest = ingest
+}
+
+// SetMaxMessageBytes limits the size of messages posted to the API, it is
+// safe to call while the server runs
+func (s *Server) SetMaxMessageBytes(n int64) {
+	s.maxMessageBytes.Store(n)
+}
+
+// composition is the JSON body of POST /api/v1/messages
+type composition struct {
+	From        string            `json:"from"`
+	To          []string          `json:"to"`
+	Cc          []string          `json:"cc"`
+	Bcc         []string          `json:"bcc"` // envelope only
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text"`
+	HTML        string            `json:"html"`
+	Headers     map[string]string `json:"headers"`
+	Attachments []attachment      `json:"attachments"`
+}
+
+type attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"` // defaults to application/octet-stream
+	Content     []byte `json:"content"`     // base64 in JSON
+}
+
+// handleInject stores a message posted as message/rfc822 or as a JSON
+// composition, as if it had been delivered over SMTP
+func (s *Server) handleInject(w http.ResponseWriter, r *http.Request) {
+	limit := s.maxMessageBytes.Load()
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	var (
+		from string
+		to   []string
+		raw  []byte
+		err  error
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "message/rfc822":
+		raw, err = io.ReadAll(r.Body)
+		if err == nil {
+			from, to, err = envelope(r, raw)
+		}
+	case "application/json":
+		var c composition
+		if err = json.NewDecoder(r.Body).Decode(&c); err == nil {
+			from, to, raw, err = c.build()
+		}
+	default:
+		http.Error(w, "Unsupported content type, expected message/rfc822 or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Message exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ingest := s.ingest
+	if ingest == nil {
+		ingest = s.store
+	}
+	id, err := ingest(from, to, raw, tenantScope(r), requestID(r.Context()))
+	if err != nil {
+		http.Error(w, "Message rejected: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/messages/%d", id))
+	w.WriteHeader(http.StatusCreated)
+	if stored, ok := s.storage.Get(id); ok {
+		json.NewEncoder(w).Encode(stored)
+	} else {
+		// Already removed by the retention limits
+		json.NewEncoder(w).Encode(map[string]int{"id": id})
+	}
+}
+
+// store is the Ingester used without an SMTP server
+func (s *Server) store(from string, to []string, raw []byte, tenant, sessionID string) (int, error) {
+	msg := NewMessage(from, to, raw)
+	msg.Tenant = tenant
+	if msg.Tenant == "" {
+		msg.Tenant = s.tenants.Route("", to)
+	}
+	msg.SessionID = sessionID
+	id := s.storage.Add(msg)
+	slog.Info("message stored", "request", sessionID, "id", id, "from", from, "to", to,
+		"bytes", len(raw), "tenant", msg.Tenant)
+	return id, nil
+}
+
+// envelope returns the sender and recipients of a raw message, from the
+// from and to query parameters or else the message headers
+func envelope(r *http.Request, raw []byte) (from string, to []string, err error) {
+	from, to, err = headerEnvelope(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		from = v
+	}
+	if v := r.URL.Query()["to"]; len(v) > 0 {
+		to = v
+	}
+	if len(to) == 0 {
+		return "", nil, errors.New("no recipients, set To, Cc or Bcc or the to parameter")
+	}
+	return from, to, nil
+}
+
+// headerEnvelope derives an envelope from the From, To, Cc and Bcc headers
+func headerEnvelope(raw []byte) (from string, to []string, err error) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", nil, err
+	}
+	defer mr.Close()
+
+	if addrs, _ := mr.Header.AddressList("From"); len(addrs) > 0 {
+		from = addrs[0].Address
+	}
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		addrs, _ := mr.Header.AddressList(key)
+		for _, a := range addrs {
+			to = append(to, a.Address)
+		}
+	}
+	return from, to, nil
+}
+
+// build returns the envelope and MIME source of the composition. Text and
+// HTML become a multipart/alternative part, attachments are added next to it.
+func (c *composition) build() (from string, to []string, raw []byte, err error) {
+	sender, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("from: %w", err)
+	}
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*mail.Address{sender})
+	for _, field := range []struct {
+		key   string
+		addrs []string
+	}{{"To", c.To}, {"Cc", c.Cc}, {"Bcc", c.Bcc}} {
+		var list []*mail.Address
+		for _, addr := range field.addrs {
+			a, err := mail.ParseAddress(addr)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("%s: %w", strings.ToLower(field.key), err)
+			}
+			list = append(list, a)
+			to = append(to, a.Address)
+		}
+		if field.key != "Bcc" && len(list) > 0 {
+			h.SetAddressList(field.key, list)
+		}
+	}
+	if len(to) == 0 {
+		return "", nil, nil, errors.New("no recipients in to, cc or bcc")
+	}
+	h.SetSubject(c.Subject)
+	if err := h.GenerateMessageID(); err != nil {
+		return "", nil, nil, err
+	}
+	for k, v := range c.Headers {
+		h.Set(k, v)
+	}
+
+	var buf bytes.Buffer
+	if err := c.writeBody(&buf, h); err != nil {
+		return "", nil, nil, err
+	}
+	return sender.Address, to, buf.Bytes(), nil
+}
+
+func (c *composition) writeBody(buf *bytes.Buffer, h mail.Header) error {
+	type textPart struct{ mediaType, body string }
+	var texts []textPart
+	if c.Text != "" || c.HTML == "" {
+		texts = append(texts, textPart{"text/plain", c.Text})
+	}
+	if c.HTML != "" {
+		texts = append(texts, textPart{"text/html", c.HTML})
+	}
+
+	// A single text part needs no multipart structure
+	if len(texts) == 1 && len(c.Attachments) == 0 {
+		h.SetContentType(texts[0].mediaType, map[string]string{"charset": "utf-8"})
+		w, err := mail.CreateSingleInlineWriter(buf, h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, texts[0].body); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	mw, err := mail.CreateWriter(buf, h)
+	if err != nil {
+		return err
+	}
+	iw, err := mw.CreateInline()
+	if err != nil {
+		return err
+	}
+	for _, t := range texts {
+		var ph mail.InlineHeader
+		ph.SetContentType(t.mediaType, map[string]string{"charset": "utf-8"})
+		pw, err := iw.CreatePart(ph)
+		if err != nil {
+			return err
+		}
+		io.WriteString(pw, t.body)
+		if err := pw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := iw.Close(); err != nil {
+		return err
+	}
+
+	for _, a := range c.Attachments {
+		var ah mail.AttachmentHeader
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		ah.Set("Content-Type", contentType)
+		ah.SetFilename(a.Filename)
+		aw, err := mw.CreateAttachment(ah)
+		if err != nil {
+			return err
+		}
+		aw.Write(a.Content)
+		if err := aw.Close(); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
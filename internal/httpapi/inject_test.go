@@ -0,0 +1,171 @@
+package httpapi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func post(h http.Handler, path, contentType, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestInject_Raw(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+
+	raw := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.com\r\n" +
+		"Bcc: carol@example.com\r\n" +
+		"Subject: =?utf-8?q?Hyv=C3=A4=C3=A4_p=C3=A4iv=C3=A4=C3=A4?=\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	rec := post(h, "/api/v1/messages", "message/rfc822", "", raw)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var created httpapi.Message
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/api/v1/messages/1" {
+		t.Errorf("unexpected Location %q", loc)
+	}
+	if created.From != "alice@example.com" || strings.Join(created.To, ",") != "bob@example.com,carol@example.com" {
+		t.Errorf("unexpected envelope %q -> %v", created.From, created.To)
+	}
+	if created.Subject != "Hyvää päivää" {
+		t.Errorf("unexpected subject %q", created.Subject)
+	}
+	if created.SessionID == "" || created.SessionID != rec.Header().Get("X-Request-ID") {
+		t.Errorf("expected session ID %q, got %q", rec.Header().Get("X-Request-ID"), created.SessionID)
+	}
+	if stored, _ := storage.Get(created.ID); stored == nil || string(stored.Raw) != raw {
+		t.Error("raw source not stored as posted")
+	}
+
+	// Query parameters override the headers
+	rec = post(h, "/api/v1/messages?from=bounce@example.com&to=dave@example.com", "message/rfc822", "", raw)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.From != "bounce@example.com" || strings.Join(created.To, ",") != "dave@example.com" {
+		t.Errorf("unexpected envelope %q -> %v", created.From, created.To)
+	}
+}
+
+func TestInject_Composition(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+
+	body := `{
+		"from": "Alice <alice@example.com>",
+		"to": ["bob@example.com"],
+		"bcc": ["audit@example.com"],
+		"subject": "Invoice",
+		"text": "See attached",
+		"html": "<p>See attached</p>",
+		"headers": {"X-Campaign": "march"},
+		"attachments": [{"filename": "invoice.txt", "contentType": "text/plain", "content": "MTAwIEVVUg=="}]
+	}`
+	rec := post(h, "/api/v1/messages", "application/json", "", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var created httpapi.Message
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.Subject != "Invoice" || strings.Join(created.To, ",") != "bob@example.com,audit@example.com" {
+		t.Errorf("unexpected message %+v", created)
+	}
+
+	stored, _ := storage.Get(created.ID)
+	mr, err := mail.CreateReader(bytes.NewReader(stored.Raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.Header.Get("Bcc") != "" {
+		t.Error("Bcc must not appear in the headers")
+	}
+	if mr.Header.Get("X-Campaign") != "march" || mr.Header.Get("Message-Id") == "" {
+		t.Errorf("missing headers in %v", mr.Header)
+	}
+	parts := map[string]string{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(p.Body)
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			ct, _, _ := h.ContentType()
+			parts[ct] = string(content)
+		case *mail.AttachmentHeader:
+			name, _ := h.Filename()
+			parts[name] = string(content)
+		}
+	}
+	if parts["text/plain"] != "See attached" || parts["text/html"] != "<p>See attached</p>" || parts["invoice.txt"] != "100 EUR" {
+		t.Errorf("unexpected parts %v", parts)
+	}
+}
+
+func TestInject_Errors(t *testing.T) {
+	srv := httpapi.New("", httpapi.NewStorage())
+	srv.SetMaxMessageBytes(64)
+	h := srv.Handler()
+
+	tests := []struct {
+		name, contentType, body string
+		want                    int
+	}{
+		{"unsupported type", "text/plain", "hello", http.StatusUnsupportedMediaType},
+		{"no recipients", "message/rfc822", "From: a@example.com\r\n\r\nhi\r\n", http.StatusBadRequest},
+		{"bad json", "application/json", "{", http.StatusBadRequest},
+		{"bad address", "application/json", `{"from":"nope","to":["b@example.com"]}`, http.StatusBadRequest},
+		{"too large", "message/rfc822", "To: b@example.com\r\n\r\n" + strings.Repeat("x", 100), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := post(h, "/api/v1/messages", tt.contentType, "", tt.body); rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestInject_TenantScope(t *testing.T) {
+	storage, h := tenantServer(t)
+
+	raw := "From: a@example.com\r\nTo: x@other.example\r\n\r\nhi\r\n"
+	rec := post(h, "/api/v1/messages", "message/rfc822", "alpha-token", raw)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var created httpapi.Message
+	json.NewDecoder(rec.Body).Decode(&created)
+	if stored, _ := storage.Get(created.ID); stored == nil || stored.Tenant != "alpha" {
+		t.Errorf("expected message stored for tenant alpha, got %+v", stored)
+	}
+	if rec := do(h, http.MethodGet, rec.Header().Get("Location"), "beta-token"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another tenant, got %d", rec.Code)
+	}
+}
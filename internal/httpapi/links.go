@@ -0,0 +1,200 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Link is a URL found in a message
+type Link struct {
+	URL    string `json:"url"`
+	Text   string `json:"text,omitempty"`   // anchor text, empty in plain text
+	Part   string `json:"part"`             // text/html or text/plain
+	Line   int    `json:"line"`             // line in the decoded part, from 1
+	Status int    `json:"status,omitempty"` // HEAD response status when checked
+	Error  string `json:"error,omitempty"`  // why a check failed or was skipped
+}
+
+const (
+	linkCheckTimeout     = 5 * time.Second
+	linkCheckConcurrency = 8
+)
+
+var (
+	anchorTag = regexp.MustCompile(`(?is)<a\s[^>]*?\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))[^>]*>(.*?)</a\s*>`)
+	bareURL   = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"']+`)
+)
+
+// SetLinkCheckHosts sets the hosts GET /messages/{id}/links?check=true may
+// send requests to. Entries are host names or host:port, *.example.com
+// allows subdomains.
+func (s *Server) SetLinkCheckHosts(hosts []string) {
+	s.linkCheckHosts.Store(&hosts)
+}
+
+// extractLinks returns the anchors of the HTML part followed by the URLs
+// of the text part, in document order
+func extractLinks(p *parsedMessage) []Link {
+	links := []Link{}
+	for _, m := range anchorTag.FindAllStringSubmatchIndex(p.HTML, -1) {
+		var href string
+		for g := 1; g <= 3; g++ {
+			if m[2*g] >= 0 {
+				href = p.HTML[m[2*g]:m[2*g+1]]
+				break
+			}
+		}
+		href = strings.TrimSpace(html.UnescapeString(href))
+		if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+			continue
+		}
+		text := htmlTags.ReplaceAllString(p.HTML[m[8]:m[9]], " ")
+		text = strings.TrimSpace(whitespace.ReplaceAllString(html.UnescapeString(text), " "))
+		links = append(links, Link{URL: href, Text: text, Part: "text/html", Line: lineAt(p.HTML, m[0])})
+	}
+	for _, m := range bareURL.FindAllStringIndex(p.Text, -1) {
+		u := strings.TrimRight(p.Text[m[0]:m[1]], ".,;:!?)]}")
+		links = append(links, Link{URL: u, Part: "text/plain", Line: lineAt(p.Text, m[0])})
+	}
+	return links
+}
+
+func lineAt(s string, offset int) int {
+	return strings.Count(s[:offset], "\n") + 1
+}
+
+// linkHostAllowed reports whether u may be checked
+func linkHostAllowed(u *url.URL, allowed []string) bool {
+	host := strings.ToLower(u.Hostname())
+	for _, a := range allowed {
+		name, port, err := net.SplitHostPort(a)
+		if err != nil {
+			name, port = strings.Trim(a, "[]"), ""
+		}
+		if port != "" && port != u.Port() {
+			continue
+		}
+		name = strings.ToLower(name)
+		if host == name || (strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLinks sends a HEAD request to every distinct allowed URL of links
+// and records the status. Redirects are reported, not followed.
+func (s *Server) checkLinks(ctx context.Context, links []Link) {
+	var allowed []string
+	if hosts := s.linkCheckHosts.Load(); hosts != nil {
+		allowed = *hosts
+	}
+	client := &http.Client{
+		Timeout:       linkCheckTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	type result struct {
+		status int
+		err    string
+	}
+	var (
+		wg      sync.WaitGroup
+		results = map[string]*result{}
+		sem     = make(chan struct{}, linkCheckConcurrency)
+	)
+	for _, link := range links {
+		if _, seen := results[link.URL]; seen {
+			continue
+		}
+		res := &result{}
+		results[link.URL] = res
+
+		u, err := url.Parse(link.URL)
+		switch {
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https"):
+			res.err = "not an HTTP link"
+			continue
+		case !linkHostAllowed(u, allowed):
+			res.err = "host not allowed"
+			continue
+		}
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			status, err := headStatus(ctx, client, target)
+			res.status = status
+			if err != nil {
+				res.err = err.Error()
+			}
+		}(link.URL)
+	}
+	wg.Wait()
+
+	for i := range links {
+		res := results[links[i].URL]
+		links[i].Status, links[i].Error = res.status, res.err
+	}
+}
+
+func headStatus(ctx context.Context, client *http.Client, target string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// handleLinks lists the links of a message, checking them with check=true
+func (s *Server) handleLinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var id int
+	if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	check := false
+	if v := r.URL.Query().Get("check"); v != "" {
+		var err error
+		if check, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid check: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Checks may take a while, so the lock is not held for them
+	s.emailsMu.RLock()
+	msg, exists := s.storage.Get(id)
+	s.emailsMu.RUnlock()
+	if !exists || !visible(tenantScope(r), msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	links := extractLinks(parseMessage(msg))
+	if check {
+		s.checkLinks(r.Context(), links)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
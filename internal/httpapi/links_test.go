@@ -0,0 +1,106 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+const signupMessage = "Subject: Confirm\r\n" +
+	"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+	"--b\r\nContent-Type: text/plain\r\n\r\n" +
+	"Welcome!\r\nConfirm at https://app.example.test/confirm?token=abc.\r\n" +
+	"--b\r\nContent-Type: text/html\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+	"<p>Welcome!</p>\r\n<p><a class=3D\"btn\" href=3D\"https://app.example.test/confirm?token=3Dabc&amp;lang=3Den\">\r\n" +
+	"  <b>Confirm</b> your account</a></p>\r\n<a href=3D\"#top\">Top</a> <a href=3D'mailto:help@example.test'>Help</a>\r\n" +
+	"--b--\r\n"
+
+func TestLinks_Extract(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+	storage.Add(&httpapi.Message{From: "a@example.com", To: []string{"b@example.com"}, Raw: []byte(signupMessage)})
+
+	var links []httpapi.Link
+	getJSON(t, h, "/api/v1/messages/1/links", &links)
+	want := []httpapi.Link{
+		{URL: "https://app.example.test/confirm?token=abc&lang=en", Text: "Confirm your account", Part: "text/html", Line: 2},
+		{URL: "mailto:help@example.test", Text: "Help", Part: "text/html", Line: 4},
+		{URL: "https://app.example.test/confirm?token=abc", Part: "text/plain", Line: 2},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("expected %d links, got %+v", len(want), links)
+	}
+	for i := range want {
+		if links[i] != want[i] {
+			t.Errorf("link %d: expected %+v, got %+v", i, want[i], links[i])
+		}
+	}
+
+	if rec := do(h, http.MethodGet, "/api/v1/messages/9/links", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+	if rec := do(h, http.MethodGet, "/api/v1/messages/1/links?check=maybe", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestLinks_Check(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("expected HEAD, got %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/confirm":
+			http.Redirect(w, r, "/welcome", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer app.Close()
+	host := app.Listener.Addr().String()
+
+	storage := httpapi.NewStorage()
+	srv := httpapi.New("", storage)
+	srv.SetLinkCheckHosts([]string{host})
+	h := srv.Handler()
+	storage.Add(&httpapi.Message{Raw: []byte("Content-Type: text/plain\r\n\r\n" +
+		"Confirm: " + app.URL + "/confirm?token=abc\r\n" +
+		"Missing: " + app.URL + "/gone\r\n" +
+		"Again: " + app.URL + "/confirm?token=abc\r\n" +
+		"Elsewhere: https://example.com/\r\n")})
+
+	var links []httpapi.Link
+	getJSON(t, h, "/api/v1/messages/1/links?check=true", &links)
+	if len(links) != 4 {
+		t.Fatalf("expected 4 links, got %+v", links)
+	}
+	for i, want := range []struct {
+		status int
+		err    string
+	}{{http.StatusFound, ""}, {http.StatusNotFound, ""}, {http.StatusFound, ""}, {0, "host not allowed"}} {
+		if links[i].Status != want.status || links[i].Error != want.err {
+			t.Errorf("%s: expected %d %q, got %d %q", links[i].URL, want.status, want.err, links[i].Status, links[i].Error)
+		}
+	}
+
+	// A different port on an allowed host name is not allowed
+	u, _ := url.Parse(app.URL)
+	srv.SetLinkCheckHosts([]string{u.Hostname() + ":1"})
+	rec := do(h, http.MethodGet, "/api/v1/messages/1/links?check=true", "")
+	links = nil
+	json.NewDecoder(rec.Body).Decode(&links)
+	if links[0].Status != 0 || links[0].Error != "host not allowed" {
+		t.Errorf("unexpected check %+v", links[0])
+	}
+}
+
+func TestLinks_TenantScope(t *testing.T) {
+	_, h := tenantServer(t)
+	if rec := do(h, http.MethodGet, "/api/v1/messages/2/links", "alpha-token"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another tenant's message, got %d", rec.Code)
+	}
+}
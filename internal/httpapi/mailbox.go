@@ -0,0 +1,107 @@
+package httpapi
+
+import (
+	"sort"
+	"strings"
+)
+
+// Mailbox summarises the messages of one envelope recipient
+type Mailbox struct {
+	Address  string `json:"address"`
+	Messages int    `json:"messages"`
+	Unread   int    `json:"unread"`
+}
+
+// MailboxOptions controls how recipient addresses are grouped into mailboxes
+type MailboxOptions struct {
+	IgnoreCase bool   // treat User@Example.com and user@example.com as one mailbox
+	StripPlus  bool   // treat user+tag@example.com as user@example.com
+	Tenant     string // only include this tenant's messages when set
+}
+
+// Normalize returns the mailbox address for a recipient
+func (o MailboxOptions) Normalize(addr string) string {
+	addr = strings.TrimSpace(addr)
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "<"), ">")
+	if o.StripPlus {
+		if at := strings.LastIndex(addr, "@"); at > 0 {
+			local, domain := addr[:at], addr[at:]
+			if plus := strings.Index(local, "+"); plus > 0 {
+				local = local[:plus]
+			}
+			addr = local + domain
+		}
+	}
+	if o.IgnoreCase {
+		addr = strings.ToLower(addr)
+	}
+	return addr
+}
+
+// mailboxesOf returns the distinct mailboxes a message belongs to
+func (o MailboxOptions) mailboxesOf(msg *Message) []string {
+	seen := make(map[string]bool, len(msg.To))
+	var result []string
+	for _, rcpt := range msg.To {
+		addr := o.Normalize(rcpt)
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		result = append(result, addr)
+	}
+	return result
+}
+
+// Mailboxes lists every distinct envelope recipient, ordered by address
+func (s *Storage) Mailboxes(opts MailboxOptions) []Mailbox {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	byAddr := make(map[string]*Mailbox)
+	for _, msg := range s.messages {
+		if opts.Tenant != "" && msg.Tenant != opts.Tenant {
+			continue
+		}
+		for _, addr := range opts.mailboxesOf(msg) {
+			mb, ok := byAddr[addr]
+			if !ok {
+				mb = &Mailbox{Address: addr}
+				byAddr[addr] = mb
+			}
+			mb.Messages++
+			if !msg.Read {
+				mb.Unread++
+			}
+		}
+	}
+
+	result := make([]Mailbox, 0, len(byAddr))
+	for _, mb := range byAddr {
+		result = append(result, *mb)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Address < result[j].Address })
+	return result
+}
+
+// MailboxMessages returns the messages delivered to address, ordered by ID
+func (s *Storage) MailboxMessages(address string, opts MailboxOptions) []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	address = opts.Normalize(address)
+	result := []Message{}
+	for _, msg := range s.messages {
+		if opts.Tenant != "" && msg.Tenant != opts.Tenant {
+			continue
+		}
+		for _, addr := range opts.mailboxesOf(msg) {
+			if addr == address {
+				result = append(result, *msg.clone(false))
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
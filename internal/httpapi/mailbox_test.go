@@ -0,0 +1,76 @@
+package httpapi_test
+
+import (
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func addMailboxFixtures(s *httpapi.Storage) {
+	s.Add(&httpapi.Message{From: "app@example.com", To: []string{"alice@example.com"}})
+	s.Add(&httpapi.Message{From: "app@example.com", To: []string{"Alice@Example.com", "bob+test1@example.com"}})
+	s.Add(&httpapi.Message{From: "app@example.com", To: []string{"bob+test2@example.com"}})
+}
+
+func TestMailboxOptions_Normalize(t *testing.T) {
+	tests := []struct {
+		opts httpapi.MailboxOptions
+		in   string
+		want string
+	}{
+		{httpapi.MailboxOptions{}, "User+tag@Example.com", "User+tag@Example.com"},
+		{httpapi.MailboxOptions{IgnoreCase: true}, "User+tag@Example.com", "user+tag@example.com"},
+		{httpapi.MailboxOptions{StripPlus: true}, "User+tag@Example.com", "User@Example.com"},
+		{httpapi.MailboxOptions{IgnoreCase: true, StripPlus: true}, "<User+a+b@Example.com>", "user@example.com"},
+		{httpapi.MailboxOptions{StripPlus: true}, "+tag@example.com", "+tag@example.com"},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) with %+v = %q, want %q", tt.in, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestStorage_Mailboxes(t *testing.T) {
+	s := httpapi.NewStorage()
+	addMailboxFixtures(s)
+	s.SetRead(1, true)
+
+	boxes := s.Mailboxes(httpapi.MailboxOptions{IgnoreCase: true})
+	if len(boxes) != 3 {
+		t.Fatalf("expected 3 mailboxes, got %+v", boxes)
+	}
+	if boxes[0].Address != "alice@example.com" || boxes[0].Messages != 2 || boxes[0].Unread != 1 {
+		t.Errorf("unexpected alice mailbox %+v", boxes[0])
+	}
+
+	boxes = s.Mailboxes(httpapi.MailboxOptions{IgnoreCase: true, StripPlus: true})
+	if len(boxes) != 2 || boxes[1].Address != "bob@example.com" || boxes[1].Messages != 2 {
+		t.Errorf("expected plus addresses to be merged, got %+v", boxes)
+	}
+
+	boxes = s.Mailboxes(httpapi.MailboxOptions{})
+	if len(boxes) != 4 {
+		t.Errorf("expected case sensitive grouping to give 4 mailboxes, got %+v", boxes)
+	}
+}
+
+func TestStorage_MailboxMessages(t *testing.T) {
+	s := httpapi.NewStorage()
+	addMailboxFixtures(s)
+
+	msgs := s.MailboxMessages("ALICE@example.com", httpapi.MailboxOptions{IgnoreCase: true})
+	if len(msgs) != 2 || msgs[0].ID != 1 || msgs[1].ID != 2 {
+		t.Errorf("expected messages 1 and 2 for alice, got %+v", msgs)
+	}
+
+	msgs = s.MailboxMessages("bob+test2@example.com", httpapi.MailboxOptions{IgnoreCase: true})
+	if len(msgs) != 1 || msgs[0].ID != 3 {
+		t.Errorf("expected message 3 for bob+test2, got %+v", msgs)
+	}
+
+	msgs = s.MailboxMessages("nobody@example.com", httpapi.MailboxOptions{})
+	if msgs == nil || len(msgs) != 0 {
+		t.Errorf("expected empty non-nil result, got %#v", msgs)
+	}
+}
@@ -0,0 +1,320 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SetMailHogPrefix serves a MailHog compatible API under prefix, e.g.
+// "/mailhog", call it before Start
+func (s *Server) SetMailHogPrefix(prefix string) {
+	s.mailhogPrefix = prefix
+}
+
+// mailhogRoutes registers MailHog's v1 and v2 message routes under prefix
+func (s *Server) mailhogRoutes(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"/api/v1/messages", s.handleMailHogMessagesV1)
+	mux.HandleFunc(prefix+"/api/v1/messages/{id}", s.handleMailHogMessageV1)
+	mux.HandleFunc(prefix+"/api/v1/messages/{id}/download", s.handleMailHogDownload)
+	mux.HandleFunc(prefix+"/api/v2/messages", s.handleMailHogMessagesV2)
+	mux.HandleFunc(prefix+"/api/v2/search", s.handleMailHogSearch)
+}
+
+// mailhogMessage is MailHog's JSON representation of a message
+type mailhogMessage struct {
+	ID      string
+	From    *mailhogPath
+	To      []*mailhogPath
+	Content *mailhogContent
+	Created string
+	MIME    *mailhogMIME
+	Raw     *mailhogRaw
+}
+
+type mailhogPath struct {
+	Relays  []string
+	Mailbox string
+	Domain  string
+	Params  string
+}
+
+type mailhogContent struct {
+	Headers map[string][]string
+	Body    string
+	Size    int
+	MIME    *mailhogMIME
+}
+
+type mailhogMIME struct {
+	Parts []*mailhogContent
+}
+
+type mailhogRaw struct {
+	From string
+	To   []string
+	Data string
+	Helo string
+}
+
+// mailhogList is the envelope of the v2 list and search responses
+type mailhogList struct {
+	Total int               `json:"total"`
+	Count int               `json:"count"`
+	Start int               `json:"start"`
+	Items []*mailhogMessage `json:"items"`
+}
+
+// handleMailHogMessagesV1 lists every message, newest first, or deletes
+// all messages in scope
+func (s *Server) handleMailHogMessagesV1(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.mailhogFind(r, "", ""))
+	case http.MethodDelete:
+		s.emailsMu.Lock()
+		defer s.emailsMu.Unlock()
+
+		if scope := tenantScope(r); scope != "" {
+			s.storage.ClearTenant(scope)
+		} else {
+			s.storage.Clear()
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMailHogMessageV1 returns or deletes one message, a delete answers
+// 200 like MailHog
+func (s *Server) handleMailHogMessageV1(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+
+	msg, ok := s.mailhogMessage(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		s.storage.Delete(msg.ID)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toMailHog(msg))
+}
+
+// handleMailHogDownload returns the raw message as an .eml attachment
+func (s *Server) handleMailHogDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.emailsMu.RLock()
+	defer s.emailsMu.RUnlock()
+
+	msg, ok := s.mailhogMessage(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d.eml"`, msg.ID))
+	w.Write(msg.Raw)
+}
+
+// mailhogMessage looks up the message named by the id path value, writing
+// an error response when it is invalid or not visible
+func (s *Server) mailhogMessage(w http.ResponseWriter, r *http.Request) (*Message, bool) {
+	var id int
+	if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, false
+	}
+	msg, exists := s.storage.Get(id)
+	if !exists || !visible(tenantScope(r), msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	}
+	return msg, true
+}
+
+// handleMailHogMessagesV2 pages through the messages, newest first
+func (s *Server) handleMailHogMessagesV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeMailHogList(w, r, s.mailhogFind(r, "", ""))
+}
+
+// handleMailHogSearch filters by kind "from", "to" or "containing"
+func (s *Server) handleMailHogSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	if kind != "from" && kind != "to" && kind != "containing" {
+		http.Error(w, "Invalid search kind", http.StatusBadRequest)
+		return
+	}
+	s.writeMailHogList(w, r, s.mailhogFind(r, kind, r.URL.Query().Get("query")))
+}
+
+func (s *Server) writeMailHogList(w http.ResponseWriter, r *http.Request, messages []*mailhogMessage) {
+	start, limit := 0, 50
+	if v := r.URL.Query().Get("start"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid start", http.StatusBadRequest)
+			return
+		}
+		start = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	page := messages[min(start, len(messages)):min(start+limit, len(messages))]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mailhogList{Total: len(messages), Count: len(page), Start: start, Items: page})
+}
+
+// mailhogFind returns the messages in scope matching a MailHog search,
+// newest first like MailHog. An empty kind matches everything.
+func (s *Server) mailhogFind(r *http.Request, kind, query string) []*mailhogMessage {
+	s.emailsMu.RLock()
+	defer s.emailsMu.RUnlock()
+
+	scope := tenantScope(r)
+	var ids []int
+	for _, msg := range s.storage.List() {
+		if visible(scope, &msg) {
+			ids = append(ids, msg.ID)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	messages := []*mailhogMessage{}
+	for _, id := range ids {
+		msg, ok := s.storage.Get(id)
+		if !ok {
+			continue
+		}
+		mh := toMailHog(msg)
+		if kind == "" || mh.matches(kind, strings.ToLower(query)) {
+			messages = append(messages, mh)
+		}
+	}
+	return messages
+}
+
+// matches implements MailHog's case-insensitive search on the envelope,
+// headers and body
+func (m *mailhogMessage) matches(kind, query string) bool {
+	contains := func(values ...string) bool {
+		for _, v := range values {
+			if strings.Contains(strings.ToLower(v), query) {
+				return true
+			}
+		}
+		return false
+	}
+	switch kind {
+	case "from":
+		return contains(m.Raw.From) || contains(m.Content.Headers["From"]...)
+	case "to":
+		return contains(m.Raw.To...) || contains(m.Content.Headers["To"]...)
+	case "containing":
+		if contains(m.Content.Body) {
+			return true
+		}
+		for _, values := range m.Content.Headers {
+			if contains(values...) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func toMailHog(msg *Message) *mailhogMessage {
+	content := parseMailHogContent(msg.Raw)
+	mh := &mailhogMessage{
+		ID:      strconv.Itoa(msg.ID),
+		From:    toMailHogPath(msg.From),
+		To:      []*mailhogPath{},
+		Content: content,
+		Created: msg.CreatedAt,
+		MIME:    content.MIME,
+		Raw:     &mailhogRaw{From: msg.From, To: msg.To, Data: string(msg.Raw)},
+	}
+	for _, rcpt := range msg.To {
+		mh.To = append(mh.To, toMailHogPath(rcpt))
+	}
+	return mh
+}
+
+func toMailHogPath(addr string) *mailhogPath {
+	mailbox, domain, _ := strings.Cut(addr, "@")
+	return &mailhogPath{Mailbox: mailbox, Domain: domain}
+}
+
+// parseMailHogContent splits raw into headers and an undecoded body, with
+// the parts of multipart messages parsed recursively
+func parseMailHogContent(raw []byte) *mailhogContent {
+	content := &mailhogContent{Headers: map[string][]string{}, Body: string(raw), Size: len(raw)}
+
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return content
+	}
+	body, _ := io.ReadAll(tp.R)
+	content.Headers = header
+	content.Body = string(body)
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return content
+	}
+	content.MIME = &mailhogMIME{}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+		// Rebuild the part's source so nested multiparts parse the same way
+		var src bytes.Buffer
+		for key, values := range part.Header {
+			for _, v := range values {
+				fmt.Fprintf(&src, "%s: %s\r\n", key, v)
+			}
+		}
+		src.WriteString("\r\n")
+		io.Copy(&src, part)
+		content.MIME.Parts = append(content.MIME.Parts, parseMailHogContent(src.Bytes()))
+	}
+	return content
+}
@@ -0,0 +1,178 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+const multipartMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"Content-Type: multipart/mixed; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/csv\r\n" +
+	"Content-Disposition: attachment; filename=report.csv\r\n" +
+	"\r\n" +
+	"a,b\r\n" +
+	"--b1--\r\n"
+
+type mailhogMessage struct {
+	ID      string
+	From    struct{ Mailbox, Domain string }
+	To      []struct{ Mailbox, Domain string }
+	Content struct {
+		Headers map[string][]string
+		Body    string
+		Size    int
+	}
+	MIME *struct {
+		Parts []struct {
+			Headers map[string][]string
+			Body    string
+		}
+	}
+	Raw struct {
+		From string
+		To   []string
+		Data string
+	}
+}
+
+type mailhogList struct {
+	Total int              `json:"total"`
+	Count int              `json:"count"`
+	Start int              `json:"start"`
+	Items []mailhogMessage `json:"items"`
+}
+
+func mailhogServer(t *testing.T) (*httpapi.Storage, http.Handler) {
+	t.Helper()
+	storage := httpapi.NewStorage()
+	storage.Add(&httpapi.Message{From: "alice@example.com", To: []string{"bob@example.com"}, Raw: []byte(multipartMessage)})
+	storage.Add(&httpapi.Message{From: "carol@example.org", To: []string{"dave@example.org"},
+		Raw: []byte("Subject: Hello\r\n\r\nPlain body\r\n")})
+
+	srv := httpapi.New("", storage)
+	srv.SetMailHogPrefix("/mailhog")
+	return storage, srv.Handler()
+}
+
+func getJSON(t *testing.T, h http.Handler, path string, v any) {
+	t.Helper()
+	rec := do(h, http.MethodGet, path, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s returned %d: %s", path, rec.Code, rec.Body)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMailHog_V2Messages(t *testing.T) {
+	_, h := mailhogServer(t)
+
+	var list mailhogList
+	getJSON(t, h, "/mailhog/api/v2/messages", &list)
+	if list.Total != 2 || list.Count != 2 || len(list.Items) != 2 {
+		t.Fatalf("unexpected list %+v", list)
+	}
+	// Newest first
+	first, second := list.Items[0], list.Items[1]
+	if first.ID != "2" || second.ID != "1" {
+		t.Errorf("expected newest first, got %s, %s", first.ID, second.ID)
+	}
+	if second.From.Mailbox != "alice" || second.From.Domain != "example.com" || second.To[0].Mailbox != "bob" {
+		t.Errorf("unexpected envelope %+v %+v", second.From, second.To)
+	}
+	if second.Content.Headers["Subject"][0] != "Report" || second.Content.Size != len(multipartMessage) {
+		t.Errorf("unexpected content %+v", second.Content)
+	}
+	if second.MIME == nil || len(second.MIME.Parts) != 2 || second.MIME.Parts[0].Body != "See attached" {
+		t.Fatalf("unexpected MIME parts %+v", second.MIME)
+	}
+	if second.MIME.Parts[1].Headers["Content-Disposition"][0] != "attachment; filename=report.csv" {
+		t.Errorf("unexpected attachment headers %v", second.MIME.Parts[1].Headers)
+	}
+	if first.MIME != nil || first.Content.Body != "Plain body\r\n" || first.Raw.From != "carol@example.org" {
+		t.Errorf("unexpected plain message %+v", first)
+	}
+
+	getJSON(t, h, "/mailhog/api/v2/messages?start=1&limit=1", &list)
+	if list.Total != 2 || list.Count != 1 || list.Start != 1 || list.Items[0].ID != "1" {
+		t.Errorf("unexpected page %+v", list)
+	}
+}
+
+func TestMailHog_Search(t *testing.T) {
+	_, h := mailhogServer(t)
+
+	for _, tc := range []struct {
+		kind, query, want string
+	}{
+		{"from", "ALICE@", "1"},
+		{"to", "dave", "2"},
+		{"containing", "plain body", "2"},
+		{"containing", "report", "1"},
+	} {
+		var list mailhogList
+		getJSON(t, h, "/mailhog/api/v2/search?kind="+tc.kind+"&query="+url.QueryEscape(tc.query), &list)
+		if list.Total != 1 || list.Items[0].ID != tc.want {
+			t.Errorf("%s=%q: expected message %s, got %+v", tc.kind, tc.query, tc.want, list.Items)
+		}
+	}
+
+	if rec := do(h, http.MethodGet, "/mailhog/api/v2/search?kind=subject&query=x", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown kind, got %d", rec.Code)
+	}
+}
+
+func TestMailHog_V1(t *testing.T) {
+	storage, h := mailhogServer(t)
+
+	var messages []mailhogMessage
+	getJSON(t, h, "/mailhog/api/v1/messages", &messages)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+
+	var msg mailhogMessage
+	getJSON(t, h, "/mailhog/api/v1/messages/1", &msg)
+	if msg.Raw.Data != multipartMessage {
+		t.Errorf("unexpected raw data %q", msg.Raw.Data)
+	}
+
+	rec := do(h, http.MethodGet, "/mailhog/api/v1/messages/1/download", "")
+	if rec.Header().Get("Content-Type") != "message/rfc822" || rec.Body.String() != multipartMessage {
+		t.Errorf("unexpected download %q %q", rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	if rec := do(h, http.MethodDelete, "/mailhog/api/v1/messages/1", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for delete, got %d", rec.Code)
+	}
+	if _, ok := storage.Get(1); ok {
+		t.Error("message 1 was not deleted")
+	}
+
+	if rec := do(h, http.MethodDelete, "/mailhog/api/v1/messages", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for delete all, got %d", rec.Code)
+	}
+	if n, _ := storage.Size(); n != 0 {
+		t.Errorf("expected empty storage, got %d messages", n)
+	}
+}
+
+func TestMailHog_DisabledByDefault(t *testing.T) {
+	h := httpapi.New("", httpapi.NewStorage()).Handler()
+	if rec := do(h, http.MethodGet, "/mailhog/api/v2/messages", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a prefix, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,602 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/mimeparse"
+)
+
+// SetMailpitPrefix serves a Mailpit compatible API under prefix, e.g.
+// "/mailpit", call it before Start
+func (s *Server) SetMailpitPrefix(prefix string) {
+	s.mailpitPrefix = prefix
+}
+
+// mailpitRoutes registers Mailpit's v1 message routes under prefix
+func (s *Server) mailpitRoutes(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"/api/v1/messages", s.handleMailpitMessages)
+	mux.HandleFunc(prefix+"/api/v1/search", s.handleMailpitSearch)
+	mux.HandleFunc(prefix+"/api/v1/message/{id}", s.handleMailpitMessage)
+	mux.HandleFunc(prefix+"/api/v1/message/{id}/headers", s.handleMailpitHeaders)
+	mux.HandleFunc(prefix+"/api/v1/message/{id}/raw", s.handleMailpitRaw)
+	mux.HandleFunc(prefix+"/api/v1/message/{id}/part/{part}", s.handleMailpitPart)
+}
+
+type mailpitAddress struct {
+	Name    string
+	Address string
+}
+
+type mailpitAttachment struct {
+	PartID      string
+	FileName    string
+	ContentType string
+	ContentID   string
+	Size        int
+}
+
+// mailpitSummary is a message in Mailpit's list and search responses
+type mailpitSummary struct {
+	ID          string
+	MessageID   string
+	Read        bool
+	From        *mailpitAddress
+	To          []*mailpitAddress
+	Cc          []*mailpitAddress
+	Bcc         []*mailpitAddress
+	ReplyTo     []*mailpitAddress
+	Subject     string
+	Created     string
+	Tags        []string
+	Size        int
+	Attachments int
+	Snippet     string
+}
+
+// mailpitMessage is Mailpit's full message representation
+type mailpitMessage struct {
+	ID          string
+	MessageID   string
+	From        *mailpitAddress
+	To          []*mailpitAddress
+	Cc          []*mailpitAddress
+	Bcc         []*mailpitAddress
+	ReplyTo     []*mailpitAddress
+	ReturnPath  string
+	Subject     string
+	Date        string
+	Tags        []string
+	Text        string
+	HTML        string
+	Size        int
+	Inline      []*mailpitAttachment
+	Attachments []*mailpitAttachment
+}
+
+type mailpitList struct {
+	Total         int               `json:"total"`
+	Unread        int               `json:"unread"`
+	Count         int               `json:"count"`
+	MessagesCount int               `json:"messages_count"`
+	Start         int               `json:"start"`
+	Tags          []string          `json:"tags"`
+	Messages      []*mailpitSummary `json:"messages"`
+}
+
+// mailpitParsed is a stored message decoded for the Mailpit API
+type mailpitParsed struct {
+	*parsedMessage
+}
+
+func parseMailpit(msg *Message) *mailpitParsed {
+	return &mailpitParsed{parseMessage(msg)}
+}
+
+// mailpitAttachments describes parts in Mailpit's attachment format
+func mailpitAttachments(parts []*mimeparse.Part) []*mailpitAttachment {
+	list := []*mailpitAttachment{}
+	for _, mp := range parts {
+		list = append(list, &mailpitAttachment{PartID: mp.ID, FileName: mp.FileName, ContentType: mp.ContentType,
+			ContentID: mp.ContentID, Size: len(mp.Body)})
+	}
+	return list
+}
+
+func (p *mailpitParsed) addresses(key string) []*mailpitAddress {
+	list := []*mailpitAddress{}
+	if p.Header.Header.Len() == 0 {
+		return list
+	}
+	addrs, _ := p.Header.AddressList(key)
+	for _, a := range addrs {
+		list = append(list, &mailpitAddress{Name: a.Name, Address: a.Address})
+	}
+	return list
+}
+
+func (p *mailpitParsed) from() *mailpitAddress {
+	if from := p.addresses("From"); len(from) > 0 {
+		return from[0]
+	}
+	return &mailpitAddress{Address: p.msg.From}
+}
+
+func (p *mailpitParsed) to() []*mailpitAddress {
+	if to := p.addresses("To"); len(to) > 0 {
+		return to
+	}
+	to := []*mailpitAddress{}
+	for _, rcpt := range p.msg.To {
+		to = append(to, &mailpitAddress{Address: rcpt})
+	}
+	return to
+}
+
+// bcc returns the envelope recipients missing from the To and Cc headers
+func (p *mailpitParsed) bcc() []*mailpitAddress {
+	listed := make(map[string]bool)
+	for _, a := range append(p.addresses("To"), p.addresses("Cc")...) {
+		listed[strings.ToLower(a.Address)] = true
+	}
+	bcc := []*mailpitAddress{}
+	if len(listed) == 0 {
+		return bcc // to() lists the envelope recipients instead
+	}
+	for _, rcpt := range p.msg.To {
+		if !listed[strings.ToLower(rcpt)] {
+			bcc = append(bcc, &mailpitAddress{Address: rcpt})
+		}
+	}
+	return bcc
+}
+
+func (p *mailpitParsed) messageID() string {
+	if p.Header.Header.Len() == 0 {
+		return ""
+	}
+	id, _ := p.Header.MessageID()
+	return id
+}
+
+// snippet is the start of the text, or of the HTML without tags
+func (p *mailpitParsed) snippet() string {
+	text := p.Text
+	if strings.TrimSpace(text) == "" {
+		text = htmlTags.ReplaceAllString(p.HTML, " ")
+	}
+	return truncateRunes(strings.TrimSpace(whitespace.ReplaceAllString(text, " ")), 250)
+}
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
+
+func (p *mailpitParsed) summary() *mailpitSummary {
+	return &mailpitSummary{
+		ID:          strconv.Itoa(p.msg.ID),
+		MessageID:   p.messageID(),
+		Read:        p.msg.Read,
+		From:        p.from(),
+		To:          p.to(),
+		Cc:          p.addresses("Cc"),
+		Bcc:         p.bcc(),
+		ReplyTo:     p.addresses("Reply-To"),
+		Subject:     p.subject(),
+		Created:     p.msg.CreatedAt,
+		Tags:        append([]string{}, p.msg.Tags...),
+		Size:        len(p.msg.Raw),
+		Attachments: len(p.Attachments),
+		Snippet:     p.snippet(),
+	}
+}
+
+func (p *mailpitParsed) message() *mailpitMessage {
+	m := &mailpitMessage{
+		ID:          strconv.Itoa(p.msg.ID),
+		MessageID:   p.messageID(),
+		From:        p.from(),
+		To:          p.to(),
+		Cc:          p.addresses("Cc"),
+		Bcc:         p.bcc(),
+		ReplyTo:     p.addresses("Reply-To"),
+		Subject:     p.subject(),
+		Date:        p.msg.CreatedAt,
+		Tags:        append([]string{}, p.msg.Tags...),
+		Text:        p.Text,
+		HTML:        p.HTML,
+		Size:        len(p.msg.Raw),
+		Inline:      mailpitAttachments(p.Inline),
+		Attachments: mailpitAttachments(p.Attachments),
+	}
+	if p.Header.Header.Len() > 0 {
+		m.ReturnPath = strings.Trim(p.Header.Get("Return-Path"), "<>")
+		if date, err := p.Header.Date(); err == nil {
+			m.Date = date.UTC().Format(time.RFC3339)
+		}
+	}
+	return m
+}
+
+// mailpitTerm is one condition of a Mailpit search query
+type mailpitTerm struct {
+	field  string // "" searches everywhere
+	value  string // lower case
+	negate bool
+}
+
+// parseMailpitQuery splits a query into terms. It supports quoted phrases,
+// negation with "-" or "!", from:, to:, subject:, is:read, is:unread,
+// has:attachment and tag:.
+func parseMailpitQuery(query string) []mailpitTerm {
+	var tokens []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+
+	var terms []mailpitTerm
+	for _, tok := range tokens {
+		var t mailpitTerm
+		if rest, ok := strings.CutPrefix(tok, "-"); ok {
+			t.negate, tok = true, rest
+		} else if rest, ok := strings.CutPrefix(tok, "!"); ok {
+			t.negate, tok = true, rest
+		}
+		if field, value, ok := strings.Cut(tok, ":"); ok {
+			switch field = strings.ToLower(field); field {
+			case "from", "to", "subject", "is", "has", "tag":
+				t.field, tok = field, value
+			}
+		}
+		t.value = strings.ToLower(tok)
+		if t.value != "" {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+func (p *mailpitParsed) matches(terms []mailpitTerm) bool {
+	for _, t := range terms {
+		if p.matchTerm(t) == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *mailpitParsed) matchTerm(t mailpitTerm) bool {
+	contains := func(values ...string) bool {
+		for _, v := range values {
+			if strings.Contains(strings.ToLower(v), t.value) {
+				return true
+			}
+		}
+		return false
+	}
+	addrs := func(list []*mailpitAddress) []string {
+		var values []string
+		for _, a := range list {
+			values = append(values, a.Name, a.Address)
+		}
+		return values
+	}
+	from := append(addrs([]*mailpitAddress{p.from()}), p.msg.From)
+	to := append(addrs(append(p.to(), p.addresses("Cc")...)), p.msg.To...)
+
+	switch t.field {
+	case "from":
+		return contains(from...)
+	case "to":
+		return contains(to...)
+	case "subject":
+		return contains(p.subject())
+	case "is":
+		return (t.value == "read" && p.msg.Read) || (t.value == "unread" && !p.msg.Read)
+	case "has":
+		return t.value == "attachment" && len(p.Attachments) > 0
+	case "tag":
+		return slices.ContainsFunc(p.msg.Tags, func(tag string) bool { return strings.EqualFold(tag, t.value) })
+	}
+	return contains(p.subject(), p.Text, p.HTML) || contains(from...) || contains(to...)
+}
+
+// mailpitFind returns the parsed messages in scope matching terms, newest
+// first like Mailpit, and the number of unread messages in scope
+func (s *Server) mailpitFind(r *http.Request, terms []mailpitTerm) (matched []*mailpitParsed, total, unread int) {
+	s.emailsMu.RLock()
+	defer s.emailsMu.RUnlock()
+
+	scope := tenantScope(r)
+	var ids []int
+	for _, msg := range s.storage.List() {
+		if visible(scope, &msg) {
+			ids = append(ids, msg.ID)
+			if !msg.Read {
+				unread++
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	for _, id := range ids {
+		msg, ok := s.storage.Get(id)
+		if !ok {
+			continue
+		}
+		if p := parseMailpit(msg); p.matches(terms) {
+			matched = append(matched, p)
+		}
+	}
+	return matched, len(ids), unread
+}
+
+func (s *Server) writeMailpitList(w http.ResponseWriter, r *http.Request, terms []mailpitTerm) {
+	start, limit := 0, 50
+	if v := r.URL.Query().Get("start"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid start", http.StatusBadRequest)
+			return
+		}
+		start = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	matched, total, unread := s.mailpitFind(r, terms)
+	list := mailpitList{Total: total, Unread: unread, MessagesCount: len(matched), Start: start,
+		Tags: []string{}, Messages: []*mailpitSummary{}}
+	for _, p := range matched[min(start, len(matched)):min(start+limit, len(matched))] {
+		list.Messages = append(list.Messages, p.summary())
+	}
+	list.Count = len(list.Messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// mailpitIDs is the body of Mailpit's bulk delete and read requests
+type mailpitIDs struct {
+	IDs  []string
+	Read bool
+}
+
+// handleMailpitMessages lists messages, deletes them or sets their read
+// status. An empty ID list in a DELETE or PUT selects every message.
+func (s *Server) handleMailpitMessages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.writeMailpitList(w, r, nil)
+		return
+	case http.MethodDelete, http.MethodPut:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req mailpitIDs
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ids, ok := s.mailpitSelect(w, r, req.IDs)
+	if !ok {
+		return
+	}
+
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+	for _, id := range ids {
+		if r.Method == http.MethodDelete {
+			s.storage.Delete(id)
+		} else {
+			s.storage.SetRead(id, req.Read)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+// mailpitSelect resolves Mailpit ID strings to visible message IDs, every
+// message in scope when ids is empty
+func (s *Server) mailpitSelect(w http.ResponseWriter, r *http.Request, ids []string) ([]int, bool) {
+	scope := tenantScope(r)
+	var selected []int
+	if len(ids) == 0 {
+		for _, msg := range s.storage.List() {
+			if visible(scope, &msg) {
+				selected = append(selected, msg.ID)
+			}
+		}
+		return selected, true
+	}
+	for _, v := range ids {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid ID "+strconv.Quote(v), http.StatusBadRequest)
+			return nil, false
+		}
+		if msg, ok := s.storage.Get(id); ok && visible(scope, msg) {
+			selected = append(selected, id)
+		}
+	}
+	return selected, true
+}
+
+// handleMailpitSearch lists or deletes the messages matching query
+func (s *Server) handleMailpitSearch(w http.ResponseWriter, r *http.Request) {
+	terms := parseMailpitQuery(r.URL.Query().Get("query"))
+	switch r.Method {
+	case http.MethodGet:
+		s.writeMailpitList(w, r, terms)
+	case http.MethodDelete:
+		matched, _, _ := s.mailpitFind(r, terms)
+		s.emailsMu.Lock()
+		defer s.emailsMu.Unlock()
+		for _, p := range matched {
+			s.storage.Delete(p.msg.ID)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// mailpitMessage looks up the message named by the id path value, which
+// may be "latest", writing an error response when it is not visible
+func (s *Server) mailpitMessage(w http.ResponseWriter, r *http.Request) (*Message, bool) {
+	scope := tenantScope(r)
+	idStr := r.PathValue("id")
+	var id int
+	if idStr == "latest" {
+		for _, msg := range s.storage.List() {
+			if visible(scope, &msg) && msg.ID > id {
+				id = msg.ID
+			}
+		}
+	} else if _, err := fmt.Sscanf(idStr, "%d", &id); err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	msg, exists := s.storage.Get(id)
+	if !exists || !visible(scope, msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	}
+	return msg, true
+}
+
+// handleMailpitMessage returns a message and marks it read, like opening
+// it in Mailpit
+func (s *Server) handleMailpitMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+
+	msg, ok := s.mailpitMessage(w, r)
+	if !ok {
+		return
+	}
+	if !msg.Read {
+		s.storage.SetRead(msg.ID, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(parseMailpit(msg).message())
+}
+
+func (s *Server) handleMailpitHeaders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.emailsMu.RLock()
+	defer s.emailsMu.RUnlock()
+
+	msg, ok := s.mailpitMessage(w, r)
+	if !ok {
+		return
+	}
+	headers := map[string][]string{}
+	if p := parseMailpit(msg); p.Header.Header.Len() > 0 {
+		fields := p.Header.Fields()
+		for fields.Next() {
+			key := textproto.CanonicalMIMEHeaderKey(fields.Key())
+			value, err := fields.Text()
+			if err != nil {
+				value = fields.Value()
+			}
+			headers[key] = append(headers[key], value)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(headers)
+}
+
+func (s *Server) handleMailpitRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.emailsMu.RLock()
+	defer s.emailsMu.RUnlock()
+
+	msg, ok := s.mailpitMessage(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(msg.Raw)
+}
+
+// handleMailpitPart returns the decoded content of one MIME part
+func (s *Server) handleMailpitPart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.emailsMu.RLock()
+	defer s.emailsMu.RUnlock()
+
+	msg, ok := s.mailpitMessage(w, r)
+	if !ok {
+		return
+	}
+	for _, part := range parseMailpit(msg).Parts {
+		if part.ID != r.PathValue("part") {
+			continue
+		}
+		contentType := part.ContentType
+		if strings.HasPrefix(contentType, "text/") {
+			contentType += "; charset=utf-8" // text parts are decoded to UTF-8
+		}
+		w.Header().Set("Content-Type", contentType)
+		if part.FileName != "" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("filename=%q", part.FileName))
+		}
+		w.Write(part.Body)
+		return
+	}
+	http.Error(w, "Part not found", http.StatusNotFound)
+}
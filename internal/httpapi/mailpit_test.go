@@ -0,0 +1,191 @@
+package httpapi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+const mailpitMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Cc: carol@example.com\r\n" +
+	"Message-ID: <report-1@example.com>\r\n" +
+	"Subject: Quarterly report\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Numbers are up\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Numbers are <b>up</b></p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/csv\r\n" +
+	"Content-Disposition: attachment; filename=report.csv\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"YSxiCjEsMgo=\r\n" +
+	"--outer--\r\n"
+
+type mailpitAddress struct{ Name, Address string }
+
+type mailpitSummary struct {
+	ID          string
+	MessageID   string
+	Read        bool
+	From        mailpitAddress
+	To, Cc, Bcc []mailpitAddress
+	Subject     string
+	Attachments int
+	Snippet     string
+}
+
+type mailpitList struct {
+	Total         int              `json:"total"`
+	Unread        int              `json:"unread"`
+	Count         int              `json:"count"`
+	MessagesCount int              `json:"messages_count"`
+	Messages      []mailpitSummary `json:"messages"`
+}
+
+func mailpitServer(t *testing.T) (*httpapi.Storage, http.Handler) {
+	t.Helper()
+	storage := httpapi.NewStorage()
+	storage.Add(&httpapi.Message{From: "alice@example.com", Subject: "Quarterly report",
+		To: []string{"bob@example.com", "carol@example.com", "audit@example.com"}, Raw: []byte(mailpitMessage)})
+	storage.Add(&httpapi.Message{From: "dave@example.org", To: []string{"erin@example.org"}, Subject: "Hello",
+		Raw: []byte("Subject: Hello\r\n\r\nJust saying hi\r\n")})
+
+	srv := httpapi.New("", storage)
+	srv.SetMailpitPrefix("/mailpit")
+	return storage, srv.Handler()
+}
+
+func TestMailpit_Messages(t *testing.T) {
+	_, h := mailpitServer(t)
+
+	var list mailpitList
+	getJSON(t, h, "/mailpit/api/v1/messages", &list)
+	if list.Total != 2 || list.Unread != 2 || list.Count != 2 || len(list.Messages) != 2 {
+		t.Fatalf("unexpected list %+v", list)
+	}
+	report := list.Messages[1]
+	if list.Messages[0].ID != "2" || report.ID != "1" {
+		t.Errorf("expected newest first, got %s, %s", list.Messages[0].ID, report.ID)
+	}
+	if report.From != (mailpitAddress{"Alice", "alice@example.com"}) || report.MessageID != "report-1@example.com" {
+		t.Errorf("unexpected sender or ID %+v", report)
+	}
+	if len(report.Bcc) != 1 || report.Bcc[0].Address != "audit@example.com" || len(report.Cc) != 1 {
+		t.Errorf("unexpected recipients cc=%v bcc=%v", report.Cc, report.Bcc)
+	}
+	if report.Attachments != 1 || report.Snippet != "Numbers are up" {
+		t.Errorf("unexpected attachments or snippet %+v", report)
+	}
+
+	getJSON(t, h, "/mailpit/api/v1/messages?start=1&limit=1", &list)
+	if list.Count != 1 || list.Messages[0].ID != "1" {
+		t.Errorf("unexpected page %+v", list)
+	}
+}
+
+func TestMailpit_Message(t *testing.T) {
+	storage, h := mailpitServer(t)
+
+	var msg struct {
+		ID          string
+		Subject     string
+		Text        string
+		HTML        string
+		Attachments []struct{ PartID, FileName, ContentType string }
+	}
+	getJSON(t, h, "/mailpit/api/v1/message/1", &msg)
+	if msg.Text != "Numbers are up" || !strings.Contains(msg.HTML, "<b>up</b>") {
+		t.Errorf("unexpected bodies %q %q", msg.Text, msg.HTML)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].PartID != "2" || msg.Attachments[0].FileName != "report.csv" {
+		t.Fatalf("unexpected attachments %+v", msg.Attachments)
+	}
+	if m, _ := storage.Get(1); !m.Read {
+		t.Error("viewing a message should mark it read")
+	}
+
+	getJSON(t, h, "/mailpit/api/v1/message/latest", &msg)
+	if msg.ID != "2" {
+		t.Errorf("expected latest message 2, got %s", msg.ID)
+	}
+
+	rec := do(h, http.MethodGet, "/mailpit/api/v1/message/1/part/2", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "a,b\n1,2\n" || rec.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Errorf("unexpected part %d %q %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if rec := do(h, http.MethodGet, "/mailpit/api/v1/message/1/part/1.2", ""); !strings.Contains(rec.Body.String(), "<b>up</b>") {
+		t.Errorf("unexpected nested part %q", rec.Body)
+	}
+	if rec := do(h, http.MethodGet, "/mailpit/api/v1/message/1/part/9", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing part, got %d", rec.Code)
+	}
+
+	var headers map[string][]string
+	getJSON(t, h, "/mailpit/api/v1/message/1/headers", &headers)
+	if headers["Subject"][0] != "Quarterly report" || headers["Message-Id"][0] != "<report-1@example.com>" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestMailpit_Search(t *testing.T) {
+	_, h := mailpitServer(t)
+
+	for query, want := range map[string]string{
+		"from:alice":            "1",
+		"to:erin@example.org":   "2",
+		`subject:"quarterly"`:   "1",
+		"has:attachment":        "1",
+		"numbers":               "1",
+		"-has:attachment":       "2",
+		`"saying hi" is:unread`: "2",
+	} {
+		var list mailpitList
+		getJSON(t, h, "/mailpit/api/v1/search?query="+url.QueryEscape(query), &list)
+		if list.MessagesCount != 1 || list.Messages[0].ID != want {
+			t.Errorf("%s: expected message %s, got %+v", query, want, list.Messages)
+		}
+	}
+}
+
+func TestMailpit_BulkUpdates(t *testing.T) {
+	storage, h := mailpitServer(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/mailpit/api/v1/messages", strings.NewReader(`{"IDs": ["2"], "Read": true}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT returned %d", rec.Code)
+	}
+	if m, _ := storage.Get(2); !m.Read {
+		t.Error("message 2 should be read")
+	}
+
+	if rec := do(h, http.MethodDelete, "/mailpit/api/v1/search?query=from:alice", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE search returned %d", rec.Code)
+	}
+	if _, ok := storage.Get(1); ok {
+		t.Error("message 1 should be deleted")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/mailpit/api/v1/messages", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if n, _ := storage.Size(); n != 0 {
+		t.Errorf("expected an empty storage, got %d messages", n)
+	}
+}
@@ -0,0 +1,41 @@
+package httpapi
+
+import (
+	"net/http"
+
+	"github.com/joukojo/go-mail-testserver/internal/metrics"
+)
+
+var (
+	requestsTotal = metrics.Default.NewCounter("mailserver_http_requests_total",
+		"HTTP API requests by route and status.", "route", "status")
+	evictionsTotal = metrics.Default.NewCounter("mailserver_storage_evictions_total",
+		"Messages removed by the retention limits.")
+)
+
+// storageMetrics reports the size of storage. Each server has its own
+// registry so servers over different storages do not replace each other.
+func storageMetrics(storage *Storage) *metrics.Registry {
+	r := metrics.NewRegistry()
+	r.NewGaugeFunc("mailserver_storage_messages", "Messages in storage.", func() float64 {
+		n, _ := storage.Size()
+		return float64(n)
+	})
+	r.NewGaugeFunc("mailserver_storage_bytes", "Raw size of the messages in storage.", func() float64 {
+		_, bytes := storage.Size()
+		return float64(bytes)
+	})
+	return r
+}
+
+// handleMetrics serves the process wide metrics and those of the server's
+// storage in the Prometheus text format. It needs no token because it
+// exposes no message content.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	metrics.Default.Handler().ServeHTTP(w, r)
+	s.metrics.WriteText(w)
+}
@@ -0,0 +1,81 @@
+package httpapi_test
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+// metric returns the value of the sample named series, 0 when absent
+func metric(t *testing.T, h http.Handler, series string) float64 {
+	t.Helper()
+	rec := do(h, http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d", rec.Code)
+	}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetrics_RequestsAndStorage(t *testing.T) {
+	storage, h := tenantServer(t)
+	series := `mailserver_http_requests_total{route="/api/v1/messages",status="200"}`
+	before := metric(t, h, series)
+
+	do(h, http.MethodGet, "/api/v1/messages", "alpha-token")
+	do(h, http.MethodGet, "/api/v1/messages", "beta-token")
+	if got := metric(t, h, series); got != before+2 {
+		t.Errorf("expected %v requests, got %v", before+2, got)
+	}
+	if got := metric(t, h, "mailserver_storage_messages"); got != 3 {
+		t.Errorf("expected 3 stored messages, got %v", got)
+	}
+
+	evictions := metric(t, h, "mailserver_storage_evictions_total")
+	storage.SetRetention(1, 0)
+	if got := metric(t, h, "mailserver_storage_evictions_total"); got != evictions+2 {
+		t.Errorf("expected %v evictions, got %v", evictions+2, got)
+	}
+}
+
+func TestMetrics_NoTokenNeeded(t *testing.T) {
+	_, h := tenantServer(t)
+
+	rec := do(h, http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 without a token, got %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	if rec := do(h, http.MethodPost, "/metrics", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", rec.Code)
+	}
+}
+
+func TestMetrics_StoragePerServer(t *testing.T) {
+	first, second := httpapi.NewStorage(), httpapi.NewStorage()
+	h1 := httpapi.New("", first).Handler()
+	h2 := httpapi.New("", second).Handler()
+	first.Add(&httpapi.Message{Raw: []byte("Subject: one\r\n\r\n")})
+
+	if got := metric(t, h1, "mailserver_storage_messages"); got != 1 {
+		t.Errorf("expected 1 message on the first server, got %v", got)
+	}
+	if got := metric(t, h2, "mailserver_storage_messages"); got != 0 {
+		t.Errorf("expected 0 messages on the second server, got %v", got)
+	}
+}
@@ -0,0 +1,31 @@
+package httpapi
+
+import (
+	"regexp"
+
+	"github.com/joukojo/go-mail-testserver/internal/mimeparse"
+)
+
+var (
+	htmlTags   = regexp.MustCompile(`(?s)<[^>]*>`)
+	whitespace = regexp.MustCompile(`\s+`)
+)
+
+// parsedMessage is a stored message with its MIME structure decoded
+type parsedMessage struct {
+	msg *Message
+	*mimeparse.Message
+}
+
+func parseMessage(msg *Message) *parsedMessage {
+	return &parsedMessage{msg: msg, Message: mimeparse.Parse(msg.Raw, msg.Body)}
+}
+
+// subject prefers the decoded subject stored with the message
+func (p *parsedMessage) subject() string {
+	if p.msg.Subject != "" || p.Header.Header.Len() == 0 {
+		return p.msg.Subject
+	}
+	subject, _ := p.Header.Subject()
+	return subject
+}
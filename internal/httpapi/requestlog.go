@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/logging"
+)
+
+type requestIDKey struct{}
+
+// logRequests gives each request an ID, taken from a valid X-Request-ID
+// header or generated, echoes it in the response and logs the request
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = logging.NewID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK, route: "unmatched"}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		requestsTotal.Inc(rec.route, strconv.Itoa(rec.status))
+		slog.Info("http request", "request", id, "method", r.Method, "path", r.URL.Path,
+			"route", rec.route, "status", rec.status, "duration", time.Since(start))
+	})
+}
+
+// requestID returns the ID logRequests gave the request
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// recordRoute stores the pattern matched by next on the statusRecorder,
+// it must wrap the mux directly because middleware may copy the request
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if rec, ok := w.(*statusRecorder); ok && r.Pattern != "" {
+			rec.route = r.Pattern
+		}
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder captures the response status and matched route for
+// logging and metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	route  string
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush keeps event streams working through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
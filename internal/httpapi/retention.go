@@ -0,0 +1,53 @@
+package httpapi
+
+import (
+	"sort"
+	"time"
+)
+
+// SetRetention limits the number of stored messages and their age, zero
+// disables a limit. Limits are enforced when a message is added and by Prune.
+func (s *Storage) SetRetention(maxMessages int, maxAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxMessages = maxMessages
+	s.maxAge = maxAge
+	s.prune()
+}
+
+// Prune removes the messages exceeding the retention limits, oldest first
+func (s *Storage) Prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+}
+
+// prune must be called with mu held
+func (s *Storage) prune() {
+	if s.maxMessages <= 0 && s.maxAge <= 0 {
+		return
+	}
+
+	ids := make([]int, 0, len(s.messages))
+	for id := range s.messages {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	cutoff := time.Now().Add(-s.maxAge)
+	for i, id := range ids {
+		msg := s.messages[id]
+		expired := s.maxMessages > 0 && len(ids)-i > s.maxMessages
+		if !expired && s.maxAge > 0 {
+			created, err := time.Parse(time.RFC3339, msg.CreatedAt)
+			expired = err == nil && created.Before(cutoff)
+		}
+		if !expired {
+			break
+		}
+		delete(s.messages, id)
+		evictionsTotal.Inc()
+		s.publish(Event{Type: EventDeleted, ID: id, Tenant: msg.Tenant})
+	}
+}
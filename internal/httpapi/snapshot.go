@@ -0,0 +1,414 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is a copy of the storage state: messages with their flags and
+// the ID counter
+type Snapshot struct {
+	Name      string
+	CreatedAt string
+	NextID    int
+	Messages  []*Message // with raw bytes, ordered by ID
+}
+
+// SnapshotInfo describes a stored snapshot
+type SnapshotInfo struct {
+	Name      string `json:"name"`
+	CreatedAt string `json:"createdAt"`
+	Messages  int    `json:"messages"`
+}
+
+func (s *Snapshot) info() SnapshotInfo {
+	return SnapshotInfo{Name: s.Name, CreatedAt: s.CreatedAt, Messages: len(s.Messages)}
+}
+
+// Snapshot returns a deep copy of the storage state
+func (s *Storage) Snapshot(name string) *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := &Snapshot{
+		Name:      name,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		NextID:    s.nextID,
+		Messages:  make([]*Message, 0, len(s.messages)),
+	}
+	for _, msg := range s.messages {
+		snap.Messages = append(snap.Messages, msg.clone(true))
+	}
+	sort.Slice(snap.Messages, func(i, j int) bool { return snap.Messages[i].ID < snap.Messages[j].ID })
+	return snap
+}
+
+// Restore replaces the storage state with a copy of snap. Subscribers see
+// a single restored event.
+func (s *Storage) Restore(snap *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = make(map[int]*Message, len(snap.Messages))
+	for _, msg := range snap.Messages {
+		s.messages[msg.ID] = msg.clone(true)
+	}
+	s.nextID = snap.NextID
+	s.publish(Event{Type: EventRestored})
+	s.prune()
+}
+
+// snapshotName restricts names to ones that are safe as file names
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// snapshotStore keeps named snapshots in memory or, with a directory, as
+// JSON files that survive restarts
+type snapshotStore struct {
+	mu     sync.Mutex
+	dir    string
+	memory map[string]*Snapshot
+}
+
+// snapshotFile is the on-disk format, Message hides the raw bytes from JSON.
+// MessageCount precedes the messages so listing can stop reading there.
+type snapshotFile struct {
+	Name         string            `json:"name"`
+	CreatedAt    string            `json:"createdAt"`
+	NextID       int               `json:"nextId"`
+	MessageCount int               `json:"messageCount"`
+	Messages     []snapshotMessage `json:"messages"`
+}
+
+type snapshotMessage struct {
+	*Message
+	Raw []byte `json:"raw"`
+}
+
+// SetSnapshotDir keeps snapshots as files in dir instead of in memory,
+// call it before Start
+func (s *Server) SetSnapshotDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	s.snapshots.dir = dir
+	return nil
+}
+
+func (st *snapshotStore) path(name string) string {
+	return filepath.Join(st.dir, name+".json")
+}
+
+func (st *snapshotStore) save(snap *Snapshot) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.dir == "" {
+		if st.memory == nil {
+			st.memory = make(map[string]*Snapshot)
+		}
+		st.memory[snap.Name] = snap
+		return nil
+	}
+
+	file := snapshotFile{Name: snap.Name, CreatedAt: snap.CreatedAt, NextID: snap.NextID, MessageCount: len(snap.Messages)}
+	for _, msg := range snap.Messages {
+		file.Messages = append(file.Messages, snapshotMessage{Message: msg, Raw: msg.Raw})
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	// Write a temporary file first so a failed write keeps the old snapshot
+	tmp, err := os.CreateTemp(st.dir, "."+snap.Name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path(snap.Name))
+}
+
+func (st *snapshotStore) load(name string) (*Snapshot, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.dir == "" {
+		snap, ok := st.memory[name]
+		if !ok {
+			return nil, errSnapshotNotFound
+		}
+		return snap, nil
+	}
+
+	data, err := os.ReadFile(st.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	snap := &Snapshot{Name: file.Name, CreatedAt: file.CreatedAt, NextID: file.NextID}
+	for _, m := range file.Messages {
+		if m.Message == nil {
+			continue
+		}
+		m.Message.Raw = m.Raw
+		snap.Messages = append(snap.Messages, m.Message)
+	}
+	return snap, nil
+}
+
+// info describes the snapshot name without loading its messages
+func (st *snapshotStore) info(name string) (SnapshotInfo, error) {
+	st.mu.Lock()
+	if st.dir == "" {
+		defer st.mu.Unlock()
+		snap, ok := st.memory[name]
+		if !ok {
+			return SnapshotInfo{}, errSnapshotNotFound
+		}
+		return snap.info(), nil
+	}
+
+	info, ok, err := readInfo(st.path(name))
+	st.mu.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		return SnapshotInfo{}, errSnapshotNotFound
+	}
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	if !ok {
+		// Written before messageCount was stored
+		snap, err := st.load(name)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		return snap.info(), nil
+	}
+	return info, nil
+}
+
+// readInfo decodes the fields of a snapshot file up to the messages. It
+// reports false when the file has no message count before them.
+func readInfo(path string) (SnapshotInfo, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return SnapshotInfo{}, false, err
+	}
+	defer f.Close()
+
+	var info SnapshotInfo
+	dec := json.NewDecoder(f)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return info, false, errors.New("not a snapshot file")
+	}
+	counted := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return info, false, err
+		}
+		switch tok {
+		case "name":
+			err = dec.Decode(&info.Name)
+		case "createdAt":
+			err = dec.Decode(&info.CreatedAt)
+		case "messageCount":
+			err = dec.Decode(&info.Messages)
+			counted = true
+		case "messages":
+			return info, counted, nil
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return info, false, err
+		}
+	}
+	return info, counted, nil
+}
+
+func (st *snapshotStore) delete(name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.dir == "" {
+		if _, ok := st.memory[name]; !ok {
+			return errSnapshotNotFound
+		}
+		delete(st.memory, name)
+		return nil
+	}
+	err := os.Remove(st.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return errSnapshotNotFound
+	}
+	return err
+}
+
+// list returns the snapshots ordered by name
+func (st *snapshotStore) list() ([]SnapshotInfo, error) {
+	infos := []SnapshotInfo{}
+	if st.dir == "" {
+		st.mu.Lock()
+		for _, snap := range st.memory {
+			infos = append(infos, snap.info())
+		}
+		st.mu.Unlock()
+	} else {
+		files, err := filepath.Glob(filepath.Join(st.dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name := strings.TrimSuffix(filepath.Base(f), ".json")
+			if !snapshotName.MatchString(name) {
+				continue
+			}
+			info, err := st.info(name)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// handleSnapshots lists the snapshots
+func (s *Server) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if tenantScope(r) != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	infos, err := s.snapshots.list()
+	if err != nil {
+		http.Error(w, "Listing snapshots failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// handleSnapshot takes (POST), describes (GET) or deletes a named snapshot.
+// Taking a snapshot replaces one with the same name.
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := s.snapshotRequest(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.emailsMu.RLock()
+		snap := s.storage.Snapshot(name)
+		s.emailsMu.RUnlock()
+		if err := s.snapshots.save(snap); err != nil {
+			http.Error(w, "Saving snapshot failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("snapshot taken", "request", requestID(r.Context()), "name", name, "messages", len(snap.Messages))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(snap.info())
+	case http.MethodGet:
+		info, err := s.snapshots.info(name)
+		if !snapshotFound(w, err) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case http.MethodDelete:
+		if snapshotFound(w, s.snapshots.delete(name)) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// handleRestore replaces the stored messages with a snapshot
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := s.snapshotRequest(w, r)
+	if !ok {
+		return
+	}
+
+	snap, err := s.snapshots.load(name)
+	if !snapshotFound(w, err) {
+		return
+	}
+	s.emailsMu.Lock()
+	s.storage.Restore(snap)
+	s.emailsMu.Unlock()
+	slog.Info("snapshot restored", "request", requestID(r.Context()), "name", name, "messages", len(snap.Messages))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap.info())
+}
+
+// snapshotRequest checks that the caller is an admin and returns the
+// validated name path value
+func (s *Server) snapshotRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if tenantScope(r) != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	name := r.PathValue("name")
+	if !snapshotName.MatchString(name) {
+		http.Error(w, "Invalid snapshot name", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// snapshotFound writes the error response for err and reports whether
+// there was none
+func snapshotFound(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errSnapshotNotFound):
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Loading snapshot failed: "+err.Error(), http.StatusInternalServerError)
+	default:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func TestSnapshot_TakeAndRestore(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+	first := storage.Add(&httpapi.Message{From: "a@example.com", To: []string{"b@example.com"}, Raw: []byte("Subject: Seed\r\n\r\nHi\r\n")})
+	storage.SetRead(first, true)
+
+	rec := do(h, http.MethodPost, "/api/v1/admin/snapshots/seeded", "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var info httpapi.SnapshotInfo
+	json.NewDecoder(rec.Body).Decode(&info)
+	if info.Name != "seeded" || info.Messages != 1 {
+		t.Errorf("unexpected snapshot %+v", info)
+	}
+
+	// Diverge from the snapshot
+	storage.Delete(first)
+	storage.Add(&httpapi.Message{From: "c@example.com"})
+	storage.Add(&httpapi.Message{From: "d@example.com"})
+
+	events, cancel := storage.Subscribe()
+	defer cancel()
+	if rec := do(h, http.MethodPost, "/api/v1/admin/snapshots/seeded/restore", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if ev := <-events; ev.Type != httpapi.EventRestored {
+		t.Errorf("expected a restored event, got %+v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("expected a single event, got another %+v", ev)
+	default:
+	}
+
+	msgs := storage.List()
+	if len(msgs) != 1 || msgs[0].ID != first || !msgs[0].Read {
+		t.Fatalf("unexpected messages after restore %+v", msgs)
+	}
+	if msg, _ := storage.Get(first); string(msg.Raw) != "Subject: Seed\r\n\r\nHi\r\n" {
+		t.Errorf("raw not restored: %q", msg.Raw)
+	}
+	// The ID counter is restored too, so scenarios see the same IDs
+	if id := storage.Add(&httpapi.Message{}); id != first+1 {
+		t.Errorf("expected next ID %d, got %d", first+1, id)
+	}
+
+	// A restored snapshot can be restored again
+	if rec := do(h, http.MethodPost, "/api/v1/admin/snapshots/seeded/restore", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if n, _ := storage.Size(); n != 1 {
+		t.Errorf("expected 1 message after second restore, got %d", n)
+	}
+}
+
+func TestSnapshot_OnDisk(t *testing.T) {
+	dir := t.TempDir()
+	storage := httpapi.NewStorage()
+	srv := httpapi.New("", storage)
+	if err := srv.SetSnapshotDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	storage.Add(&httpapi.Message{From: "a@example.com", To: []string{"b@example.com"}, Tenant: "alpha", Raw: []byte("hello")})
+	if rec := do(srv.Handler(), http.MethodPost, "/api/v1/admin/snapshots/seeded", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// A new server, as after a restart, finds the snapshot in the directory
+	restarted := httpapi.NewStorage()
+	srv = httpapi.New("", restarted)
+	if err := srv.SetSnapshotDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	h := srv.Handler()
+
+	var infos []httpapi.SnapshotInfo
+	getJSON(t, h, "/api/v1/admin/snapshots", &infos)
+	if len(infos) != 1 || infos[0].Name != "seeded" || infos[0].Messages != 1 {
+		t.Fatalf("unexpected snapshots %+v", infos)
+	}
+	if rec := do(h, http.MethodPost, "/api/v1/admin/snapshots/seeded/restore", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	msg, ok := restarted.Get(1)
+	if !ok || msg.From != "a@example.com" || msg.Tenant != "alpha" || string(msg.Raw) != "hello" {
+		t.Errorf("unexpected restored message %+v", msg)
+	}
+
+	if rec := do(h, http.MethodDelete, "/api/v1/admin/snapshots/seeded", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+	if rec := do(h, http.MethodGet, "/api/v1/admin/snapshots/seeded", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestSnapshot_Errors(t *testing.T) {
+	_, h := tenantServer(t)
+
+	tests := []struct {
+		name, method, path, token string
+		want                      int
+	}{
+		{"tenant may not take", http.MethodPost, "/api/v1/admin/snapshots/seeded", "alpha-token", http.StatusForbidden},
+		{"tenant may not list", http.MethodGet, "/api/v1/admin/snapshots", "alpha-token", http.StatusForbidden},
+		{"invalid name", http.MethodPost, "/api/v1/admin/snapshots/..hidden", "admin-token", http.StatusBadRequest},
+		{"unknown snapshot", http.MethodPost, "/api/v1/admin/snapshots/missing/restore", "admin-token", http.StatusNotFound},
+		{"method", http.MethodPut, "/api/v1/admin/snapshots/seeded", "admin-token", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(h, tt.method, tt.path, tt.token); rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestSnapshot_ListReadsOnlyTheHeader(t *testing.T) {
+	dir := t.TempDir()
+	srv := httpapi.New("", httpapi.NewStorage())
+	if err := srv.SetSnapshotDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	// The messages are never decoded, so a broken list still shows the count
+	files := map[string]string{
+		"large.json":  `{"name":"large","createdAt":"2026-01-02T03:04:05Z","nextId":3,"messageCount":2,"messages":[not decoded`,
+		"legacy.json": `{"name":"legacy","createdAt":"2026-01-02T03:04:05Z","nextId":2,"messages":[{"id":1,"raw":"aGk="}]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var infos []httpapi.SnapshotInfo
+	getJSON(t, srv.Handler(), "/api/v1/admin/snapshots", &infos)
+	if len(infos) != 2 || infos[0].Name != "large" || infos[0].Messages != 2 || infos[1].Name != "legacy" || infos[1].Messages != 1 {
+		t.Errorf("unexpected snapshots %+v", infos)
+	}
+}
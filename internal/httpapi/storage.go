@@ -1,8 +1,14 @@
 package httpapi
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"sync"
 	"time"
+
+	_ "github.com/emersion/go-message/charset" // decode non-UTF-8 subjects
+	"github.com/emersion/go-message/mail"
 )
 
 // Message represents an email message
@@ -14,31 +20,87 @@ type Message struct {
 	Body      string   `json:"body"`
 	CreatedAt string   `json:"createdAt"`
 	Raw       []byte   `json:"-"` // RFC822 raw bytes, not exposed in JSON
+	Read      bool     `json:"read"`
+	Starred   bool     `json:"starred"`
+	Tags      []string `json:"tags"`              // sorted, free-form labels
+	Deleted   bool     `json:"deleted,omitempty"` // marked for deletion by an IMAP client
+	Tenant    string   `json:"tenant,omitempty"`
+	SessionID string   `json:"sessionId,omitempty"` // SMTP session or HTTP request that delivered the message
+
+	Relay *RelayStatus `json:"relay,omitempty"` // set when a relay rule matched
+}
+
+// NewMessage builds a message from its envelope and RFC 822 source, the
+// same way for SMTP, LMTP and HTTP deliveries
+func NewMessage(from string, to []string, raw []byte) *Message {
+	msg := &Message{
+		From: from,
+		To:   to,
+		Body: string(raw),
+		Raw:  raw,
+	}
+	if r, err := mail.CreateReader(bytes.NewReader(raw)); err == nil {
+		msg.Subject, _ = r.Header.Subject()
+	}
+	return msg
+}
+
+// RelayStatus describes the upstream delivery state of a relayed message
+type RelayStatus struct {
+	State      string   `json:"state"` // queued, sent or failed
+	Rule       string   `json:"rule,omitempty"`
+	Recipients []string `json:"recipients"`
+	Attempts   int      `json:"attempts"`
+	LastError  string   `json:"lastError,omitempty"`
+	UpdatedAt  string   `json:"updatedAt"`
 }
 
+// Relay states
+const (
+	RelayQueued = "queued"
+	RelaySent   = "sent"
+	RelayFailed = "failed"
+)
+
 // Storage manages email messages with thread-safe operations
 type Storage struct {
 	mu       sync.RWMutex
 	messages map[int]*Message
 	nextID   int
+
+	maxMessages int           // 0 for no limit
+	maxAge      time.Duration // 0 for no limit
+	tagRules    []TagRule
+
+	subMu       sync.Mutex
+	subscribers map[chan Event]struct{}
 }
 
 func NewStorage() *Storage {
 	return &Storage{
-		messages: make(map[int]*Message),
-		nextID:   1,
+		messages:    make(map[int]*Message),
+		nextID:      1,
+		subscribers: make(map[chan Event]struct{}),
 	}
 }
 
-// Add stores a new message and returns its ID
+// Add stores a new message and returns its ID. Tag rules add their tags,
+// CreatedAt is set to the current time unless it is already set, e.g. by
+// an import.
 func (s *Storage) Add(msg *Message) int {
+	s.applyTagRules(msg)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	msg.ID = s.nextID
-	msg.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	if msg.CreatedAt == "" {
+		msg.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
 	s.messages[msg.ID] = msg
 	s.nextID++
+	s.publish(Event{Type: EventAdded, ID: msg.ID, Tenant: msg.Tenant})
+	s.prune()
 	return msg.ID
 }
 
@@ -50,18 +112,38 @@ func (s *Storage) List() []Message {
 	result := make([]Message, 0, len(s.messages))
 	for _, msg := range s.messages {
 		// Copy message without raw bytes
-		result = append(result, Message{
-			ID:        msg.ID,
-			From:      msg.From,
-			To:        append([]string(nil), msg.To...),
-			Subject:   msg.Subject,
-			Body:      msg.Body,
-			CreatedAt: msg.CreatedAt,
-		})
+		result = append(result, *msg.clone(false))
 	}
 	return result
 }
 
+// Size returns the number of stored messages and their raw size in bytes
+func (s *Storage) Size() (messages int, bytes int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, msg := range s.messages {
+		bytes += int64(len(msg.Raw))
+	}
+	return len(s.messages), bytes
+}
+
+// Ready reports whether messages can be written, failing when the write
+// lock is not available before ctx ends
+func (s *Storage) Ready(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !s.mu.TryLock() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("storage is not writable: %w", ctx.Err())
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
 // Get retrieves a message by ID
 func (s *Storage) Get(id int) (*Message, bool) {
 	s.mu.RLock()
@@ -73,16 +155,76 @@ func (s *Storage) Get(id int) (*Message, bool) {
 	}
 
 	// Return a copy
-	msgCopy := &Message{
-		ID:        msg.ID,
-		From:      msg.From,
-		To:        append([]string(nil), msg.To...),
-		Subject:   msg.Subject,
-		Body:      msg.Body,
-		CreatedAt: msg.CreatedAt,
-		Raw:       append([]byte(nil), msg.Raw...),
+	return msg.clone(true), true
+}
+
+// SetRelayStatus replaces the relay status of a stored message
+func (s *Storage) SetRelayStatus(id int, status RelayStatus) bool {
+	status.Recipients = append([]string(nil), status.Recipients...)
+	return s.update(id, func(msg *Message) { msg.Relay = &status })
+}
+
+// SetRead marks a message as read or unread
+func (s *Storage) SetRead(id int, read bool) bool {
+	return s.update(id, func(msg *Message) { msg.Read = read })
+}
+
+// SetStarred stars or unstars a message
+func (s *Storage) SetStarred(id int, starred bool) bool {
+	return s.update(id, func(msg *Message) { msg.Starred = starred })
+}
+
+// SetDeleted sets or clears the deletion mark of a message
+func (s *Storage) SetDeleted(id int, deleted bool) bool {
+	return s.update(id, func(msg *Message) { msg.Deleted = deleted })
+}
+
+// SetFlags sets the read, starred and deleted flags of a message in one
+// update
+func (s *Storage) SetFlags(id int, read, starred, deleted bool) bool {
+	return s.update(id, func(msg *Message) {
+		msg.Read, msg.Starred, msg.Deleted = read, starred, deleted
+	})
+}
+
+func (s *Storage) update(id int, fn func(*Message)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.messages[id]
+	if !exists {
+		return false
+	}
+	fn(msg)
+	s.publish(Event{Type: EventUpdated, ID: id, Tenant: msg.Tenant})
+	return true
+}
+
+// Delete removes a message by ID and reports whether it existed
+func (s *Storage) Delete(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.messages[id]
+	if !exists {
+		return false
+	}
+	delete(s.messages, id)
+	s.publish(Event{Type: EventDeleted, ID: id, Tenant: msg.Tenant})
+	return true
+}
+
+// ClearTenant removes the messages of one tenant, IDs are not reset
+func (s *Storage) ClearTenant(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, msg := range s.messages {
+		if msg.Tenant == tenant {
+			delete(s.messages, id)
+			s.publish(Event{Type: EventDeleted, ID: id, Tenant: tenant})
+		}
 	}
-	return msgCopy, true
 }
 
 // Clear removes all messages
@@ -92,4 +234,32 @@ func (s *Storage) Clear() {
 
 	s.messages = make(map[int]*Message)
 	s.nextID = 1
+	s.publish(Event{Type: EventCleared})
+}
+
+// clone returns a deep copy of the message, optionally including raw bytes
+func (m *Message) clone(withRaw bool) *Message {
+	c := &Message{
+		ID:        m.ID,
+		From:      m.From,
+		To:        append([]string(nil), m.To...),
+		Subject:   m.Subject,
+		Body:      m.Body,
+		CreatedAt: m.CreatedAt,
+		Read:      m.Read,
+		Starred:   m.Starred,
+		Tags:      append([]string{}, m.Tags...),
+		Deleted:   m.Deleted,
+		Tenant:    m.Tenant,
+		SessionID: m.SessionID,
+	}
+	if withRaw {
+		c.Raw = append([]byte(nil), m.Raw...)
+	}
+	if m.Relay != nil {
+		relay := *m.Relay
+		relay.Recipients = append([]string(nil), m.Relay.Recipients...)
+		c.Relay = &relay
+	}
+	return c
 }
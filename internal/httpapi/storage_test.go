@@ -262,6 +262,135 @@ func TestStorage_Clear(t *testing.T) {
 	}
 }
 
+func TestStorage_Delete(t *testing.T) {
+	s := httpapi.NewStorage()
+
+	id := s.Add(&httpapi.Message{From: "sender@example.com", To: []string{"recipient@example.com"}})
+	other := s.Add(&httpapi.Message{From: "sender@example.com", To: []string{"recipient@example.com"}})
+
+	if !s.Delete(id) {
+		t.Fatal("expected Delete to succeed")
+	}
+	if _, exists := s.Get(id); exists {
+		t.Error("expected deleted message to be gone")
+	}
+	if _, exists := s.Get(other); !exists {
+		t.Error("expected other message to remain")
+	}
+	if s.Delete(id) {
+		t.Error("expected second Delete to fail")
+	}
+}
+
+func TestStorage_SetRelayStatus(t *testing.T) {
+	s := httpapi.NewStorage()
+
+	id := s.Add(&httpapi.Message{From: "sender@example.com", To: []string{"recipient@example.com"}})
+
+	ok := s.SetRelayStatus(id, httpapi.RelayStatus{State: httpapi.RelaySent, Recipients: []string{"recipient@example.com"}, Attempts: 1})
+	if !ok {
+		t.Fatal("expected SetRelayStatus to succeed")
+	}
+
+	msg, _ := s.Get(id)
+	if msg.Relay == nil || msg.Relay.State != httpapi.RelaySent {
+		t.Fatalf("expected relay state %q, got %+v", httpapi.RelaySent, msg.Relay)
+	}
+
+	// Returned status must be a copy
+	msg.Relay.Recipients[0] = "modified@example.com"
+	again, _ := s.Get(id)
+	if again.Relay.Recipients[0] != "recipient@example.com" {
+		t.Error("relay status was modified through returned copy")
+	}
+
+	if s.SetRelayStatus(999, httpapi.RelayStatus{}) {
+		t.Error("expected SetRelayStatus to fail for non-existent message")
+	}
+}
+
+func TestStorage_SetReadAndDeleted(t *testing.T) {
+	s := httpapi.NewStorage()
+
+	id := s.Add(&httpapi.Message{From: "sender@example.com", To: []string{"recipient@example.com"}})
+
+	if !s.SetRead(id, true) || !s.SetDeleted(id, true) {
+		t.Fatal("expected flag updates to succeed")
+	}
+	msg, _ := s.Get(id)
+	if !msg.Read || !msg.Deleted {
+		t.Errorf("expected read and deleted, got read=%v deleted=%v", msg.Read, msg.Deleted)
+	}
+
+	s.SetRead(id, false)
+	if list := s.List(); list[0].Read {
+		t.Error("expected message to be unread in List()")
+	}
+
+	if s.SetRead(999, true) {
+		t.Error("expected SetRead to fail for non-existent message")
+	}
+}
+
+func TestStorage_SetFlags(t *testing.T) {
+	s := httpapi.NewStorage()
+	id := s.Add(&httpapi.Message{From: "sender@example.com"})
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	if !s.SetFlags(id, true, true, false) {
+		t.Fatal("expected SetFlags to succeed")
+	}
+	msg, _ := s.Get(id)
+	if !msg.Read || !msg.Starred || msg.Deleted {
+		t.Errorf("expected read and starred, got read=%v starred=%v deleted=%v", msg.Read, msg.Starred, msg.Deleted)
+	}
+
+	<-events
+	select {
+	case ev := <-events:
+		t.Errorf("expected a single update event, got another %+v", ev)
+	default:
+	}
+
+	if s.SetFlags(999, true, false, false) {
+		t.Error("expected SetFlags to fail for non-existent message")
+	}
+}
+
+func TestStorage_Subscribe(t *testing.T) {
+	s := httpapi.NewStorage()
+	events, cancel := s.Subscribe()
+
+	id := s.Add(&httpapi.Message{From: "sender@example.com"})
+	s.SetRead(id, true)
+	s.Delete(id)
+	s.Clear()
+
+	want := []httpapi.Event{
+		{Type: httpapi.EventAdded, ID: id},
+		{Type: httpapi.EventUpdated, ID: id},
+		{Type: httpapi.EventDeleted, ID: id},
+		{Type: httpapi.EventCleared},
+	}
+	for _, w := range want {
+		select {
+		case got := <-events:
+			if got != w {
+				t.Errorf("expected event %+v, got %+v", w, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", w)
+		}
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("expected channel to be closed after cancel")
+	}
+	cancel() // must be safe to call twice
+}
+
 // Concurrency Tests
 
 func TestStorage_ConcurrentAdd(t *testing.T) {
@@ -686,3 +815,27 @@ func BenchmarkStorage_ConcurrentRead(b *testing.B) {
 		}
 	})
 }
+
+func TestStorage_Retention(t *testing.T) {
+	s := httpapi.NewStorage()
+	for i := 0; i < 3; i++ {
+		s.Add(&httpapi.Message{Subject: "old"})
+	}
+	s.SetRetention(2, 0)
+	if _, exists := s.Get(1); exists {
+		t.Error("expected the oldest message to be pruned")
+	}
+
+	id := s.Add(&httpapi.Message{Subject: "new"})
+	if n := len(s.List()); n != 2 {
+		t.Errorf("expected 2 messages, got %d", n)
+	}
+	if _, exists := s.Get(id); !exists {
+		t.Error("expected the newest message to be kept")
+	}
+
+	s.SetRetention(0, time.Nanosecond)
+	if n := len(s.List()); n != 0 {
+		t.Errorf("expected expired messages to be pruned, got %d", n)
+	}
+}
@@ -0,0 +1,237 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// TagRule adds tags to messages matching every condition that is set. Tags
+// may contain ${name} placeholders filled from named groups (?P<name>...)
+// of the rule's patterns.
+type TagRule struct {
+	Name          string            `json:"name,omitempty"`
+	Tags          []string          `json:"tags"`
+	Headers       map[string]string `json:"headers,omitempty"`   // header name to pattern, any value matches
+	Recipient     string            `json:"recipient,omitempty"` // pattern, any envelope recipient matches
+	Sender        string            `json:"sender,omitempty"`    // pattern on the envelope sender
+	Subject       string            `json:"subject,omitempty"`   // pattern on the decoded subject
+	MinSize       int               `json:"minSize,omitempty"`   // bytes
+	MaxSize       int               `json:"maxSize,omitempty"`   // bytes, 0 for no limit
+	HasAttachment *bool             `json:"hasAttachment,omitempty"`
+
+	headers                    map[string]*regexp.Regexp
+	recipient, sender, subject *regexp.Regexp
+}
+
+// tagPlaceholder matches ${name} in rule tags
+var tagPlaceholder = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// LoadTagRules reads a JSON array of rules from path
+func LoadTagRules(path string) ([]TagRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []TagRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if rules, err = compileTagRules(rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// compileTagRules returns validated copies of rules with their patterns
+// compiled
+func compileTagRules(rules []TagRule) ([]TagRule, error) {
+	rules = slices.Clone(rules)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			if rules[i].Name != "" {
+				return nil, fmt.Errorf("tag rule %q: %w", rules[i].Name, err)
+			}
+			return nil, fmt.Errorf("tag rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile validates the rule and compiles its patterns
+func (r *TagRule) compile() error {
+	if len(r.Tags) == 0 {
+		return errors.New("no tags")
+	}
+	for _, tag := range r.Tags {
+		if strings.TrimSpace(tag) == "" || len(tag) > maxTagLength {
+			return fmt.Errorf("invalid tag %q, expected 1 to %d characters", tag, maxTagLength)
+		}
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MaxSize < r.MinSize) {
+		return errors.New("invalid size range")
+	}
+
+	var err error
+	compile := func(field, pattern string) *regexp.Regexp {
+		if pattern == "" || err != nil {
+			return nil
+		}
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(pattern); err != nil {
+			err = fmt.Errorf("%s: %w", field, err)
+		}
+		return re
+	}
+	r.headers = make(map[string]*regexp.Regexp, len(r.Headers))
+	for name, pattern := range r.Headers {
+		if pattern == "" {
+			return fmt.Errorf("header %s: empty pattern", name)
+		}
+		r.headers[name] = compile("header "+name, pattern)
+	}
+	r.recipient = compile("recipient", r.Recipient)
+	r.sender = compile("sender", r.Sender)
+	r.subject = compile("subject", r.Subject)
+	return err
+}
+
+// match returns the tags r adds to msg, nil when it does not match
+func (r *TagRule) match(msg *Message, parsed func() *parsedMessage) []string {
+	size := len(msg.Raw)
+	if size < r.MinSize || (r.MaxSize > 0 && size > r.MaxSize) {
+		return nil
+	}
+
+	groups := map[string]string{}
+	matchAny := func(re *regexp.Regexp, values ...string) bool {
+		if re == nil {
+			return true
+		}
+		for _, v := range values {
+			if m := re.FindStringSubmatch(v); m != nil {
+				for i, name := range re.SubexpNames() {
+					if name != "" {
+						groups[name] = m[i]
+					}
+				}
+				return true
+			}
+		}
+		return false
+	}
+	if !matchAny(r.sender, msg.From) || !matchAny(r.recipient, msg.To...) || !matchAny(r.subject, msg.Subject) {
+		return nil
+	}
+	for name, re := range r.headers {
+		fields := parsed().Header.FieldsByKey(name)
+		var values []string
+		for fields.Next() {
+			if v, err := fields.Text(); err == nil {
+				values = append(values, v)
+			} else {
+				values = append(values, fields.Value())
+			}
+		}
+		if !matchAny(re, values...) {
+			return nil
+		}
+	}
+	if r.HasAttachment != nil && (len(parsed().Attachments) > 0) != *r.HasAttachment {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range r.Tags {
+		tag = tagPlaceholder.ReplaceAllStringFunc(tag, func(p string) string {
+			return groups[tagPlaceholder.FindStringSubmatch(p)[1]]
+		})
+		if tag = strings.TrimSpace(tag); tag != "" && len(tag) <= maxTagLength {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// SetTagRules validates rules and applies them to messages added from now
+// on. Invalid rules change nothing.
+func (s *Storage) SetTagRules(rules []TagRule) error {
+	rules, err := compileTagRules(rules)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tagRules = rules
+	return nil
+}
+
+// TagRules returns the configured rules
+func (s *Storage) TagRules() []TagRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.tagRules)
+}
+
+// applyTagRules tags a message before it is stored. It is called without
+// mu held because matching may parse the message, which is done at most
+// once and only when a rule looks at headers or attachments.
+func (s *Storage) applyTagRules(msg *Message) {
+	s.mu.RLock()
+	rules := s.tagRules // replaced, never modified, by SetTagRules
+	s.mu.RUnlock()
+	if len(rules) == 0 {
+		return
+	}
+	var p *parsedMessage
+	parsed := func() *parsedMessage {
+		if p == nil {
+			p = parseMessage(msg)
+		}
+		return p
+	}
+	tags := msg.Tags
+	for i := range rules {
+		tags = append(tags, rules[i].match(msg, parsed)...)
+	}
+	msg.Tags = normalizeTags(tags)
+}
+
+// handleTagRules returns (GET) or replaces (PUT) the tagging rules
+func (s *Server) handleTagRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if tenantScope(r) != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var rules []TagRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "Invalid tag rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.storage.SetTagRules(rules); err != nil {
+			http.Error(w, "Invalid tag rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("tag rules updated", "request", requestID(r.Context()), "count", len(rules))
+	}
+
+	rules := s.storage.TagRules()
+	if rules == nil {
+		rules = []TagRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
@@ -0,0 +1,105 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func put(h http.Handler, path, token, body string) int {
+	req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestTagRules_Apply(t *testing.T) {
+	storage := httpapi.NewStorage()
+	yes := true
+	err := storage.SetTagRules([]httpapi.TagRule{
+		{Name: "service", Headers: map[string]string{"X-Service": `^(?P<service>[\w-]+)$`}, Tags: []string{"service:${service}"}},
+		{Recipient: `@(?P<domain>qa\.example\.com)$`, Tags: []string{"qa", "to:${domain}"}},
+		{Sender: `^billing@`, Subject: `(?i)invoice`, Tags: []string{"invoice"}},
+		{MinSize: 150, Tags: []string{"large"}},
+		{HasAttachment: &yes, Tags: []string{"attachment"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	multipart := "X-Service: orders\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nHi\r\n" +
+		"--b\r\nContent-Type: text/csv\r\nContent-Disposition: attachment; filename=\"a.csv\"\r\n\r\na,b\r\n--b--\r\n"
+	tests := []struct {
+		name string
+		msg  *httpapi.Message
+		want string
+	}{
+		{"header", &httpapi.Message{Raw: []byte("X-Service: payments\r\n\r\nHi\r\n")}, "service:payments"},
+		{"recipient", &httpapi.Message{To: []string{"a@example.com", "b@qa.example.com"}, Raw: []byte("\r\n")}, "qa,to:qa.example.com"},
+		{"sender and subject", &httpapi.Message{From: "billing@example.com", Subject: "Your Invoice", Raw: []byte("\r\n")}, "invoice"},
+		{"sender only", &httpapi.Message{From: "billing@example.com", Subject: "Hello", Raw: []byte("\r\n")}, ""},
+		{"attachment and size", &httpapi.Message{Raw: []byte(multipart)}, "attachment,large,service:orders"},
+		{"existing tags kept", &httpapi.Message{Tags: []string{"seed"}, Raw: []byte("X-Service: payments\r\n\r\n")}, "seed,service:payments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := storage.Get(storage.Add(tt.msg))
+			if got := strings.Join(msg.Tags, ","); got != tt.want {
+				t.Errorf("expected tags %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTagRules_API(t *testing.T) {
+	storage, h := tenantServer(t)
+
+	rules := `[{"name":"service","headers":{"X-Service":"(?P<service>.+)"},"tags":["service:${service}"]}]`
+	if code := put(h, "/api/v1/admin/tag-rules", "alpha-token", rules); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a tenant, got %d", code)
+	}
+	if code := put(h, "/api/v1/admin/tag-rules", "admin-token", rules); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	for _, body := range []string{`[{"tags":["x"],"subject":"("}]`, `[{"subject":"x"}]`, `[{"tags":["x"],"minSize":10,"maxSize":5}]`, `{}`} {
+		if code := put(h, "/api/v1/admin/tag-rules", "admin-token", body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, code)
+		}
+	}
+
+	// Invalid rules leave the previous ones in place
+	var got []httpapi.TagRule
+	json.NewDecoder(do(h, http.MethodGet, "/api/v1/admin/tag-rules", "admin-token").Body).Decode(&got)
+	if len(got) != 1 || got[0].Name != "service" {
+		t.Fatalf("unexpected rules %+v", got)
+	}
+
+	msg, _ := storage.Get(storage.Add(&httpapi.Message{Raw: []byte("X-Service: search\r\n\r\n")}))
+	if strings.Join(msg.Tags, ",") != "service:search" {
+		t.Errorf("unexpected tags %v", msg.Tags)
+	}
+}
+
+func TestLoadTagRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`[{"name":"qa","recipient":"@qa\\.","tags":["qa"]}]`), 0o600)
+	rules, err := httpapi.LoadTagRules(path)
+	if err != nil || len(rules) != 1 || rules[0].Recipient != `@qa\.` {
+		t.Fatalf("unexpected rules %+v: %v", rules, err)
+	}
+
+	os.WriteFile(path, []byte(`{`), 0o600)
+	if _, err := httpapi.LoadTagRules(path); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
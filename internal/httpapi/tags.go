@@ -0,0 +1,154 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// maxTagLength limits a single tag, in bytes
+const maxTagLength = 100
+
+// Patch changes the mutable state of a message, nil fields are kept
+type Patch struct {
+	Read       *bool    `json:"read"`
+	Starred    *bool    `json:"starred"`
+	Tags       []string `json:"tags"` // replaces all tags when set, [] removes them
+	AddTags    []string `json:"addTags"`
+	RemoveTags []string `json:"removeTags"`
+}
+
+// validate normalizes the tags of p and reports an empty patch
+func (p *Patch) validate() error {
+	for _, tags := range [][]string{p.Tags, p.AddTags, p.RemoveTags} {
+		for i, tag := range tags {
+			tag = strings.TrimSpace(tag)
+			if tag == "" || len(tag) > maxTagLength {
+				return fmt.Errorf("invalid tag %q, expected 1 to %d characters", tags[i], maxTagLength)
+			}
+			tags[i] = tag
+		}
+	}
+	if p.Read == nil && p.Starred == nil && p.Tags == nil && len(p.AddTags) == 0 && len(p.RemoveTags) == 0 {
+		return errors.New("nothing to update, set read, starred, tags, addTags or removeTags")
+	}
+	return nil
+}
+
+// apply changes msg, tags are replaced first, then added and removed.
+// Removal ignores case like the tag filter does.
+func (p *Patch) apply(msg *Message) {
+	if p.Read != nil {
+		msg.Read = *p.Read
+	}
+	if p.Starred != nil {
+		msg.Starred = *p.Starred
+	}
+	tags := msg.Tags
+	if p.Tags != nil {
+		tags = p.Tags
+	}
+	tags = append(slices.Clone(tags), p.AddTags...)
+	tags = slices.DeleteFunc(tags, func(tag string) bool {
+		return slices.ContainsFunc(p.RemoveTags, func(remove string) bool { return strings.EqualFold(tag, remove) })
+	})
+	msg.Tags = normalizeTags(tags)
+}
+
+// normalizeTags sorts tags and removes duplicates in place
+func normalizeTags(tags []string) []string {
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// Patch applies p to a message and reports whether it exists
+func (s *Storage) Patch(id int, p Patch) bool {
+	return s.update(id, p.apply)
+}
+
+// handlePatchEmail changes the read, starred and tag state of a message
+// and returns it
+func (s *Server) handlePatchEmail(w http.ResponseWriter, r *http.Request) {
+	var id int
+	if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var p Patch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validate(); err != nil {
+		http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+
+	msg, exists := s.storage.Get(id)
+	if !exists || !visible(tenantScope(r), msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	s.storage.Patch(id, p)
+	msg, _ = s.storage.Get(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// bulkPatch is the body of PATCH /api/v1/messages
+type bulkPatch struct {
+	IDs []int `json:"ids"` // messages to change, all matching the query filter when empty
+	All bool  `json:"all"` // required to change every message without ids or a filter
+	Patch
+}
+
+// handleBulkPatch applies a patch to the listed messages or to those
+// matching the query filter. Without either the body must set all, so a
+// forgotten selector does not change every message.
+func (s *Server) handleBulkPatch(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req bulkPatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 && !filter.selective() && !req.All {
+		http.Error(w, "Invalid patch: select messages with ids, a query filter or \"all\": true", http.StatusBadRequest)
+		return
+	}
+
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+
+	scope := tenantScope(r)
+	ids := req.IDs
+	if len(ids) == 0 {
+		for _, msg := range s.find(scope, filter) {
+			ids = append(ids, msg.ID)
+		}
+	}
+	updated := 0
+	for _, id := range ids {
+		if msg, ok := s.storage.Get(id); ok && visible(scope, msg) && s.storage.Patch(id, req.Patch) {
+			updated++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"updated": updated})
+}
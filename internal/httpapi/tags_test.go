@@ -0,0 +1,147 @@
+package httpapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+func patch(h http.Handler, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPatch_Message(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+	id := storage.Add(&httpapi.Message{From: "a@example.com", To: []string{"b@example.com"}})
+
+	rec := patch(h, "/api/v1/messages/1", "", `{"read":true,"starred":true,"addTags":["TC-42"," reviewed ","TC-42"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var msg httpapi.Message
+	json.NewDecoder(rec.Body).Decode(&msg)
+	if !msg.Read || !msg.Starred || strings.Join(msg.Tags, ",") != "TC-42,reviewed" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	// Fields left out are kept, removals apply after additions
+	rec = patch(h, "/api/v1/messages/1", "", `{"read":false,"addTags":["flaky"],"removeTags":["TC-42"]}`)
+	json.NewDecoder(rec.Body).Decode(&msg)
+	if msg.Read || !msg.Starred || strings.Join(msg.Tags, ",") != "flaky,reviewed" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	// Removal ignores case like the tag filter
+	rec = patch(h, "/api/v1/messages/1", "", `{"removeTags":["FLAKY"]}`)
+	json.NewDecoder(rec.Body).Decode(&msg)
+	if strings.Join(msg.Tags, ",") != "reviewed" {
+		t.Errorf("expected flaky to be removed, got %v", msg.Tags)
+	}
+
+	// tags replaces the whole set
+	patch(h, "/api/v1/messages/1", "", `{"tags":[]}`)
+	if stored, _ := storage.Get(id); len(stored.Tags) != 0 {
+		t.Errorf("expected tags to be cleared, got %v", stored.Tags)
+	}
+
+	for _, body := range []string{`{}`, `{"addTags":[""]}`, `{"addTags":["` + strings.Repeat("x", 101) + `"]}`, `{"read":"yes"}`} {
+		if rec := patch(h, "/api/v1/messages/1", "", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+	if rec := patch(h, "/api/v1/messages/9", "", `{"read":true}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestPatch_Bulk(t *testing.T) {
+	storage := httpapi.NewStorage()
+	h := httpapi.New("", storage).Handler()
+	for _, to := range []string{"alice@example.com", "bob@example.com", "alice@example.org"} {
+		storage.Add(&httpapi.Message{From: "shop@example.com", To: []string{to}})
+	}
+
+	var result struct{ Updated int }
+	rec := patch(h, "/api/v1/messages", "", `{"ids":[1,3,99],"addTags":["TC-7"]}`)
+	json.NewDecoder(rec.Body).Decode(&result)
+	if rec.Code != http.StatusOK || result.Updated != 2 {
+		t.Fatalf("expected 2 updated, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// Without IDs the query filter selects the messages
+	rec = patch(h, "/api/v1/messages?to=bob@", "", `{"starred":true}`)
+	json.NewDecoder(rec.Body).Decode(&result)
+	if result.Updated != 1 {
+		t.Errorf("expected 1 updated, got %d", result.Updated)
+	}
+
+	// Every message needs all, a missing selector is an error
+	for _, path := range []string{"/api/v1/messages", "/api/v1/messages?limit=1"} {
+		if rec := patch(h, path, "", `{"addTags":["all"]}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 without a selector, got %d", path, rec.Code)
+		}
+	}
+	rec = patch(h, "/api/v1/messages", "", `{"all":true,"addTags":["all"]}`)
+	json.NewDecoder(rec.Body).Decode(&result)
+	if result.Updated != 3 {
+		t.Errorf("expected all 3 updated, got %d: %s", result.Updated, rec.Body)
+	}
+	patch(h, "/api/v1/messages", "", `{"all":true,"removeTags":["all"]}`)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"tag=tc-7", "1,3"},
+		{"tag=TC-7&to=alice@example.org", "3"},
+		{"starred=true", "2"},
+		{"starred=false&tag=TC-7", "1,3"},
+		{"read=false", "1,2,3"},
+		{"tag=TC-7&tag=other", ""},
+	}
+	for _, tt := range tests {
+		var msgs []httpapi.Message
+		getJSON(t, h, "/api/v1/messages?"+tt.query, &msgs)
+		var ids []string
+		for _, m := range msgs {
+			ids = append(ids, strconv.Itoa(m.ID))
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+
+	if rec := do(h, http.MethodGet, "/api/v1/messages?read=maybe", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid read filter, got %d", rec.Code)
+	}
+}
+
+func TestPatch_TenantScope(t *testing.T) {
+	storage, h := tenantServer(t)
+
+	if rec := patch(h, "/api/v1/messages/2", "alpha-token", `{"starred":true}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another tenant's message, got %d", rec.Code)
+	}
+	rec := patch(h, "/api/v1/messages", "alpha-token", `{"ids":[1,2,3],"addTags":["seen"]}`)
+	var result struct{ Updated int }
+	json.NewDecoder(rec.Body).Decode(&result)
+	if result.Updated != 1 {
+		t.Errorf("expected only alpha's message updated, got %d", result.Updated)
+	}
+	if msg, _ := storage.Get(2); len(msg.Tags) != 0 {
+		t.Errorf("beta's message was tagged: %v", msg.Tags)
+	}
+}
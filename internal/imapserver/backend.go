@@ -0,0 +1,298 @@
+package imapserver
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+const inboxName = "INBOX"
+
+var errReadOnly = errors.New("mailbox hierarchy is read-only")
+
+// Backend exposes Storage as IMAP mailboxes, one INBOX per recipient
+// address or one shared INBOX.
+type Backend struct {
+	storage *httpapi.Storage
+	shared  bool
+	users   map[string]string
+	tenants *tenant.Registry
+
+	// uidValidity changes whenever storage is cleared, because message
+	// IDs and therefore UIDs are reused afterwards.
+	uidValidity atomic.Uint32
+
+	// New mail is announced to sessions through their own channels rather
+	// than backend.BackendUpdater, whose dispatcher reads connection state
+	// without synchronization.
+	mu       sync.Mutex
+	conns    map[string]*connChans // by remote address, until login
+	sessions map[*user]bool        // logged in sessions with a selected mailbox
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// connChans are the parts of a connection's context that are set when it
+// is created and safe to use from other goroutines
+type connChans struct {
+	responses chan<- imap.WriterTo
+	loggedOut <-chan struct{}
+}
+
+// NewBackend creates a backend over storage. Users maps user names to
+// passwords, when empty any credentials are accepted.
+func NewBackend(storage *httpapi.Storage, shared bool, users map[string]string) *Backend {
+	be := &Backend{
+		storage:  storage,
+		shared:   shared,
+		users:    users,
+		conns:    make(map[string]*connChans),
+		sessions: make(map[*user]bool),
+		stop:     make(chan struct{}),
+	}
+	be.uidValidity.Store(uint32(time.Now().Unix()))
+
+	events, cancel := storage.Subscribe()
+	go be.watch(events, cancel)
+	return be
+}
+
+// SetTenants requires a tenant or admin API token as the password and
+// limits tenant tokens to their tenant's messages. Users is ignored while
+// tenants are enabled.
+func (be *Backend) SetTenants(r *tenant.Registry) {
+	be.tenants = r
+}
+
+// Login implements backend.Backend
+func (be *Backend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	var tenantName string
+	if be.tenants.Enabled() {
+		name, _, ok := be.tenants.Authenticate(password)
+		if !ok {
+			return nil, backend.ErrInvalidCredentials
+		}
+		tenantName = name
+	} else if len(be.users) > 0 {
+		if want, ok := be.users[username]; !ok || want != password {
+			return nil, backend.ErrInvalidCredentials
+		}
+	}
+	u := &user{be: be, name: strings.ToLower(username), tenant: tenantName, updates: make(chan uint32, 16)}
+	if info != nil && info.RemoteAddr != nil {
+		be.mu.Lock()
+		u.conn = be.conns[info.RemoteAddr.String()]
+		be.mu.Unlock()
+	}
+	return u, nil
+}
+
+// Close stops watching storage for new messages
+func (be *Backend) Close() {
+	be.once.Do(func() { close(be.stop) })
+}
+
+// Capabilities implements server.Extension, the backend adds none
+func (be *Backend) Capabilities(server.Conn) []string { return nil }
+
+// Command implements server.Extension, the backend adds none
+func (be *Backend) Command(string) server.HandlerFactory { return nil }
+
+// NewConn implements server.ConnExtension. It keeps the connection's
+// response channel so that Login can hand it to the session.
+func (be *Backend) NewConn(c server.Conn) server.Conn {
+	ctx := c.Context()
+	if addr := c.Info().RemoteAddr; addr != nil {
+		key := addr.String()
+		be.mu.Lock()
+		be.conns[key] = &connChans{responses: ctx.Responses, loggedOut: ctx.LoggedOut}
+		be.mu.Unlock()
+		go func() {
+			select {
+			case <-ctx.LoggedOut:
+			case <-be.stop:
+			}
+			be.mu.Lock()
+			delete(be.conns, key)
+			be.mu.Unlock()
+		}()
+	}
+	return c
+}
+
+// messages returns the stored messages visible to u, ordered by ID
+func (be *Backend) messages(u *user) []httpapi.Message {
+	var result []httpapi.Message
+	for _, msg := range be.storage.List() {
+		if be.visible(u, &msg) && !u.expunged(uint32(msg.ID)) {
+			result = append(result, msg)
+		}
+	}
+	sortByID(result)
+	return result
+}
+
+// visible reports whether msg belongs in the INBOX of u. Users logged in
+// with a tenant token only see that tenant's messages.
+func (be *Backend) visible(u *user, msg *httpapi.Message) bool {
+	if u.tenant != "" && msg.Tenant != u.tenant {
+		return false
+	}
+	if be.shared {
+		return true
+	}
+	for _, rcpt := range msg.To {
+		if strings.EqualFold(rcpt, u.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch announces new messages to idling clients with an EXISTS update
+func (be *Backend) watch(events <-chan httpapi.Event, cancel func()) {
+	defer cancel()
+	for {
+		select {
+		case <-be.stop:
+			return
+		case ev := <-events:
+			switch ev.Type {
+			case httpapi.EventCleared, httpapi.EventRestored:
+				be.uidValidity.Add(1)
+			case httpapi.EventAdded:
+				msg, ok := be.storage.Get(ev.ID)
+				if !ok {
+					continue
+				}
+				be.announce(msg)
+			}
+		}
+	}
+}
+
+// announce queues the new message count for the sessions that see msg. A
+// session whose queue is full gets the count with its next update.
+func (be *Backend) announce(msg *httpapi.Message) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	for u := range be.sessions {
+		if !be.visible(u, msg) {
+			continue
+		}
+		select {
+		case u.updates <- uint32(len(be.messages(u))):
+		default:
+		}
+	}
+}
+
+// selected starts announcing new mail to the session of u
+func (be *Backend) selected(u *user) {
+	if u.conn == nil {
+		return
+	}
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if be.sessions[u] {
+		return
+	}
+	be.sessions[u] = true
+	go be.forward(u)
+}
+
+// forward writes the counts queued for u as EXISTS responses until the
+// connection ends
+func (be *Backend) forward(u *user) {
+	defer func() {
+		be.mu.Lock()
+		delete(be.sessions, u)
+		be.mu.Unlock()
+	}()
+	for {
+		select {
+		case n := <-u.updates:
+			status := imap.NewMailboxStatus(inboxName, []imap.StatusItem{imap.StatusMessages})
+			status.Messages = n
+			select {
+			case u.conn.responses <- &responses.Select{Mailbox: status}:
+			case <-u.conn.loggedOut:
+				return
+			case <-be.stop:
+				return
+			}
+		case <-u.conn.loggedOut:
+			return
+		case <-be.stop:
+			return
+		}
+	}
+}
+
+type user struct {
+	be      *Backend
+	name    string
+	tenant  string      // empty for every tenant
+	conn    *connChans  // nil when the connection is unknown
+	updates chan uint32 // message counts to announce
+
+	// EXPUNGE only hides messages from this session, storage is shared
+	// with the HTTP API and the other servers
+	mu       sync.Mutex
+	hidden   map[uint32]bool
+	validity uint32 // uidValidity the hidden UIDs belong to
+}
+
+// expunge hides uid from the session
+func (u *user) expunge(uid uint32) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.reset()
+	u.hidden[uid] = true
+}
+
+// expunged reports whether the session has expunged uid
+func (u *user) expunged(uid uint32) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.reset()
+	return u.hidden[uid]
+}
+
+// reset forgets the hidden UIDs once storage has been cleared, because
+// the UIDs are reused afterwards
+func (u *user) reset() {
+	if validity := u.be.uidValidity.Load(); u.hidden == nil || validity != u.validity {
+		u.hidden = make(map[uint32]bool)
+		u.validity = validity
+	}
+}
+
+func (u *user) Username() string { return u.name }
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return []backend.Mailbox{newMailbox(u)}, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	if !strings.EqualFold(name, inboxName) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	u.be.selected(u)
+	return newMailbox(u), nil
+}
+
+func (u *user) CreateMailbox(name string) error              { return errReadOnly }
+func (u *user) DeleteMailbox(name string) error              { return errReadOnly }
+func (u *user) RenameMailbox(existing, newName string) error { return errReadOnly }
+func (u *user) Logout() error                                { return nil }
@@ -0,0 +1,323 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+// mailbox is a session's view of an INBOX. Sequence numbers stay stable
+// until the session expunges, new messages are appended to the view.
+type mailbox struct {
+	user *user
+
+	mu          sync.Mutex
+	uids        []uint32
+	uidValidity uint32
+}
+
+func newMailbox(u *user) *mailbox {
+	return &mailbox{user: u}
+}
+
+// refresh appends messages that arrived since the last refresh and returns
+// the current messages keyed by UID.
+func (m *mailbox) refresh() map[uint32]httpapi.Message {
+	be := m.user.be
+	current := make(map[uint32]httpapi.Message)
+	msgs := be.messages(m.user)
+	for _, msg := range msgs {
+		current[uint32(msg.ID)] = msg
+	}
+
+	if validity := be.uidValidity.Load(); validity != m.uidValidity {
+		m.uidValidity = validity
+		m.uids = nil
+	}
+
+	var last uint32
+	if len(m.uids) > 0 {
+		last = m.uids[len(m.uids)-1]
+	}
+	for _, msg := range msgs {
+		if uid := uint32(msg.ID); uid > last {
+			m.uids = append(m.uids, uid)
+		}
+	}
+	return current
+}
+
+func (m *mailbox) Name() string { return inboxName }
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: inboxName}, nil
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := m.refresh()
+
+	status := imap.NewMailboxStatus(inboxName, items)
+	status.Flags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+
+	var unseen uint32
+	for i, uid := range m.uids {
+		if msg, ok := current[uid]; ok && !msg.Read {
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.uids))
+		case imap.StatusUidNext:
+			status.UidNext = 1
+			if len(m.uids) > 0 {
+				status.UidNext = m.uids[len(m.uids)-1] + 1
+			}
+		case imap.StatusUidValidity:
+			status.UidValidity = m.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+func (m *mailbox) SetSubscribed(subscribed bool) error { return nil }
+
+func (m *mailbox) Check() error { return nil }
+
+// Poll lets NOOP pick up new messages
+func (m *mailbox) Poll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refresh()
+	return nil
+}
+
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	m.mu.Lock()
+	m.refresh()
+	uids := append([]uint32(nil), m.uids...)
+	m.mu.Unlock()
+
+	for i, u := range uids {
+		seqNum := uint32(i + 1)
+		if !seqSet.Contains(selector(uid, seqNum, u)) {
+			continue
+		}
+
+		msg, ok := m.user.be.storage.Get(int(u))
+		if !ok {
+			continue // removed outside IMAP
+		}
+
+		fetched, err := fetch(msg, seqNum, items)
+		if err != nil {
+			continue
+		}
+
+		// Fetching a body section without PEEK marks the message read
+		for _, item := range items {
+			if section, err := imap.ParseBodySectionName(item); err == nil && !section.Peek && !msg.Read {
+				m.user.be.storage.SetRead(msg.ID, true)
+				if fetched.Flags != nil {
+					msg.Read = true
+					fetched.Flags = flags(msg)
+				}
+				break
+			}
+		}
+
+		ch <- fetched
+	}
+	return nil
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.mu.Lock()
+	m.refresh()
+	uids := append([]uint32(nil), m.uids...)
+	m.mu.Unlock()
+
+	var ids []uint32
+	for i, u := range uids {
+		seqNum := uint32(i + 1)
+		msg, ok := m.user.be.storage.Get(int(u))
+		if !ok {
+			continue
+		}
+
+		e, err := message.Read(bytes.NewReader(msg.Raw))
+		if err != nil && !message.IsUnknownCharset(err) {
+			continue
+		}
+		ok, err = backendutil.Match(e, seqNum, u, internalDate(msg), flags(msg), criteria)
+		if err != nil || !ok {
+			continue
+		}
+		ids = append(ids, selector(uid, seqNum, u))
+	}
+	return ids, nil
+}
+
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errReadOnly
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, changes []string) error {
+	m.mu.Lock()
+	m.refresh()
+	uids := append([]uint32(nil), m.uids...)
+	m.mu.Unlock()
+
+	storage := m.user.be.storage
+	for i, u := range uids {
+		seqNum := uint32(i + 1)
+		if !seqSet.Contains(selector(uid, seqNum, u)) {
+			continue
+		}
+		msg, ok := storage.Get(int(u))
+		if !ok {
+			continue
+		}
+
+		// Only \Seen, \Flagged (starred) and \Deleted are kept, other flags
+		// are dropped
+		updated := backendutil.UpdateFlags(flags(msg), op, changes)
+		msg.Read, msg.Starred, msg.Deleted = false, false, false
+		for _, f := range updated {
+			switch f {
+			case imap.SeenFlag:
+				msg.Read = true
+			case imap.FlaggedFlag:
+				msg.Starred = true
+			case imap.DeletedFlag:
+				msg.Deleted = true
+			}
+		}
+		storage.SetFlags(msg.ID, msg.Read, msg.Starred, msg.Deleted)
+	}
+	return nil
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	return errReadOnly
+}
+
+// Expunge hides messages marked \Deleted from the session. They stay in
+// storage for the HTTP API and the other servers.
+func (m *mailbox) Expunge() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := m.refresh()
+	for i := len(m.uids) - 1; i >= 0; i-- {
+		msg, ok := current[m.uids[i]]
+		if !ok || !msg.Deleted {
+			continue
+		}
+		m.user.expunge(m.uids[i])
+		m.uids = append(m.uids[:i], m.uids[i+1:]...)
+	}
+	return nil
+}
+
+func selector(uid bool, seqNum, u uint32) uint32 {
+	if uid {
+		return u
+	}
+	return seqNum
+}
+
+func fetch(msg *httpapi.Message, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody(msg.Raw)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := headerAndBody(msg.Raw)
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = flags(msg)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = internalDate(msg)
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(msg.Raw))
+		case imap.FetchUid:
+			fetched.Uid = uint32(msg.ID)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			hdr, body, err := headerAndBody(msg.Raw)
+			if err != nil {
+				return nil, err
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+func headerAndBody(raw []byte) (textproto.Header, *bufio.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(raw))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+func flags(msg *httpapi.Message) []string {
+	f := []string{}
+	if msg.Read {
+		f = append(f, imap.SeenFlag)
+	}
+	if msg.Starred {
+		f = append(f, imap.FlaggedFlag)
+	}
+	if msg.Deleted {
+		f = append(f, imap.DeletedFlag)
+	}
+	return f
+}
+
+func internalDate(msg *httpapi.Message) time.Time {
+	t, err := time.Parse(time.RFC3339, msg.CreatedAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func sortByID(msgs []httpapi.Message) {
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+}
@@ -0,0 +1,66 @@
+package imapserver
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+
+	"github.com/emersion/go-imap/server"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+// Server is a read-only IMAP4rev1 server over Storage
+type Server struct {
+	backend    *Backend
+	ImapServer *server.Server
+	closed     atomic.Bool
+}
+
+// New creates a new IMAP server. In shared mode every user sees all
+// messages, otherwise the login name selects the recipient's mailbox.
+func New(storage *httpapi.Storage, addr string, shared bool, users map[string]string) *Server {
+	be := NewBackend(storage, shared, users)
+
+	s := server.New(be)
+	s.Enable(be)
+	s.Addr = addr
+	s.AllowInsecureAuth = true // OK for local testing only
+	return &Server{backend: be, ImapServer: s}
+}
+
+// SetTLSConfig enables STARTTLS
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.ImapServer.TLSConfig = cfg
+}
+
+// SetTenants authenticates logins with tenant API tokens, call it before
+// Start
+func (s *Server) SetTenants(r *tenant.Registry) {
+	s.backend.SetTenants(r)
+}
+
+// Start listens on the configured address, it returns nil once the server
+// is closed
+func (s *Server) Start() error {
+	return s.ignoreClosed(s.ImapServer.ListenAndServe())
+}
+
+// Serve accepts connections on l until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	return s.ignoreClosed(s.ImapServer.Serve(l))
+}
+
+func (s *Server) ignoreClosed(err error) error {
+	if s.closed.Load() {
+		return nil
+	}
+	return err
+}
+
+// Close closes the listeners and connections
+func (s *Server) Close() error {
+	s.closed.Store(true)
+	s.backend.Close()
+	return s.ImapServer.Close()
+}
@@ -0,0 +1,283 @@
+package imapserver_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/imapserver"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+const rawMessage = "From: Sender <sender@example.com>\r\n" +
+	"To: Alice <alice@example.com>\r\n" +
+	"Subject: Welcome aboard\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"\r\n" +
+	"Hello Alice\r\n"
+
+func startServer(t *testing.T, shared bool) (*httpapi.Storage, string) {
+	t.Helper()
+	storage := httpapi.NewStorage()
+	srv := imapserver.New(storage, "", shared, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return storage, l.Addr().String()
+}
+
+func login(t *testing.T, addr, user string) *client.Client {
+	t.Helper()
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err := c.Login(user, "any"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func add(s *httpapi.Storage, to ...string) int {
+	return s.Add(&httpapi.Message{From: "sender@example.com", To: to, Raw: []byte(rawMessage)})
+}
+
+func TestIMAP_PerRecipientInbox(t *testing.T) {
+	storage, addr := startServer(t, false)
+	add(storage, "alice@example.com")
+	add(storage, "bob@example.com")
+	add(storage, "ALICE@example.com", "bob@example.com")
+
+	c := login(t, addr, "alice@example.com")
+	mbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mbox.Messages != 2 {
+		t.Fatalf("expected 2 messages for alice, got %d", mbox.Messages)
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 2)
+	ch := make(chan *imap.Message, 2)
+	if err := c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchBodyStructure}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	var uids []uint32
+	for msg := range ch {
+		uids = append(uids, msg.Uid)
+		if msg.Envelope.Subject != "Welcome aboard" {
+			t.Errorf("unexpected subject %q", msg.Envelope.Subject)
+		}
+		if msg.BodyStructure == nil || msg.BodyStructure.MIMEType != "text" {
+			t.Errorf("unexpected body structure %+v", msg.BodyStructure)
+		}
+	}
+	if len(uids) != 2 || uids[0] != 1 || uids[1] != 3 {
+		t.Errorf("expected UIDs [1 3], got %v", uids)
+	}
+}
+
+func TestIMAP_FetchBodyMarksRead(t *testing.T) {
+	storage, addr := startServer(t, true)
+	id := add(storage, "alice@example.com")
+
+	c := login(t, addr, "anyone")
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(1)
+	section := &imap.BodySectionName{}
+	ch := make(chan *imap.Message, 1)
+	if err := c.Fetch(seqset, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-ch
+	body, _ := io.ReadAll(msg.GetBody(section))
+	if string(body) != rawMessage {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	stored, _ := storage.Get(id)
+	if !stored.Read {
+		t.Error("expected fetching BODY[] to mark the message read")
+	}
+}
+
+func TestIMAP_SearchAndFlags(t *testing.T) {
+	storage, addr := startServer(t, true)
+	add(storage, "alice@example.com")
+	id := storage.Add(&httpapi.Message{To: []string{"bob@example.com"},
+		Raw: []byte("Subject: Password reset\r\n\r\nreset link\r\n")})
+
+	c := login(t, addr, "anyone")
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", "reset")
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 1 || uids[0] != uint32(id) {
+		t.Fatalf("expected search to find UID %d, got %v", id, uids)
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := storage.Get(id)
+	if !stored.Read || !stored.Starred || !stored.Deleted {
+		t.Errorf("expected flags to be stored, got read=%v starred=%v deleted=%v", stored.Read, stored.Starred, stored.Deleted)
+	}
+
+	criteria = imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	unseen, err := c.Search(criteria)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unseen) != 1 || unseen[0] != 1 {
+		t.Errorf("expected only message 1 unseen, got %v", unseen)
+	}
+
+	if err := c.Expunge(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := storage.Get(id); !exists {
+		t.Error("expected EXPUNGE to keep the message in storage")
+	}
+	status, err := c.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected the expunged message to be hidden, got %d messages", status.Messages)
+	}
+
+	other := login(t, addr, "anyone")
+	status, err = other.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 2 {
+		t.Errorf("expected other sessions to keep the message, got %d messages", status.Messages)
+	}
+}
+
+func TestIMAP_IdleReportsNewMail(t *testing.T) {
+	storage, addr := startServer(t, false)
+
+	c := login(t, addr, "alice@example.com")
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	// Drop the updates sent for the SELECT response
+	for len(updates) > 0 {
+		<-updates
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- c.Idle(stop, nil) }()
+	time.Sleep(50 * time.Millisecond)
+
+	add(storage, "bob@example.com")
+	add(storage, "alice@example.com")
+
+	// The update's mailbox status is shared with the client's reader
+	// goroutine, so only its arrival is checked here
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case u := <-updates:
+			if _, ok := u.(*client.MailboxUpdate); !ok {
+				continue
+			}
+			close(stop)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			status, err := c.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Messages != 1 {
+				t.Errorf("expected 1 message for alice, got %d", status.Messages)
+			}
+			return
+		case <-timeout:
+			close(stop)
+			<-done
+			t.Fatal("no EXISTS update received while idling")
+		}
+	}
+}
+
+func TestIMAP_Tenants(t *testing.T) {
+	registry, err := tenant.New([]tenant.Tenant{{Name: "alpha", Token: "alpha-token"}}, "admin-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := httpapi.NewStorage()
+	srv := imapserver.New(storage, "", true, nil)
+	srv.SetTenants(registry)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	storage.Add(&httpapi.Message{Tenant: "alpha", To: []string{"a@example.com"}, Raw: []byte(rawMessage)})
+	storage.Add(&httpapi.Message{To: []string{"b@example.com"}, Raw: []byte(rawMessage)})
+
+	c, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err := c.Login("anyone", "any"); err == nil {
+		t.Fatal("expected a password that is not a token to fail")
+	}
+	if err := c.Login("anyone", "alpha-token"); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mbox.Messages != 1 {
+		t.Errorf("expected 1 message for alpha, got %d", mbox.Messages)
+	}
+
+	admin, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Logout() })
+	if err := admin.Login("anyone", "admin-token"); err != nil {
+		t.Fatal(err)
+	}
+	if mbox, err := admin.Select("INBOX", false); err != nil || mbox.Messages != 2 {
+		t.Errorf("expected the admin to see 2 messages, got %v, %v", mbox, err)
+	}
+}
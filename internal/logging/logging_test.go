@@ -0,0 +1,57 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/logging"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger, err := logging.New(&buf, logging.FormatJSON, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("hidden")
+	logger.Info("message stored", "session", "abc")
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON entry, got %q", buf.String())
+	}
+	if entry["msg"] != "message stored" || entry["session"] != "abc" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+
+	buf.Reset()
+	level.Set(slog.LevelDebug)
+	logger.Debug("shown")
+	if !strings.Contains(buf.String(), "shown") {
+		t.Error("expected the level change to apply")
+	}
+
+	if _, err := logging.New(&buf, "xml", level); err == nil {
+		t.Error("expected unknown format to fail")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := logging.ParseLevel("WARN"); err != nil || level != slog.LevelWarn {
+		t.Errorf("expected warn, got %v %v", level, err)
+	}
+	if _, err := logging.ParseLevel("loud"); err == nil {
+		t.Error("expected unknown level to fail")
+	}
+}
+
+func TestNewID(t *testing.T) {
+	a, b := logging.NewID(), logging.NewID()
+	if len(a) != 16 || a == b {
+		t.Errorf("expected distinct 16 character IDs, got %q and %q", a, b)
+	}
+}
@@ -0,0 +1,74 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/metrics"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := metrics.NewRegistry()
+	messages := r.NewCounter("mail_messages_total", "Messages by result.", "result", "code")
+	messages.Inc("accepted", "250")
+	messages.Add(2, "rejected", "550")
+	messages.Inc("accepted", "250")
+	r.NewCounter("mail_plain_total", "Unlabelled counter.")
+	r.NewGaugeFunc("mail_stored", "Stored messages.", func() float64 { return 3 })
+	sizes := r.NewHistogram("mail_size_bytes", "Message sizes.", []float64{100, 1000})
+	sizes.Observe(50)
+	sizes.Observe(100)
+	sizes.Observe(5000)
+
+	var out strings.Builder
+	r.WriteText(&out)
+
+	want := `# HELP mail_messages_total Messages by result.
+# TYPE mail_messages_total counter
+mail_messages_total{result="accepted",code="250"} 2
+mail_messages_total{result="rejected",code="550"} 2
+# HELP mail_plain_total Unlabelled counter.
+# TYPE mail_plain_total counter
+mail_plain_total 0
+# HELP mail_stored Stored messages.
+# TYPE mail_stored gauge
+mail_stored 3
+# HELP mail_size_bytes Message sizes.
+# TYPE mail_size_bytes histogram
+mail_size_bytes_bucket{le="100"} 2
+mail_size_bytes_bucket{le="1000"} 2
+mail_size_bytes_bucket{le="+Inf"} 3
+mail_size_bytes_sum 5150
+mail_size_bytes_count 3
+`
+	if out.String() != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestCounter_EscapesLabels(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounter("requests_total", "Requests.", "route").Inc("a\"b\\c\nd")
+
+	var out strings.Builder
+	r.WriteText(&out)
+	if !strings.Contains(out.String(), `requests_total{route="a\"b\\c\nd"} 1`) {
+		t.Errorf("label not escaped:\n%s", out.String())
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewGaugeFunc("up", "Always one.", func() float64 { return 1 })
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "up 1\n") {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+}
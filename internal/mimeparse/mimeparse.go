@@ -0,0 +1,89 @@
+// Package mimeparse decodes the MIME structure of captured messages. The
+// HTTP API and pkg/mailtest share it so that they agree on which parts
+// are bodies, inline parts and attachments.
+package mimeparse
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset" // decode non-UTF-8 parts
+	"github.com/emersion/go-message/mail"
+)
+
+// Part is a leaf MIME part with its decoded body
+type Part struct {
+	ID          string // 1-based indices joined by dots, like IMAP
+	ContentType string
+	FileName    string
+	ContentID   string
+	Attachment  bool // has an attachment disposition or a file name
+	Body        []byte
+}
+
+// Message is a message with its MIME structure decoded
+type Message struct {
+	Header      mail.Header // empty when raw is not a valid message
+	Text        string      // the first text/plain body
+	HTML        string      // the first text/html body
+	Parts       []*Part
+	Inline      []*Part // parts besides the bodies shown inline, e.g. images
+	Attachments []*Part
+}
+
+// Parse decodes raw. Messages that cannot be read at all get fallback as
+// their text body.
+func Parse(raw []byte, fallback string) *Message {
+	p := &Message{}
+	// Unknown charsets are reported with an entity that is still readable
+	entity, _ := message.Read(bytes.NewReader(raw))
+	if entity == nil {
+		p.Text = fallback
+		return p
+	}
+	p.Header = mail.Header{Header: entity.Header}
+
+	entity.Walk(func(path []int, part *message.Entity, err error) error {
+		mediaType, params, _ := part.Header.ContentType()
+		if strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		body, _ := io.ReadAll(part.Body)
+
+		ids := make([]string, len(path))
+		for i, n := range path {
+			ids[i] = strconv.Itoa(n + 1)
+		}
+		mp := &Part{ID: strings.Join(ids, "."), ContentType: mediaType, Body: body}
+		if mp.ID == "" {
+			mp.ID = "1"
+		}
+		if mediaType == "" {
+			mp.ContentType = "text/plain"
+		}
+		disposition, dispParams, _ := part.Header.ContentDisposition()
+		mp.FileName = dispParams["filename"]
+		if mp.FileName == "" {
+			mp.FileName = params["name"]
+		}
+		mp.ContentID = strings.Trim(part.Header.Get("Content-Id"), "<>")
+		mp.Attachment = disposition == "attachment" || mp.FileName != ""
+		p.Parts = append(p.Parts, mp)
+
+		switch {
+		case !mp.Attachment && mp.ContentType == "text/plain" && p.Text == "":
+			p.Text = string(body)
+		case !mp.Attachment && mp.ContentType == "text/html" && p.HTML == "":
+			p.HTML = string(body)
+		case disposition == "inline" || (disposition == "" && mp.ContentID != ""):
+			p.Inline = append(p.Inline, mp)
+		default:
+			p.Attachments = append(p.Attachments, mp)
+		}
+		return nil
+	})
+	return p
+}
@@ -0,0 +1,506 @@
+package pop3
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+// Server serves captured messages over POP3 (RFC 1939)
+type Server struct {
+	Addr      string
+	Domain    string
+	TLSConfig *tls.Config // enables STLS when set
+
+	// Shared serves every message to every user instead of one
+	// mailbox per recipient address.
+	Shared bool
+
+	// Users maps user names to passwords. When empty any credentials are
+	// accepted, matching the permissive SMTP side.
+	Users map[string]string
+
+	// Tenants, when enabled, replaces Users: the password must be a tenant
+	// or admin API token and tenant tokens only see their tenant's mail.
+	Tenants *tenant.Registry
+
+	ReadTimeout time.Duration
+
+	storage *httpapi.Storage
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New creates a new POP3 server
+func New(storage *httpapi.Storage, addr string) *Server {
+	return &Server{
+		Addr:        addr,
+		Domain:      "localhost",
+		ReadTimeout: 10 * time.Minute,
+		storage:     storage,
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listens on Addr and serves connections
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go func() {
+			newConn(s, c).serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listeners and closes open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	for _, l := range s.listeners {
+		if lerr := l.Close(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+// mailbox returns the messages visible to user in a tenant, ordered by ID.
+// An empty tenant sees every tenant.
+func (s *Server) mailbox(user, tenantName string) []httpapi.Message {
+	var result []httpapi.Message
+	for _, msg := range s.storage.List() {
+		if tenantName != "" && msg.Tenant != tenantName {
+			continue
+		}
+		if s.Shared || hasRecipient(msg.To, user) {
+			result = append(result, msg)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+func hasRecipient(to []string, user string) bool {
+	for _, rcpt := range to {
+		if strings.EqualFold(rcpt, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword returns the tenant the credentials give access to
+func (s *Server) checkPassword(user, pass string) (string, bool) {
+	if s.Tenants.Enabled() {
+		name, _, ok := s.Tenants.Authenticate(pass)
+		return name, ok
+	}
+	if len(s.Users) == 0 {
+		return "", true
+	}
+	want, ok := s.Users[user]
+	return "", ok && want == pass
+}
+
+// checkAPOP verifies an APOP digest. Tenant tokens are not usable as APOP
+// secrets, so APOP is refused when tenants are enabled.
+func (s *Server) checkAPOP(user, timestamp, digest string) bool {
+	if s.Tenants.Enabled() {
+		return false
+	}
+	if len(s.Users) == 0 {
+		return true
+	}
+	pass, ok := s.Users[user]
+	if !ok {
+		return false
+	}
+	sum := md5.Sum([]byte(timestamp + pass))
+	return strings.EqualFold(hex.EncodeToString(sum[:]), digest)
+}
+
+var errQuit = errors.New("quit")
+
+type state int
+
+const (
+	stateAuthorization state = iota
+	stateTransaction
+)
+
+type conn struct {
+	srv       *Server
+	nc        net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	timestamp string
+	isTLS     bool
+
+	state    state
+	user     string
+	tenant   string
+	messages []httpapi.Message
+	sizes    []int // octets sent for each message
+	deleted  map[int]bool
+}
+
+func newConn(s *Server, c net.Conn) *conn {
+	_, isTLS := c.(*tls.Conn)
+	return &conn{
+		srv:       s,
+		nc:        c,
+		r:         bufio.NewReader(c),
+		w:         bufio.NewWriter(c),
+		timestamp: fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), s.Domain),
+		isTLS:     isTLS,
+	}
+}
+
+func (c *conn) serve() {
+	defer c.nc.Close()
+
+	c.ok("POP3 server ready " + c.timestamp)
+	for {
+		if c.srv.ReadTimeout > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(c.srv.ReadTimeout))
+		}
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd, args := parseLine(line)
+		if err := c.handle(cmd, args); err != nil {
+			return
+		}
+	}
+}
+
+func parseLine(line string) (string, []string) {
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(fields[0]), fields[1:]
+}
+
+func (c *conn) handle(cmd string, args []string) error {
+	switch cmd {
+	case "CAPA":
+		c.capa()
+		return nil
+	case "NOOP":
+		c.ok("")
+		return nil
+	case "QUIT":
+		return c.quit()
+	}
+
+	if c.state == stateAuthorization {
+		switch cmd {
+		case "USER":
+			if len(args) != 1 {
+				c.err("USER requires a mailbox name")
+				return nil
+			}
+			c.user = args[0]
+			c.ok("send PASS")
+		case "PASS":
+			if c.user == "" {
+				c.err("USER first")
+				return nil
+			}
+			name, ok := c.srv.checkPassword(c.user, strings.Join(args, " "))
+			if !ok {
+				c.user = ""
+				c.err("[AUTH] invalid credentials")
+				return nil
+			}
+			c.tenant = name
+			c.login()
+		case "APOP":
+			if len(args) != 2 {
+				c.err("APOP requires name and digest")
+				return nil
+			}
+			if !c.srv.checkAPOP(args[0], c.timestamp, args[1]) {
+				c.err("[AUTH] invalid credentials")
+				return nil
+			}
+			c.user = args[0]
+			c.login()
+		case "STLS":
+			return c.startTLS()
+		default:
+			c.err("command not valid in this state")
+		}
+		return nil
+	}
+
+	switch cmd {
+	case "STAT":
+		count, size := 0, 0
+		for i := range c.messages {
+			if !c.deleted[i] {
+				count++
+				size += c.sizes[i]
+			}
+		}
+		c.ok(fmt.Sprintf("%d %d", count, size))
+	case "LIST":
+		c.list(args, func(i int, msg httpapi.Message) string { return strconv.Itoa(c.sizes[i]) })
+	case "UIDL":
+		c.list(args, func(i int, msg httpapi.Message) string { return strconv.Itoa(msg.ID) })
+	case "RETR":
+		i, ok := c.message(args)
+		if !ok {
+			return nil
+		}
+		c.ok(fmt.Sprintf("%d octets", c.sizes[i]))
+		c.writeMultiline(c.messages[i].Raw, -1)
+	case "TOP":
+		if len(args) != 2 {
+			c.err("TOP requires message and line count")
+			return nil
+		}
+		i, ok := c.message(args[:1])
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			c.err("invalid line count")
+			return nil
+		}
+		c.ok("")
+		c.writeMultiline(c.messages[i].Raw, n)
+	case "DELE":
+		i, ok := c.message(args)
+		if !ok {
+			return nil
+		}
+		c.deleted[i] = true
+		c.ok(fmt.Sprintf("message %d deleted", i+1))
+	case "RSET":
+		c.deleted = make(map[int]bool)
+		c.ok("")
+	default:
+		c.err("unknown command")
+	}
+	return nil
+}
+
+func (c *conn) capa() {
+	c.ok("capability list follows")
+	caps := []string{"USER", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "IMPLEMENTATION go-mail-testserver"}
+	if c.srv.TLSConfig != nil && !c.isTLS && c.state == stateAuthorization {
+		caps = append(caps, "STLS")
+	}
+	for _, cp := range caps {
+		c.w.WriteString(cp + "\r\n")
+	}
+	c.w.WriteString(".\r\n")
+	c.w.Flush()
+}
+
+func (c *conn) login() {
+	c.state = stateTransaction
+	c.deleted = make(map[int]bool)
+	c.messages, c.sizes = nil, nil
+	// List omits raw bytes, fetch each message in full
+	for _, m := range c.srv.mailbox(c.user, c.tenant) {
+		if msg, ok := c.srv.storage.Get(m.ID); ok {
+			c.messages = append(c.messages, *msg)
+			c.sizes = append(c.sizes, wireSize(msg.Raw))
+		}
+	}
+	c.ok(fmt.Sprintf("%s has %d messages", c.user, len(c.messages)))
+}
+
+func (c *conn) startTLS() error {
+	if c.srv.TLSConfig == nil || c.isTLS {
+		c.err("STLS not available")
+		return nil
+	}
+	// Commands pipelined after STLS would be lost with the plain reader
+	if c.r.Buffered() > 0 {
+		c.err("STLS must be the last command sent before the TLS handshake")
+		return nil
+	}
+	c.ok("begin TLS negotiation")
+
+	tlsConn := tls.Server(c.nc, c.srv.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.nc = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	c.w = bufio.NewWriter(tlsConn)
+	c.isTLS = true
+	return nil
+}
+
+func (c *conn) quit() error {
+	if c.state == stateTransaction {
+		for i := range c.deleted {
+			c.srv.storage.Delete(c.messages[i].ID)
+		}
+	}
+	c.ok("bye")
+	return errQuit
+}
+
+// message resolves a 1-based message number argument
+func (c *conn) message(args []string) (int, bool) {
+	if len(args) != 1 {
+		c.err("message number required")
+		return 0, false
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(c.messages) {
+		c.err("no such message")
+		return 0, false
+	}
+	if c.deleted[n-1] {
+		c.err("message already deleted")
+		return 0, false
+	}
+	return n - 1, true
+}
+
+func (c *conn) list(args []string, value func(int, httpapi.Message) string) {
+	if len(args) > 0 {
+		i, ok := c.message(args)
+		if ok {
+			c.ok(fmt.Sprintf("%d %s", i+1, value(i, c.messages[i])))
+		}
+		return
+	}
+
+	c.ok("")
+	for i, msg := range c.messages {
+		if !c.deleted[i] {
+			fmt.Fprintf(c.w, "%d %s\r\n", i+1, value(i, msg))
+		}
+	}
+	c.w.WriteString(".\r\n")
+	c.w.Flush()
+}
+
+// writeMultiline writes a byte-stuffed message. When bodyLines is not
+// negative only the headers and that many body lines are written.
+func (c *conn) writeMultiline(raw []byte, bodyLines int) {
+	for _, line := range wireLines(raw, bodyLines) {
+		c.w.WriteString(line + "\r\n")
+	}
+	c.w.WriteString(".\r\n")
+	c.w.Flush()
+}
+
+// wireLines returns the dot-stuffed lines of raw as sent, with the headers
+// and at most bodyLines body lines, all of them when bodyLines is negative
+func wireLines(raw []byte, bodyLines int) []string {
+	lines := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var out []string
+	inBody := false
+	for _, line := range lines {
+		if inBody && bodyLines >= 0 {
+			if bodyLines == 0 {
+				break
+			}
+			bodyLines--
+		}
+		if line == "" {
+			inBody = true
+		}
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// wireSize is the number of octets RETR sends for raw, without the
+// terminating line
+func wireSize(raw []byte) int {
+	size := 0
+	for _, line := range wireLines(raw, -1) {
+		size += len(line) + 2
+	}
+	return size
+}
+
+func (c *conn) ok(msg string) {
+	if msg == "" {
+		c.w.WriteString("+OK\r\n")
+	} else {
+		c.w.WriteString("+OK " + msg + "\r\n")
+	}
+	c.w.Flush()
+}
+
+func (c *conn) err(msg string) {
+	c.w.WriteString("-ERR " + msg + "\r\n")
+	c.w.Flush()
+}
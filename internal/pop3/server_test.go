@@ -0,0 +1,295 @@
+package pop3_test
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/pop3"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+func startServer(t *testing.T, configure func(*pop3.Server)) (*httpapi.Storage, string) {
+	t.Helper()
+	storage := httpapi.NewStorage()
+	srv := pop3.New(storage, "")
+	if configure != nil {
+		configure(srv)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return storage, l.Addr().String()
+}
+
+type client struct {
+	t *testing.T
+	*textproto.Conn
+	greeting string
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	greeting, err := c.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{t: t, Conn: c, greeting: greeting}
+}
+
+func (c *client) cmd(line string) string {
+	c.t.Helper()
+	if err := c.PrintfLine("%s", line); err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := c.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+func (c *client) multi(line string) []string {
+	c.t.Helper()
+	if resp := c.cmd(line); !strings.HasPrefix(resp, "+OK") {
+		c.t.Fatalf("%s: %s", line, resp)
+	}
+	lines, err := c.ReadDotLines()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return lines
+}
+
+func addMessages(s *httpapi.Storage) {
+	s.Add(&httpapi.Message{From: "a@example.com", To: []string{"alice@example.com"},
+		Raw: []byte("Subject: one\r\n\r\nline1\r\n.dot\r\nline3\r\n")})
+	s.Add(&httpapi.Message{From: "a@example.com", To: []string{"bob@example.com"},
+		Raw: []byte("Subject: two\r\n\r\nhello bob\r\n")})
+	s.Add(&httpapi.Message{From: "a@example.com", To: []string{"Alice@example.com", "bob@example.com"},
+		Raw: []byte("Subject: three\r\n\r\nhello both\r\n")})
+}
+
+func TestPOP3_PerRecipientMailbox(t *testing.T) {
+	storage, addr := startServer(t, nil)
+	addMessages(storage)
+
+	c := dial(t, addr)
+	if resp := c.cmd("USER alice@example.com"); !strings.HasPrefix(resp, "+OK") {
+		t.Fatal(resp)
+	}
+	if resp := c.cmd("PASS secret"); !strings.HasPrefix(resp, "+OK") {
+		t.Fatal(resp)
+	}
+
+	if resp := c.cmd("STAT"); !strings.HasPrefix(resp, "+OK 2 ") {
+		t.Errorf("expected 2 messages for alice, got %q", resp)
+	}
+
+	uidl := c.multi("UIDL")
+	if len(uidl) != 2 || uidl[0] != "1 1" || uidl[1] != "2 3" {
+		t.Errorf("unexpected UIDL listing: %v", uidl)
+	}
+
+	body := c.multi("RETR 1")
+	if strings.Join(body, "\n") != "Subject: one\n\nline1\n.dot\nline3" {
+		t.Errorf("unexpected RETR content: %q", body)
+	}
+
+	top := c.multi("TOP 1 1")
+	if strings.Join(top, "\n") != "Subject: one\n\nline1" {
+		t.Errorf("unexpected TOP content: %q", top)
+	}
+}
+
+func TestPOP3_DeleteOnQuit(t *testing.T) {
+	storage, addr := startServer(t, func(s *pop3.Server) { s.Shared = true })
+	addMessages(storage)
+
+	c := dial(t, addr)
+	c.cmd("USER anyone")
+	c.cmd("PASS x")
+	if resp := c.cmd("DELE 2"); !strings.HasPrefix(resp, "+OK") {
+		t.Fatal(resp)
+	}
+	if resp := c.cmd("RETR 2"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("expected deleted message to be inaccessible, got %q", resp)
+	}
+	if resp := c.cmd("STAT"); !strings.HasPrefix(resp, "+OK 2 ") {
+		t.Errorf("expected 2 messages after DELE, got %q", resp)
+	}
+	c.cmd("QUIT")
+
+	if _, exists := storage.Get(2); exists {
+		t.Error("expected message 2 to be removed from storage")
+	}
+	if len(storage.List()) != 2 {
+		t.Errorf("expected 2 messages left, got %d", len(storage.List()))
+	}
+}
+
+func TestPOP3_RsetKeepsMessages(t *testing.T) {
+	storage, addr := startServer(t, func(s *pop3.Server) { s.Shared = true })
+	addMessages(storage)
+
+	c := dial(t, addr)
+	c.cmd("USER anyone")
+	c.cmd("PASS x")
+	c.cmd("DELE 1")
+	c.cmd("RSET")
+	c.cmd("QUIT")
+
+	if len(storage.List()) != 3 {
+		t.Errorf("expected RSET to undo deletion, got %d messages", len(storage.List()))
+	}
+}
+
+func TestPOP3_Authentication(t *testing.T) {
+	users := map[string]string{"alice@example.com": "secret"}
+	storage, addr := startServer(t, func(s *pop3.Server) { s.Users = users })
+	addMessages(storage)
+
+	c := dial(t, addr)
+	c.cmd("USER alice@example.com")
+	if resp := c.cmd("PASS wrong"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("expected wrong password to fail, got %q", resp)
+	}
+	if resp := c.cmd("STAT"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("expected STAT before login to fail, got %q", resp)
+	}
+
+	c2 := dial(t, addr)
+	timestamp := regexp.MustCompile(`<[^>]+>`).FindString(c2.greeting)
+	sum := md5.Sum([]byte(timestamp + "secret"))
+	if resp := c2.cmd("APOP alice@example.com " + hex.EncodeToString(sum[:])); !strings.HasPrefix(resp, "+OK") {
+		t.Errorf("expected APOP to succeed, got %q", resp)
+	}
+}
+
+func TestPOP3_Capabilities(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	c := dial(t, addr)
+	caps := strings.Join(c.multi("CAPA"), " ")
+	for _, want := range []string{"USER", "TOP", "UIDL"} {
+		if !strings.Contains(caps, want) {
+			t.Errorf("expected capability %s in %q", want, caps)
+		}
+	}
+	if strings.Contains(caps, "STLS") {
+		t.Error("STLS must not be advertised without TLS configuration")
+	}
+	if resp := c.cmd("STLS"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("expected STLS to fail, got %q", resp)
+	}
+}
+
+func TestPOP3_Tenants(t *testing.T) {
+	registry, err := tenant.New([]tenant.Tenant{{Name: "alpha", Token: "alpha-token"}, {Name: "beta", Token: "beta-token"}}, "admin-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, addr := startServer(t, func(s *pop3.Server) {
+		s.Shared = true
+		s.Tenants = registry
+	})
+	storage.Add(&httpapi.Message{Tenant: "alpha", To: []string{"a@example.com"}, Raw: []byte("Subject: alpha\r\n\r\n")})
+	storage.Add(&httpapi.Message{Tenant: "beta", To: []string{"b@example.com"}, Raw: []byte("Subject: beta\r\n\r\n")})
+
+	c := dial(t, addr)
+	c.cmd("USER anyone")
+	if resp := c.cmd("PASS wrong"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("expected an unknown token to fail, got %q", resp)
+	}
+	c.cmd("USER anyone")
+	c.cmd("PASS alpha-token")
+	if resp := c.cmd("STAT"); !strings.HasPrefix(resp, "+OK 1 ") {
+		t.Errorf("expected 1 message for alpha, got %q", resp)
+	}
+	c.cmd("DELE 1")
+	c.cmd("QUIT")
+	if _, exists := storage.Get(2); !exists {
+		t.Error("expected alpha not to delete beta's message")
+	}
+
+	admin := dial(t, addr)
+	admin.cmd("USER anyone")
+	admin.cmd("PASS admin-token")
+	if resp := admin.cmd("STAT"); !strings.HasPrefix(resp, "+OK 1 ") {
+		t.Errorf("expected the admin to see beta's message, got %q", resp)
+	}
+}
+
+func TestPOP3_OctetsMatchSentBytes(t *testing.T) {
+	storage, addr := startServer(t, nil)
+	raw := "Subject: bare\n\n.dot\nline\n"
+	storage.Add(&httpapi.Message{From: "a@example.com", To: []string{"alice@example.com"}, Raw: []byte(raw)})
+
+	c := dial(t, addr)
+	c.cmd("USER alice@example.com")
+	c.cmd("PASS secret")
+
+	// CRLF line endings plus one stuffed dot
+	want := len(raw) + 4 + 1
+	if resp := c.cmd("STAT"); resp != "+OK 1 "+strconv.Itoa(want) {
+		t.Errorf("STAT: %q, want %d octets", resp, want)
+	}
+	if resp := c.cmd("LIST 1"); resp != "+OK 1 "+strconv.Itoa(want) {
+		t.Errorf("LIST: %q, want %d octets", resp, want)
+	}
+
+	resp := c.cmd("RETR 1")
+	if resp != "+OK "+strconv.Itoa(want)+" octets" {
+		t.Errorf("RETR: %q, want %d octets", resp, want)
+	}
+	sent := 0
+	for {
+		line, err := c.R.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ".\r\n" {
+			break
+		}
+		sent += len(line)
+	}
+	if sent != want {
+		t.Errorf("RETR sent %d octets, announced %d", sent, want)
+	}
+}
+
+func TestPOP3_STLSRejectsPipelinedCommands(t *testing.T) {
+	_, addr := startServer(t, func(s *pop3.Server) { s.TLSConfig = &tls.Config{} })
+
+	c := dial(t, addr)
+	// Send both lines in one write so the NOOP is already buffered
+	if _, err := c.W.WriteString("STLS\r\nNOOP\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	for _, want := range []string{"-ERR", "+OK"} {
+		resp, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(resp, want) {
+			t.Errorf("expected %s, got %q", want, resp)
+		}
+	}
+}
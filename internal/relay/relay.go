@@ -0,0 +1,279 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	smtp "github.com/emersion/go-smtp"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+)
+
+// Rule selects recipients whose mail is delivered upstream.
+// A recipient matches when every configured condition matches.
+type Rule struct {
+	Name         string
+	Recipient    *regexp.Regexp // matched against the envelope recipient
+	SenderDomain string         // matched against the envelope sender domain
+}
+
+// Match returns the recipients of the envelope selected by the rule
+func (r Rule) Match(from string, to []string) []string {
+	if r.Recipient == nil && r.SenderDomain == "" {
+		return nil
+	}
+	if r.SenderDomain != "" && !strings.EqualFold(domainOf(from), r.SenderDomain) {
+		return nil
+	}
+
+	var matched []string
+	for _, rcpt := range to {
+		if r.Recipient == nil || r.Recipient.MatchString(rcpt) {
+			matched = append(matched, rcpt)
+		}
+	}
+	return matched
+}
+
+// Config holds the upstream server settings
+type Config struct {
+	Addr          string // upstream SMTP server host:port
+	Username      string
+	Password      string
+	StartTLS      bool // require STARTTLS on the upstream connection
+	MaxAttempts   int
+	RetryInterval time.Duration
+	QueueSize     int
+	Workers       int
+}
+
+type job struct {
+	id         int
+	from       string
+	recipients []string
+	raw        []byte
+	rule       string
+	attempts   int
+}
+
+// Relayer delivers messages matching relay rules to an upstream server
+// asynchronously, retrying failed deliveries.
+type Relayer struct {
+	storage *httpapi.Storage
+	cfg     Config
+
+	mu    sync.RWMutex
+	rules []Rule
+
+	queue chan *job
+	wg    sync.WaitGroup
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// New creates a relayer, call Start to begin delivering
+func New(storage *httpapi.Storage, cfg Config, rules []Rule) *Relayer {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 2
+	}
+	return &Relayer{
+		storage: storage,
+		cfg:     cfg,
+		rules:   rules,
+		queue:   make(chan *job, cfg.QueueSize),
+		stop:    make(chan struct{}),
+	}
+}
+
+// SetRules replaces the relay rules
+func (r *Relayer) SetRules(rules []Rule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+}
+
+// Start launches the delivery workers
+func (r *Relayer) Start() {
+	for i := 0; i < r.cfg.Workers; i++ {
+		r.wg.Add(1)
+		go r.worker()
+	}
+}
+
+// Stop stops the workers, queued deliveries are abandoned
+func (r *Relayer) Stop() {
+	r.once.Do(func() { close(r.stop) })
+	r.wg.Wait()
+}
+
+// Enqueue schedules a stored message for relay when a rule matches.
+// It reports whether the message was queued.
+func (r *Relayer) Enqueue(msg *httpapi.Message) bool {
+	recipients, rule := r.match(msg.From, msg.To)
+	if len(recipients) == 0 {
+		return false
+	}
+
+	j := &job{
+		id:         msg.ID,
+		from:       msg.From,
+		recipients: recipients,
+		raw:        append([]byte(nil), msg.Raw...),
+		rule:       rule,
+	}
+	r.setStatus(j, httpapi.RelayQueued, "")
+
+	select {
+	case r.queue <- j:
+		return true
+	default:
+		r.setStatus(j, httpapi.RelayFailed, "relay queue full")
+		return false
+	}
+}
+
+// match collects recipients selected by any rule, the first matching rule
+// names the delivery.
+func (r *Relayer) match(from string, to []string) ([]string, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var recipients []string
+	var name string
+	for _, rule := range r.rules {
+		for _, rcpt := range rule.Match(from, to) {
+			if seen[rcpt] {
+				continue
+			}
+			seen[rcpt] = true
+			recipients = append(recipients, rcpt)
+			if name == "" {
+				name = rule.Name
+			}
+		}
+	}
+	return recipients, name
+}
+
+func (r *Relayer) worker() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case j := <-r.queue:
+			r.deliver(j)
+		}
+	}
+}
+
+func (r *Relayer) deliver(j *job) {
+	j.attempts++
+
+	err := r.send(j)
+	if err == nil {
+		r.setStatus(j, httpapi.RelaySent, "")
+		return
+	}
+
+	if j.attempts >= r.cfg.MaxAttempts {
+		r.setStatus(j, httpapi.RelayFailed, err.Error())
+		return
+	}
+	r.setStatus(j, httpapi.RelayQueued, err.Error())
+
+	// Back off linearly before the next attempt
+	delay := r.cfg.RetryInterval * time.Duration(j.attempts)
+	time.AfterFunc(delay, func() {
+		select {
+		case <-r.stop:
+		case r.queue <- j:
+		}
+	})
+}
+
+func (r *Relayer) send(j *job) error {
+	var (
+		c   *smtp.Client
+		err error
+	)
+	if r.cfg.StartTLS {
+		c, err = smtp.DialStartTLS(r.cfg.Addr, nil)
+	} else {
+		c, err = smtp.Dial(r.cfg.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if r.cfg.Username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", r.cfg.Username, r.cfg.Password)); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(j.from, j.recipients, bytes.NewReader(j.raw)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (r *Relayer) setStatus(j *job, state, lastErr string) {
+	r.storage.SetRelayStatus(j.id, httpapi.RelayStatus{
+		State:      state,
+		Rule:       j.rule,
+		Recipients: j.recipients,
+		Attempts:   j.attempts,
+		LastError:  lastErr,
+		UpdatedAt:  time.Now().UTC().Format(time.RFC3339),
+	})
+
+	level := slog.LevelInfo
+	if state == httpapi.RelayFailed {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "relay "+state, "id", j.id, "rule", j.rule,
+		"recipients", j.recipients, "attempts", j.attempts, "error", lastErr)
+}
+
+// ParseRules builds rules from a recipient regex and a comma separated
+// list of sender domains, as used by the environment configuration.
+func ParseRules(recipientRegex, senderDomains string) ([]Rule, error) {
+	var rules []Rule
+	if recipientRegex != "" {
+		re, err := regexp.Compile(recipientRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay recipient regex: %w", err)
+		}
+		rules = append(rules, Rule{Name: "recipient", Recipient: re})
+	}
+	for _, d := range strings.Split(senderDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			rules = append(rules, Rule{Name: "sender:" + d, SenderDomain: d})
+		}
+	}
+	return rules, nil
+}
+
+func domainOf(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package relay_test
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/relay"
+)
+
+type upstream struct {
+	mu   sync.Mutex
+	rcpt []string
+}
+
+func (u *upstream) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &upstreamSession{u: u}, nil
+}
+
+type upstreamSession struct {
+	u  *upstream
+	to []string
+}
+
+func (s *upstreamSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *upstreamSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *upstreamSession) Data(r io.Reader) error {
+	_, err := io.ReadAll(r)
+	s.u.mu.Lock()
+	s.u.rcpt = append(s.u.rcpt, s.to...)
+	s.u.mu.Unlock()
+	return err
+}
+func (s *upstreamSession) Reset()        {}
+func (s *upstreamSession) Logout() error { return nil }
+
+func startUpstream(t *testing.T) (*upstream, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &upstream{}
+	srv := smtp.NewServer(u)
+	srv.Domain = "localhost"
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return u, l.Addr().String()
+}
+
+func waitState(t *testing.T, s *httpapi.Storage, id int, state string) *httpapi.RelayStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		msg, _ := s.Get(id)
+		if msg.Relay != nil && msg.Relay.State == state {
+			return msg.Relay
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	msg, _ := s.Get(id)
+	t.Fatalf("relay state %q not reached, got %+v", state, msg.Relay)
+	return nil
+}
+
+func TestRule_Match(t *testing.T) {
+	rule := relay.Rule{Recipient: regexp.MustCompile(`@team\.example$`)}
+	got := rule.Match("app@example.com", []string{"a@team.example", "b@other.example"})
+	if len(got) != 1 || got[0] != "a@team.example" {
+		t.Errorf("unexpected match: %v", got)
+	}
+
+	rule = relay.Rule{SenderDomain: "Example.com"}
+	if got := rule.Match("app@example.com", []string{"x@y"}); len(got) != 1 {
+		t.Errorf("expected sender domain match, got %v", got)
+	}
+	if got := rule.Match("app@other.com", []string{"x@y"}); len(got) != 0 {
+		t.Errorf("expected no match, got %v", got)
+	}
+
+	if got := (relay.Rule{}).Match("a@b", []string{"c@d"}); len(got) != 0 {
+		t.Errorf("empty rule must not match, got %v", got)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := relay.ParseRules(`@team\.example$`, "a.com, b.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Errorf("expected 3 rules, got %d", len(rules))
+	}
+
+	if _, err := relay.ParseRules("(", ""); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestRelayer_Delivers(t *testing.T) {
+	u, addr := startUpstream(t)
+	s := httpapi.NewStorage()
+	rules, _ := relay.ParseRules(`@team\.example$`, "")
+	r := relay.New(s, relay.Config{Addr: addr}, rules)
+	r.Start()
+	defer r.Stop()
+
+	msg := &httpapi.Message{
+		From: "app@example.com",
+		To:   []string{"dev@team.example", "user@customer.example"},
+		Raw:  []byte("Subject: hi\r\n\r\nbody\r\n"),
+	}
+	s.Add(msg)
+	if !r.Enqueue(msg) {
+		t.Fatal("expected message to be queued")
+	}
+
+	status := waitState(t, s, msg.ID, httpapi.RelaySent)
+	if status.Attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", status.Attempts)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.rcpt) != 1 || u.rcpt[0] != "dev@team.example" {
+		t.Errorf("unexpected upstream recipients: %v", u.rcpt)
+	}
+}
+
+func TestRelayer_NoMatch(t *testing.T) {
+	s := httpapi.NewStorage()
+	rules, _ := relay.ParseRules(`@team\.example$`, "")
+	r := relay.New(s, relay.Config{Addr: "127.0.0.1:1"}, rules)
+
+	msg := &httpapi.Message{From: "a@b", To: []string{"c@d"}}
+	s.Add(msg)
+	if r.Enqueue(msg) {
+		t.Error("expected message not to be queued")
+	}
+	got, _ := s.Get(msg.ID)
+	if got.Relay != nil {
+		t.Errorf("expected no relay status, got %+v", got.Relay)
+	}
+}
+
+func TestRelayer_RetriesThenFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := httpapi.NewStorage()
+	rules, _ := relay.ParseRules(`.*`, "")
+	r := relay.New(s, relay.Config{Addr: addr, MaxAttempts: 2, RetryInterval: 10 * time.Millisecond}, rules)
+	r.Start()
+	defer r.Stop()
+
+	msg := &httpapi.Message{From: "a@b", To: []string{"c@d"}, Raw: []byte("\r\n")}
+	s.Add(msg)
+	r.Enqueue(msg)
+
+	status := waitState(t, s, msg.ID, httpapi.RelayFailed)
+	if status.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", status.Attempts)
+	}
+	if status.LastError == "" {
+		t.Error("expected last error to be recorded")
+	}
+}
@@ -0,0 +1,151 @@
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Tenant is a namespace of messages with its own API token
+type Tenant struct {
+	Name    string   `json:"name"`
+	Token   string   `json:"token"`
+	Users   []string `json:"users"`   // SMTP AUTH user names routed to the tenant
+	Domains []string `json:"domains"` // recipient domains routed to the tenant
+}
+
+// Registry routes messages to tenants and authenticates API tokens
+type Registry struct {
+	mu         sync.RWMutex
+	tenants    []Tenant
+	adminToken string
+}
+
+// New creates a registry. The admin token sees every tenant.
+func New(tenants []Tenant, adminToken string) (*Registry, error) {
+	r := &Registry{}
+	if err := r.Set(tenants, adminToken); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Set validates and replaces the tenant configuration
+func (r *Registry) Set(tenants []Tenant, adminToken string) error {
+	if err := Validate(tenants, adminToken); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenants = tenants
+	r.adminToken = adminToken
+	return nil
+}
+
+// Validate checks that tenants have unique names and tokens and that an
+// admin token is set with them
+func Validate(tenants []Tenant, adminToken string) error {
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, t := range tenants {
+		if t.Name == "" {
+			return errors.New("tenant without a name")
+		}
+		if t.Token == "" {
+			return fmt.Errorf("tenant %q has no token", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		if tokens[t.Token] || t.Token == adminToken {
+			return fmt.Errorf("tenant %q reuses another token", t.Name)
+		}
+		names[t.Name], tokens[t.Token] = true, true
+	}
+	if len(tenants) > 0 && adminToken == "" {
+		return errors.New("an admin token is required when tenants are configured")
+	}
+	return nil
+}
+
+// Enabled reports whether any tenant is configured. Without tenants the
+// API is open and messages are not namespaced.
+func (r *Registry) Enabled() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tenants) > 0
+}
+
+// Route returns the tenant of a message. An authenticated SMTP user takes
+// precedence over the recipient domains, the first recipient with a mapped
+// domain decides otherwise. Unrouted messages return "".
+func (r *Registry) Route(username string, to []string) string {
+	if r == nil {
+		return ""
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if username != "" {
+		for _, t := range r.tenants {
+			for _, u := range t.Users {
+				if strings.EqualFold(u, username) {
+					return t.Name
+				}
+			}
+		}
+	}
+
+	for _, rcpt := range to {
+		domain := rcpt[strings.LastIndex(rcpt, "@")+1:]
+		domain = strings.TrimSuffix(domain, ">")
+		for _, t := range r.tenants {
+			for _, d := range t.Domains {
+				if strings.EqualFold(d, domain) {
+					return t.Name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Authenticate resolves an API token. Admin tokens return admin true and
+// an empty tenant name.
+func (r *Registry) Authenticate(token string) (name string, admin bool, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if token == "" {
+		return "", false, false
+	}
+	if token == r.adminToken {
+		return "", true, true
+	}
+	for _, t := range r.tenants {
+		if t.Token == token {
+			return t.Name, false, true
+		}
+	}
+	return "", false, false
+}
+
+// Load reads a JSON array of tenants from path
+func Load(path string) ([]Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return tenants, nil
+}
@@ -0,0 +1,101 @@
+package tenant_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+)
+
+var tenants = []tenant.Tenant{
+	{Name: "alpha", Token: "alpha-token", Users: []string{"alpha-app"}, Domains: []string{"alpha.example"}},
+	{Name: "beta", Token: "beta-token", Domains: []string{"beta.example"}},
+}
+
+func TestRegistry_Route(t *testing.T) {
+	r, err := tenant.New(tenants, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user string
+		to   []string
+		want string
+	}{
+		{"alpha-app", []string{"x@beta.example"}, "alpha"},
+		{"ALPHA-APP", nil, "alpha"},
+		{"", []string{"x@other.example", "y@Beta.Example"}, "beta"},
+		{"unknown", []string{"<z@alpha.example>"}, "alpha"},
+		{"", []string{"x@other.example"}, ""},
+	}
+	for _, tt := range tests {
+		if got := r.Route(tt.user, tt.to); got != tt.want {
+			t.Errorf("Route(%q, %v) = %q, want %q", tt.user, tt.to, got, tt.want)
+		}
+	}
+
+	var nilRegistry *tenant.Registry
+	if nilRegistry.Enabled() || nilRegistry.Route("alpha-app", nil) != "" {
+		t.Error("nil registry must be disabled")
+	}
+}
+
+func TestRegistry_Authenticate(t *testing.T) {
+	r, err := tenant.New(tenants, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name, admin, ok := r.Authenticate("beta-token"); !ok || admin || name != "beta" {
+		t.Errorf("unexpected tenant auth: %q %v %v", name, admin, ok)
+	}
+	if _, admin, ok := r.Authenticate("admin"); !ok || !admin {
+		t.Error("expected admin token to authenticate as admin")
+	}
+	for _, token := range []string{"", "nope"} {
+		if _, _, ok := r.Authenticate(token); ok {
+			t.Errorf("expected token %q to be rejected", token)
+		}
+	}
+}
+
+func TestRegistry_Validation(t *testing.T) {
+	invalid := [][]tenant.Tenant{
+		{{Name: "", Token: "t"}},
+		{{Name: "a"}},
+		{{Name: "a", Token: "t"}, {Name: "a", Token: "u"}},
+		{{Name: "a", Token: "t"}, {Name: "b", Token: "t"}},
+		{{Name: "a", Token: "admin"}},
+	}
+	for _, ts := range invalid {
+		if _, err := tenant.New(ts, "admin"); err == nil {
+			t.Errorf("expected error for %+v", ts)
+		}
+	}
+	if _, err := tenant.New(tenants, ""); err == nil {
+		t.Error("expected error without admin token")
+	}
+	if _, err := tenant.New(nil, ""); err != nil {
+		t.Errorf("empty configuration must be valid: %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	os.WriteFile(path, []byte(`[{"name":"alpha","token":"t","domains":["alpha.example"]}]`), 0o600)
+
+	ts, err := tenant.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 1 || ts[0].Name != "alpha" || ts[0].Domains[0] != "alpha.example" {
+		t.Errorf("unexpected tenants %+v", ts)
+	}
+
+	os.WriteFile(path, []byte(`{`), 0o600)
+	if _, err := tenant.Load(path); err == nil {
+		t.Error("expected parse error")
+	}
+}
@@ -0,0 +1,554 @@
+// Package client is a typed Go client for the mail test server HTTP API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a captured email message
+type Message struct {
+	ID        int          `json:"id"`
+	From      string       `json:"from"`
+	To        []string     `json:"to"`
+	Subject   string       `json:"subject"`
+	Body      string       `json:"body"`
+	CreatedAt string       `json:"createdAt"`
+	Read      bool         `json:"read"`
+	Starred   bool         `json:"starred"`
+	Tags      []string     `json:"tags"`
+	Deleted   bool         `json:"deleted,omitempty"`
+	Tenant    string       `json:"tenant,omitempty"`
+	SessionID string       `json:"sessionId,omitempty"`
+	Relay     *RelayStatus `json:"relay,omitempty"`
+}
+
+// RelayStatus describes the upstream delivery state of a relayed message
+type RelayStatus struct {
+	State      string   `json:"state"`
+	Rule       string   `json:"rule,omitempty"`
+	Recipients []string `json:"recipients"`
+	Attempts   int      `json:"attempts"`
+	LastError  string   `json:"lastError,omitempty"`
+	UpdatedAt  string   `json:"updatedAt"`
+}
+
+// Mailbox summarises the messages of one envelope recipient
+type Mailbox struct {
+	Address  string `json:"address"`
+	Messages int    `json:"messages"`
+	Unread   int    `json:"unread"`
+}
+
+// Event is a storage change streamed by Subscribe
+type Event struct {
+	Type   string `json:"type"` // added, updated, deleted, cleared or restored
+	ID     int    `json:"id,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Link is a URL found in the HTML or text part of a message
+type Link struct {
+	URL    string `json:"url"`
+	Text   string `json:"text,omitempty"`   // anchor text, empty in plain text
+	Part   string `json:"part"`             // text/html or text/plain
+	Line   int    `json:"line"`             // line in the decoded part, from 1
+	Status int    `json:"status,omitempty"` // HEAD response status when checked
+	Error  string `json:"error,omitempty"`  // why a check failed or was skipped
+}
+
+// Code is a one-time code or token extracted from a message
+type Code struct {
+	Value   string `json:"value"`
+	Pattern string `json:"pattern"` // otp, token or a registered pattern name
+	Part    string `json:"part"`    // subject, text/plain or text/html
+}
+
+// CodePattern is a named regular expression extracting codes, the value is
+// the group named code, else the first group, else the whole match
+type CodePattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// HTMLCheck reports the HTML and CSS features of a message that some mail
+// clients do not support
+type HTMLCheck struct {
+	Clients []HTMLClientScore `json:"clients"`
+	Issues  []HTMLIssue       `json:"issues"`
+}
+
+// HTMLClientScore is the share of the detected features a client supports,
+// partial support counting half
+type HTMLClientScore struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Score       float64  `json:"score"` // 0 to 100
+	Unsupported []string `json:"unsupported"`
+	Partial     []string `json:"partial"`
+}
+
+// HTMLIssue is a detected feature with limited support
+type HTMLIssue struct {
+	Feature     string   `json:"feature"`
+	Title       string   `json:"title"`
+	Type        string   `json:"type"` // html or css
+	Lines       []int    `json:"lines"`
+	Unsupported []string `json:"unsupported"`
+	Partial     []string `json:"partial"`
+	Notes       string   `json:"notes,omitempty"`
+}
+
+// Patch changes the state of messages, nil fields are kept
+type Patch struct {
+	Read       *bool     `json:"read,omitempty"`
+	Starred    *bool     `json:"starred,omitempty"`
+	Tags       *[]string `json:"tags,omitempty"` // replaces all tags, an empty slice removes them
+	AddTags    []string  `json:"addTags,omitempty"`
+	RemoveTags []string  `json:"removeTags,omitempty"`
+}
+
+// Composition is a message for Inject, built into MIME by the server
+type Composition struct {
+	From        string            `json:"from"`
+	To          []string          `json:"to,omitempty"`
+	Cc          []string          `json:"cc,omitempty"`
+	Bcc         []string          `json:"bcc,omitempty"` // envelope only
+	Subject     string            `json:"subject,omitempty"`
+	Text        string            `json:"text,omitempty"`
+	HTML        string            `json:"html,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+}
+
+// Attachment is a file attached to a Composition
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"`
+	Content     []byte `json:"content"`
+}
+
+// Filter selects messages. Empty fields match everything, text fields are
+// case-insensitive substring matches.
+type Filter struct {
+	From     string
+	To       string
+	Subject  string
+	Contains string
+	Since    time.Time
+	Read     *bool    // nil matches read and unread messages
+	Starred  *bool    // nil matches starred and unstarred messages
+	Tags     []string // messages carrying every tag
+	Limit    int
+}
+
+func (f Filter) values() url.Values {
+	q := url.Values{}
+	for k, v := range map[string]string{"from": f.From, "to": f.To, "subject": f.Subject, "contains": f.Contains} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if f.Read != nil {
+		q.Set("read", strconv.FormatBool(*f.Read))
+	}
+	if f.Starred != nil {
+		q.Set("starred", strconv.FormatBool(*f.Starred))
+	}
+	for _, tag := range f.Tags {
+		q.Add("tag", tag)
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return q
+}
+
+// MailboxOptions controls how recipient addresses are grouped into mailboxes
+type MailboxOptions struct {
+	CaseSensitive bool // the server ignores case by default
+	StripPlus     bool
+}
+
+func (o MailboxOptions) values() url.Values {
+	q := url.Values{}
+	if o.CaseSensitive {
+		q.Set("ignoreCase", "false")
+	}
+	if o.StripPlus {
+		q.Set("stripPlus", "true")
+	}
+	return q
+}
+
+// Errors matched by errors.Is against an *APIError
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+)
+
+// APIError is returned for non-2xx responses
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("mail test server: %d %s", e.StatusCode, e.Message)
+}
+
+// Is maps the status code to ErrBadRequest, ErrUnauthorized or ErrNotFound
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// Client talks to one server
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken sends a bearer token, required when tenants are configured
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// New creates a client for the server at baseURL, e.g. "http://localhost:8025"
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// List returns the messages matching filter, ordered by ID
+func (c *Client) List(ctx context.Context, filter Filter) ([]Message, error) {
+	var messages []Message
+	err := c.getJSON(ctx, "/api/v1/messages", filter.values(), &messages)
+	return messages, err
+}
+
+// Get returns a message by ID
+func (c *Client) Get(ctx context.Context, id int) (*Message, error) {
+	var msg Message
+	if err := c.getJSON(ctx, fmt.Sprintf("/api/v1/messages/%d", id), nil, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Raw returns the RFC 822 source of a message
+func (c *Client) Raw(ctx context.Context, id int) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/messages/%d/raw", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Links returns the links of a message. With check the server sends a HEAD
+// request to each link on an allowed host and reports the status.
+func (c *Client) Links(ctx context.Context, id int, check bool) ([]Link, error) {
+	var q url.Values
+	if check {
+		q = url.Values{"check": {"true"}}
+	}
+	var links []Link
+	err := c.getJSON(ctx, fmt.Sprintf("/api/v1/messages/%d/links", id), q, &links)
+	return links, err
+}
+
+// Codes returns the one-time codes and tokens found in a message, those of
+// registered patterns first
+func (c *Client) Codes(ctx context.Context, id int) ([]Code, error) {
+	var codes []Code
+	err := c.getJSON(ctx, fmt.Sprintf("/api/v1/messages/%d/codes", id), nil, &codes)
+	return codes, err
+}
+
+// SetCodePatterns replaces the code patterns of the token's tenant, or the
+// global ones for the admin token or without tenants
+func (c *Client) SetCodePatterns(ctx context.Context, patterns []CodePattern) error {
+	if patterns == nil {
+		patterns = []CodePattern{}
+	}
+	var stored []CodePattern
+	return c.sendJSON(ctx, http.MethodPut, "/api/v1/code-patterns", patterns, &stored)
+}
+
+// HTMLCheck checks the HTML part of a message against the clients, all
+// known clients when none are given
+func (c *Client) HTMLCheck(ctx context.Context, id int, clients ...string) (*HTMLCheck, error) {
+	var q url.Values
+	if len(clients) > 0 {
+		q = url.Values{"clients": {strings.Join(clients, ",")}}
+	}
+	var check HTMLCheck
+	if err := c.getJSON(ctx, fmt.Sprintf("/api/v1/messages/%d/html-check", id), q, &check); err != nil {
+		return nil, err
+	}
+	return &check, nil
+}
+
+// Delete removes a message
+func (c *Client) Delete(ctx context.Context, id int) error {
+	resp, err := c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/v1/messages/%d", id), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Clear removes all messages visible to the token
+func (c *Client) Clear(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/messages/clear")
+}
+
+// Inject stores a composed message as if it had arrived over SMTP
+func (c *Client) Inject(ctx context.Context, msg Composition) (*Message, error) {
+	var created Message
+	if err := c.sendJSON(ctx, http.MethodPost, "/api/v1/messages", msg, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// InjectRaw stores an RFC 822 message. The envelope is taken from the
+// headers unless from or to are given.
+func (c *Client) InjectRaw(ctx context.Context, raw []byte, from string, to ...string) (*Message, error) {
+	q := url.Values{}
+	if from != "" {
+		q.Set("from", from)
+	}
+	for _, rcpt := range to {
+		q.Add("to", rcpt)
+	}
+	path := "/api/v1/messages"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return c.inject(ctx, path, "message/rfc822", bytes.NewReader(raw))
+}
+
+func (c *Client) inject(ctx context.Context, path, contentType string, body io.Reader) (*Message, error) {
+	var msg Message
+	if err := c.sendBody(ctx, http.MethodPost, path, contentType, body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// sendJSON sends body as JSON and decodes the response into v
+func (c *Client) sendJSON(ctx context.Context, method, path string, body, v any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.sendBody(ctx, method, path, "application/json", bytes.NewReader(data), v)
+}
+
+func (c *Client) sendBody(ctx context.Context, method, path, contentType string, body io.Reader, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Update applies p to a message and returns the updated message
+func (c *Client) Update(ctx context.Context, id int, p Patch) (*Message, error) {
+	var msg Message
+	if err := c.sendJSON(ctx, http.MethodPatch, fmt.Sprintf("/api/v1/messages/%d", id), p, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// UpdateAll applies p to the messages with the given IDs, or to all messages
+// matching filter when ids is empty, and returns the number updated. The
+// server rejects the call when both ids and filter are empty.
+func (c *Client) UpdateAll(ctx context.Context, ids []int, filter Filter, p Patch) (int, error) {
+	path := "/api/v1/messages"
+	if q := filter.values(); len(ids) == 0 && len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	body := struct {
+		IDs []int `json:"ids,omitempty"`
+		Patch
+	}{ids, p}
+	var result struct {
+		Updated int `json:"updated"`
+	}
+	err := c.sendJSON(ctx, http.MethodPatch, path, body, &result)
+	return result.Updated, err
+}
+
+// Tag adds tags to the messages with the given IDs
+func (c *Client) Tag(ctx context.Context, ids []int, tags ...string) error {
+	if len(ids) == 0 {
+		return nil // an empty list would tag every message
+	}
+	_, err := c.UpdateAll(ctx, ids, Filter{}, Patch{AddTags: tags})
+	return err
+}
+
+// Snapshot saves the server's messages under name, replacing an older
+// snapshot. It needs the admin token when tenants are configured.
+func (c *Client) Snapshot(ctx context.Context, name string) error {
+	return c.post(ctx, "/api/v1/admin/snapshots/"+url.PathEscape(name))
+}
+
+// Restore replaces the server's messages with the snapshot saved as name
+func (c *Client) Restore(ctx context.Context, name string) error {
+	return c.post(ctx, "/api/v1/admin/snapshots/"+url.PathEscape(name)+"/restore")
+}
+
+// Wait blocks until a message matching filter arrives or timeout expires,
+// returning ErrNotFound on timeout. Existing messages match immediately. A
+// zero timeout uses the server's default of 10 seconds.
+func (c *Client) Wait(ctx context.Context, filter Filter, timeout time.Duration) (*Message, error) {
+	q := filter.values()
+	q.Del("limit")
+	if timeout > 0 {
+		q.Set("timeout", timeout.String())
+	}
+	var msg Message
+	if err := c.getJSON(ctx, "/api/v1/messages/wait", q, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Mailboxes returns one entry per envelope recipient
+func (c *Client) Mailboxes(ctx context.Context, opts MailboxOptions) ([]Mailbox, error) {
+	var mailboxes []Mailbox
+	err := c.getJSON(ctx, "/api/v1/mailboxes", opts.values(), &mailboxes)
+	return mailboxes, err
+}
+
+// MailboxMessages returns the messages delivered to address
+func (c *Client) MailboxMessages(ctx context.Context, address string, opts MailboxOptions) ([]Message, error) {
+	var messages []Message
+	err := c.getJSON(ctx, "/api/v1/mailboxes/"+url.PathEscape(address)+"/messages", opts.values(), &messages)
+	return messages, err
+}
+
+// Subscribe streams storage events until ctx is cancelled or the
+// connection drops, then closes the channel
+func (c *Client) Subscribe(ctx context.Context) (<-chan Event, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/v1/events", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var ev Event
+			if json.Unmarshal([]byte(data), &ev) != nil {
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// post sends a POST without a body and discards the response
+func (c *Client) post(ctx context.Context, path string) error {
+	resp, err := c.do(ctx, http.MethodPost, path, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, q url.Values, v any) error {
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends a request and turns non-2xx responses into an *APIError
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(req)
+}
+
+// send adds the token to req and turns non-2xx responses into an *APIError
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
@@ -0,0 +1,331 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/internal/tenant"
+	"github.com/joukojo/go-mail-testserver/pkg/client"
+)
+
+func newClient(t *testing.T) (*httpapi.Storage, *client.Client) {
+	t.Helper()
+	storage := httpapi.NewStorage()
+	srv := httptest.NewServer(httpapi.New("", storage).Handler())
+	t.Cleanup(srv.Close)
+	return storage, client.New(srv.URL)
+}
+
+func add(s *httpapi.Storage, subject string, to ...string) int {
+	return s.Add(&httpapi.Message{From: "sender@example.com", To: to, Subject: subject,
+		Body: "Hello", Raw: []byte("Subject: " + subject + "\r\n\r\nHello\r\n")})
+}
+
+func TestClient_ListGetRawDelete(t *testing.T) {
+	storage, c := newClient(t)
+	ctx := context.Background()
+	add(storage, "Welcome", "alice@example.com")
+	id := add(storage, "Password reset", "bob@example.com")
+
+	messages, err := c.List(ctx, client.Filter{Subject: "RESET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != id {
+		t.Fatalf("expected only message %d, got %+v", id, messages)
+	}
+
+	msg, err := c.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.To[0] != "bob@example.com" {
+		t.Errorf("unexpected recipients %v", msg.To)
+	}
+
+	raw, err := c.Raw(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "Subject: Password reset\r\n\r\nHello\r\n" {
+		t.Errorf("unexpected raw message %q", raw)
+	}
+
+	if err := c.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(ctx, id)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 404 {
+		t.Errorf("expected *APIError with status 404, got %v", err)
+	}
+}
+
+func TestClient_Wait(t *testing.T) {
+	storage, c := newClient(t)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		add(storage, "Other", "bob@example.com")
+		add(storage, "Your code", "alice@example.com")
+	}()
+
+	msg, err := c.Wait(context.Background(), client.Filter{To: "alice@"}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Your code" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	_, err = c.Wait(context.Background(), client.Filter{To: "nobody@"}, 50*time.Millisecond)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound on timeout, got %v", err)
+	}
+
+	// A zero timeout leaves the default to the server
+	msg, err = c.Wait(context.Background(), client.Filter{To: "alice@"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Your code" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	storage, c := newClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := c.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := add(storage, "Hello", "alice@example.com")
+
+	select {
+	case ev := <-events:
+		if ev.Type != "added" || ev.ID != id {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestClient_Mailboxes(t *testing.T) {
+	storage, c := newClient(t)
+	add(storage, "One", "Alice+news@example.com")
+	add(storage, "Two", "alice@example.com")
+
+	mailboxes, err := c.Mailboxes(context.Background(), client.MailboxOptions{StripPlus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mailboxes) != 1 || mailboxes[0].Messages != 2 {
+		t.Fatalf("expected one mailbox with 2 messages, got %+v", mailboxes)
+	}
+
+	messages, err := c.MailboxMessages(context.Background(), "alice@example.com", client.MailboxOptions{StripPlus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(messages))
+	}
+}
+
+func TestClient_Token(t *testing.T) {
+	storage := httpapi.NewStorage()
+	api := httpapi.New("", storage)
+	registry, err := tenant.New([]tenant.Tenant{{Name: "team-a", Token: "a-token", Domains: []string{"a.example.com"}}}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetTenants(registry)
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+	storage.Add(&httpapi.Message{To: []string{"x@a.example.com"}, Tenant: "team-a"})
+	storage.Add(&httpapi.Message{To: []string{"x@b.example.com"}})
+
+	_, err = client.New(srv.URL).List(context.Background(), client.Filter{})
+	if !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized without token, got %v", err)
+	}
+
+	messages, err := client.New(srv.URL, client.WithToken("a-token")).List(context.Background(), client.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Tenant != "team-a" {
+		t.Errorf("expected only the tenant's message, got %+v", messages)
+	}
+}
+
+func TestClient_Inject(t *testing.T) {
+	storage, c := newClient(t)
+	ctx := context.Background()
+
+	msg, err := c.Inject(ctx, client.Composition{
+		From:        "shop@example.com",
+		To:          []string{"alice@example.com"},
+		Subject:     "Your order",
+		Text:        "Thanks",
+		Attachments: []client.Attachment{{Filename: "receipt.txt", Content: []byte("100 EUR")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Your order" || msg.To[0] != "alice@example.com" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	raw := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: Raw\r\n\r\nHello\r\n")
+	msg, err = c.InjectRaw(ctx, raw, "", "c@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != "a@example.com" || len(msg.To) != 1 || msg.To[0] != "c@example.com" {
+		t.Errorf("unexpected envelope %q -> %v", msg.From, msg.To)
+	}
+	if stored, _ := storage.Get(msg.ID); stored == nil || string(stored.Raw) != string(raw) {
+		t.Error("raw message not stored as sent")
+	}
+
+	_, err = c.Inject(ctx, client.Composition{From: "shop@example.com"})
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 400 {
+		t.Errorf("expected 400 without recipients, got %v", err)
+	}
+}
+
+func TestClient_SnapshotRestore(t *testing.T) {
+	storage, c := newClient(t)
+	ctx := context.Background()
+	id := add(storage, "Seed", "alice@example.com")
+
+	if err := c.Snapshot(ctx, "seeded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Restore(ctx, "seeded"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := c.Get(ctx, id); err != nil || msg.Subject != "Seed" {
+		t.Errorf("expected restored message, got %+v, %v", msg, err)
+	}
+	if err := c.Restore(ctx, "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestClient_UpdateAndTag(t *testing.T) {
+	storage, c := newClient(t)
+	ctx := context.Background()
+	first := add(storage, "Welcome", "alice@example.com")
+	second := add(storage, "Reset", "alice@example.com")
+
+	starred := true
+	msg, err := c.Update(ctx, first, client.Patch{Starred: &starred, AddTags: []string{"reviewed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Starred || len(msg.Tags) != 1 || msg.Tags[0] != "reviewed" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	if err := c.Tag(ctx, []int{first, second}, "TC-42"); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := c.List(ctx, client.Filter{Tags: []string{"TC-42"}, Starred: &starred})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != first {
+		t.Errorf("expected only message %d, got %+v", first, messages)
+	}
+
+	read := true
+	n, err := c.UpdateAll(ctx, nil, client.Filter{Subject: "reset"}, client.Patch{Read: &read})
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 updated, got %d, %v", n, err)
+	}
+
+	msg, err = c.Update(ctx, first, client.Patch{Tags: &[]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Tags) != 0 {
+		t.Errorf("expected an empty Tags patch to clear the tags, got %v", msg.Tags)
+	}
+}
+
+func TestClient_Links(t *testing.T) {
+	storage, c := newClient(t)
+	ctx := context.Background()
+	id := storage.Add(&httpapi.Message{Raw: []byte("Content-Type: text/html\r\n\r\n" +
+		`<a href="https://app.example.test/confirm?token=abc">Confirm</a>` + "\r\n")})
+
+	links, err := c.Links(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].URL != "https://app.example.test/confirm?token=abc" || links[0].Text != "Confirm" {
+		t.Fatalf("unexpected links %+v", links)
+	}
+
+	// No hosts are allowed by default, so nothing is requested
+	links, err = c.Links(ctx, id, true)
+	if err != nil || links[0].Status != 0 || links[0].Error != "host not allowed" {
+		t.Errorf("unexpected check %+v, %v", links, err)
+	}
+}
+
+func TestClient_Codes(t *testing.T) {
+	storage, c := newClient(t)
+	ctx := context.Background()
+	id := storage.Add(&httpapi.Message{Raw: []byte("Subject: Sign in\r\n\r\nYour code is 482913, ticket T-7781\r\n")})
+
+	if err := c.SetCodePatterns(ctx, []client.CodePattern{{Name: "ticket", Pattern: `T-(\d+)`}}); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := c.Codes(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 2 || codes[0].Value != "7781" || codes[0].Pattern != "ticket" || codes[1].Value != "482913" {
+		t.Errorf("unexpected codes %+v", codes)
+	}
+
+	if err := c.SetCodePatterns(ctx, []client.CodePattern{{Name: "broken", Pattern: "("}}); !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("expected a bad request error, got %v", err)
+	}
+}
+
+func TestClient_HTMLCheck(t *testing.T) {
+	storage, c := newClient(t)
+	ctx := context.Background()
+	id := storage.Add(&httpapi.Message{Raw: []byte("Content-Type: text/html\r\n\r\n" +
+		`<div style="display: grid">Sale</div>` + "\r\n")})
+
+	check, err := c.HTMLCheck(ctx, id, "outlook-windows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(check.Clients) != 1 || check.Clients[0].Score != 0 || len(check.Issues) != 1 || check.Issues[0].Feature != "css-display-grid" {
+		t.Errorf("unexpected check %+v", check)
+	}
+	if _, err := c.HTMLCheck(ctx, id, "lynx"); !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("expected a bad request error, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package mailtest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/internal/mimeparse"
+	"github.com/joukojo/go-mail-testserver/pkg/client"
+)
+
+// Expectation describes a message a test waits for. Build it with Expect,
+// add conditions and finish with Within.
+type Expectation struct {
+	t      testing.TB
+	srv    *Server
+	checks []check
+}
+
+// check is one condition, it returns "" when the message passes and
+// otherwise what the message has instead
+type check struct {
+	want string
+	fn   func(*parsed) string
+}
+
+// parsed is a captured message with its MIME structure decoded
+type parsed struct {
+	client.Message
+	text        string   // concatenated text parts
+	attachments []string // file names
+}
+
+// Expect starts an expectation on the messages captured by srv
+func Expect(t testing.TB, srv *Server) *Expectation {
+	return &Expectation{t: t, srv: srv}
+}
+
+// From requires the envelope sender to equal addr, ignoring case
+func (e *Expectation) From(addr string) *Expectation {
+	return e.add(fmt.Sprintf("from %q", addr), func(p *parsed) string {
+		if strings.EqualFold(p.From, addr) {
+			return ""
+		}
+		return fmt.Sprintf("from %q", p.From)
+	})
+}
+
+// To requires addr among the envelope recipients, ignoring case
+func (e *Expectation) To(addr string) *Expectation {
+	return e.add(fmt.Sprintf("to %q", addr), func(p *parsed) string {
+		for _, rcpt := range p.To {
+			if strings.EqualFold(rcpt, addr) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("to %q", p.To)
+	})
+}
+
+// SubjectContains requires the decoded subject to contain s
+func (e *Expectation) SubjectContains(s string) *Expectation {
+	return e.add(fmt.Sprintf("subject containing %q", s), func(p *parsed) string {
+		if strings.Contains(p.Subject, s) {
+			return ""
+		}
+		return fmt.Sprintf("subject %q", p.Subject)
+	})
+}
+
+// BodyContains requires a text part of the message to contain s
+func (e *Expectation) BodyContains(s string) *Expectation {
+	return e.add(fmt.Sprintf("body containing %q", s), func(p *parsed) string {
+		if strings.Contains(p.text, s) {
+			return ""
+		}
+		return fmt.Sprintf("body %q", truncate(p.text, 80))
+	})
+}
+
+// HasAttachment requires an attachment named filename
+func (e *Expectation) HasAttachment(filename string) *Expectation {
+	return e.add(fmt.Sprintf("attachment %q", filename), func(p *parsed) string {
+		for _, name := range p.attachments {
+			if name == filename {
+				return ""
+			}
+		}
+		return fmt.Sprintf("attachments %q", p.attachments)
+	})
+}
+
+func (e *Expectation) add(want string, fn func(*parsed) string) *Expectation {
+	e.checks = append(e.checks, check{want: want, fn: fn})
+	return e
+}
+
+// Within waits up to d for a matching message and returns the first one.
+// The test fails with a report of every received message on timeout.
+func (e *Expectation) Within(d time.Duration) client.Message {
+	e.t.Helper()
+
+	// Subscribe before looking so no message slips through in between
+	events, cancel := e.srv.storage.Subscribe()
+	defer cancel()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		var received []*parsed
+		for _, msg := range e.srv.Messages() {
+			p := e.srv.parse(msg)
+			if e.match(p) {
+				return msg
+			}
+			received = append(received, p)
+		}
+
+		select {
+		case <-events:
+		case <-timer.C:
+			e.t.Fatal(e.report(d, received))
+			return client.Message{}
+		}
+	}
+}
+
+func (e *Expectation) match(p *parsed) bool {
+	for _, c := range e.checks {
+		if c.fn(p) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// report explains the expectation and how each received message differs
+func (e *Expectation) report(d time.Duration, received []*parsed) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "mailtest: no message matched within %v\n", d)
+	wants := make([]string, len(e.checks))
+	for i, c := range e.checks {
+		wants[i] = c.want
+	}
+	fmt.Fprintf(&b, "expected a message with %s\n", strings.Join(wants, ", "))
+
+	if len(received) == 0 {
+		b.WriteString("received no messages")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "received %d message(s):", len(received))
+	for _, p := range received {
+		fmt.Fprintf(&b, "\n  #%d from %q to %q subject %q", p.ID, p.From, p.To, p.Subject)
+		for _, c := range e.checks {
+			if got := c.fn(p); got != "" {
+				fmt.Fprintf(&b, "\n    - want %s, got %s", c.want, got)
+			}
+		}
+	}
+	return b.String()
+}
+
+// parse decodes msg with the parser the HTTP API uses, so attachments are
+// the ones the API reports. Messages that are not valid MIME are treated
+// as a single text part.
+func (s *Server) parse(msg client.Message) *parsed {
+	p := &parsed{Message: msg}
+	raw, _ := s.Raw(msg.ID)
+
+	m := mimeparse.Parse(raw, msg.Body)
+	if len(m.Parts) == 0 {
+		p.text = m.Text
+	}
+	for _, part := range m.Parts {
+		if !part.Attachment && strings.HasPrefix(part.ContentType, "text/") {
+			p.text += string(part.Body)
+		}
+	}
+	for _, part := range m.Attachments {
+		p.attachments = append(p.attachments, part.FileName)
+	}
+	return p
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+package mailtest_test
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joukojo/go-mail-testserver/pkg/mailtest"
+)
+
+const invoiceMessage = "From: billing@example.com\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Your invoice\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"\r\n" +
+	"Invoice attached\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=invoice.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0=\r\n" +
+	"--b--\r\n"
+
+func send(srv *mailtest.Server, to, raw string) error {
+	return smtp.SendMail(srv.SMTPAddr, nil, "billing@example.com", []string{to}, []byte(raw))
+}
+
+func TestExpect_Match(t *testing.T) {
+	srv := mailtest.Start(t)
+	sent := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := send(srv, "bob@example.com", "Subject: Welcome\r\n\r\nHi\r\n"); err != nil {
+			sent <- err
+			return
+		}
+		sent <- send(srv, "alice@example.com", invoiceMessage)
+	}()
+	defer func() {
+		if err := <-sent; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	msg := mailtest.Expect(t, srv).
+		To("alice@example.com").
+		SubjectContains("invoice").
+		BodyContains("Invoice attached").
+		HasAttachment("invoice.pdf").
+		Within(5 * time.Second)
+	if msg.Subject != "Your invoice" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+// recorder captures a fatal failure instead of stopping the test
+type recorder struct {
+	testing.TB
+	failure string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Fatal(args ...any) {
+	r.failure = args[0].(string)
+}
+
+func TestExpect_Report(t *testing.T) {
+	srv := mailtest.Start(t)
+	if err := send(srv, "alice@example.com", invoiceMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recorder{TB: t}
+	mailtest.Expect(rec, srv).To("alice@example.com").SubjectContains("Reset").HasAttachment("report.csv").Within(20 * time.Millisecond)
+
+	for _, want := range []string{
+		`expected a message with to "alice@example.com", subject containing "Reset", attachment "report.csv"`,
+		`#1 from "billing@example.com" to ["alice@example.com"] subject "Your invoice"`,
+		`want subject containing "Reset", got subject "Your invoice"`,
+		`want attachment "report.csv", got attachments ["invoice.pdf"]`,
+	} {
+		if !strings.Contains(rec.failure, want) {
+			t.Errorf("report misses %q:\n%s", want, rec.failure)
+		}
+	}
+	if strings.Contains(rec.failure, "want to") {
+		t.Errorf("report lists a passing condition:\n%s", rec.failure)
+	}
+}
+
+func TestExpect_InlineImageIsNotAnAttachment(t *testing.T) {
+	srv := mailtest.Start(t)
+	raw := "Subject: Newsletter\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<img src=\"cid:logo\">\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: inline; filename=logo.png\r\n" +
+		"Content-Id: <logo>\r\n" +
+		"\r\n" +
+		"png\r\n" +
+		"--b--\r\n"
+	if err := send(srv, "alice@example.com", raw); err != nil {
+		t.Fatal(err)
+	}
+
+	// The HTTP API lists the image as an inline part, not an attachment
+	rec := &recorder{TB: t}
+	mailtest.Expect(rec, srv).HasAttachment("logo.png").Within(20 * time.Millisecond)
+	if !strings.Contains(rec.failure, `got attachments []`) {
+		t.Errorf("expected the inline image not to count as an attachment, got %q", rec.failure)
+	}
+}
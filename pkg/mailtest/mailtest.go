@@ -0,0 +1,116 @@
+// Package mailtest runs the mail test server inside a Go test process.
+//
+//	srv := mailtest.Start(t)
+//	// point the code under test at srv.SMTPAddr
+//	messages := srv.Messages()
+package mailtest
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/internal/commonssmtp"
+	"github.com/joukojo/go-mail-testserver/internal/httpapi"
+	"github.com/joukojo/go-mail-testserver/pkg/client"
+)
+
+// Server is an SMTP and HTTP server pair on random loopback ports
+type Server struct {
+	SMTPAddr string // host:port of the SMTP listener
+	URL      string // base URL of the HTTP API, e.g. http://127.0.0.1:54321
+
+	storage *httpapi.Storage
+	client  *client.Client
+}
+
+// Start starts the servers and stops them when the test finishes
+func Start(t testing.TB) *Server {
+	t.Helper()
+
+	smtpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("mailtest: listen SMTP: %v", err)
+	}
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		smtpListener.Close()
+		t.Fatalf("mailtest: listen HTTP: %v", err)
+	}
+
+	storage := httpapi.NewStorage()
+	smtpServer := commonssmtp.NewSmtpServer(storage, smtpListener.Addr().String())
+	apiServer := httpapi.New(httpListener.Addr().String(), storage)
+	go smtpServer.Serve(smtpListener)
+	go apiServer.Serve(httpListener)
+	t.Cleanup(func() {
+		smtpServer.Close()
+		apiServer.Close()
+	})
+
+	url := "http://" + httpListener.Addr().String()
+	return &Server{
+		SMTPAddr: smtpListener.Addr().String(),
+		URL:      url,
+		storage:  storage,
+		client:   client.New(url),
+	}
+}
+
+// Client returns an HTTP API client for the server
+func (s *Server) Client() *client.Client {
+	return s.client
+}
+
+// Messages returns the captured messages ordered by ID
+func (s *Server) Messages() []client.Message {
+	stored := s.storage.List()
+	messages := make([]client.Message, 0, len(stored))
+	for _, msg := range stored {
+		messages = append(messages, toClient(msg))
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages
+}
+
+// Raw returns the RFC 822 source of a message
+func (s *Server) Raw(id int) ([]byte, bool) {
+	msg, ok := s.storage.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return msg.Raw, true
+}
+
+// Clear removes all captured messages
+func (s *Server) Clear() {
+	s.storage.Clear()
+}
+
+func toClient(msg httpapi.Message) client.Message {
+	m := client.Message{
+		ID:        msg.ID,
+		From:      msg.From,
+		To:        msg.To,
+		Subject:   msg.Subject,
+		Body:      msg.Body,
+		CreatedAt: msg.CreatedAt,
+		Read:      msg.Read,
+		Starred:   msg.Starred,
+		Tags:      msg.Tags,
+		Deleted:   msg.Deleted,
+		Tenant:    msg.Tenant,
+		SessionID: msg.SessionID,
+	}
+	if r := msg.Relay; r != nil {
+		m.Relay = &client.RelayStatus{
+			State:      r.State,
+			Rule:       r.Rule,
+			Recipients: r.Recipients,
+			Attempts:   r.Attempts,
+			LastError:  r.LastError,
+			UpdatedAt:  r.UpdatedAt,
+		}
+	}
+	return m
+}
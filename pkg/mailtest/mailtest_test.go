@@ -0,0 +1,55 @@
+package mailtest_test
+
+import (
+	"context"
+	"net/smtp"
+	"testing"
+
+	"github.com/joukojo/go-mail-testserver/pkg/client"
+	"github.com/joukojo/go-mail-testserver/pkg/mailtest"
+)
+
+func TestStart(t *testing.T) {
+	srv := mailtest.Start(t)
+
+	err := smtp.SendMail(srv.SMTPAddr, nil, "sender@example.com", []string{"alice@example.com"},
+		[]byte("Subject: Hello\r\n\r\nHi Alice\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 || messages[0].To[0] != "alice@example.com" {
+		t.Fatalf("expected one message to alice, got %+v", messages)
+	}
+	raw, ok := srv.Raw(messages[0].ID)
+	if !ok || string(raw) != "Subject: Hello\r\n\r\nHi Alice\r\n" {
+		t.Errorf("unexpected raw message %q", raw)
+	}
+
+	listed, err := srv.Client().List(context.Background(), client.Filter{To: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 {
+		t.Errorf("expected the HTTP API to list 1 message, got %d", len(listed))
+	}
+
+	srv.Clear()
+	if len(srv.Messages()) != 0 {
+		t.Error("expected Clear to remove all messages")
+	}
+}
+
+func TestStart_Isolated(t *testing.T) {
+	a, b := mailtest.Start(t), mailtest.Start(t)
+	if a.SMTPAddr == b.SMTPAddr || a.URL == b.URL {
+		t.Fatal("expected servers on distinct ports")
+	}
+	if err := smtp.SendMail(a.SMTPAddr, nil, "s@example.com", []string{"x@example.com"}, []byte("\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Messages()) != 0 {
+		t.Error("expected servers not to share storage")
+	}
+}